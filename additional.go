@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Additional adds the addresses of the names that MX, SRV and NS answers point
+// to into the additional section of the message, saving clients a query for
+// each of them. Only names within the zone being answered from are looked up
+// (as clients wouldn't trust addresses from anywhere else), and addresses are
+// only added while the message still fits within the limit on the size of the
+// response, as they're optional.
+func (r *Resolver) Additional(req *dns.Msg, msg *dns.Msg, zone string, limit int) error {
+	additionalCounter := metrics.GetOrRegisterCounter("resolver.answers.additional", metrics.DefaultRegistry)
+
+	zone = strings.ToLower(zone)
+	sign := r.signer != nil && dnssecOK(req)
+
+	seen := make(map[string]bool)
+	for _, rr := range msg.Answer {
+		seen[strings.ToLower(rr.Header().Name)] = true
+	}
+	for _, rr := range msg.Answer {
+		target := strings.ToLower(additionalTarget(rr))
+		if target == "" || seen[target] || !dns.IsSubDomain(zone, target) {
+			continue
+		}
+		seen[target] = true
+
+		for _, rrType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			records, err := r.LookupAnswersForType(target, rrType)
+			if err != nil {
+				return err
+			} else if len(records) == 0 {
+				continue
+			}
+			if sign {
+				records = append(records, r.signer.Sign(records)...)
+			}
+
+			extra := msg.Extra
+			msg.Extra = append(msg.Extra, records...)
+			if msg.Len() > limit {
+				msg.Extra = extra
+				return nil
+			}
+			additionalCounter.Inc(int64(len(records)))
+		}
+	}
+	return nil
+}
+
+// additionalTarget returns the name that a record points to, that clients
+// will need the address of, or an empty string if there isn't one
+func additionalTarget(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.MX:
+		return rr.Mx
+	case *dns.SRV:
+		return rr.Target
+	case *dns.NS:
+		return rr.Ns
+	}
+	return ""
+}
+
+// maxMsgSize returns the largest response the client sending the request can
+// receive over UDP, the buffer size it advertised with EDNS0 or the 512 bytes
+// every client supports. This is the limit when the transport and our own
+// limit aren't known (see responseLimit).
+func maxMsgSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
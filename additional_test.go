@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+var testAdditionalRecords = map[string]string{
+	".SOA.ttl":   "3600",
+	"ns1/.A":     "1.1.1.1",
+	".MX/0":      "10\tmail.disco.net.",
+	".MX/1":      "20\tmail.elsewhere.org.",
+	"mail/.A":    "1.1.1.2",
+	"mail/.AAAA": "::2",
+}
+
+func TestLookupAdditional(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupAdditional/"
+	newTestZone("TestLookupAdditional", testAdditionalRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	query := new(dns.Msg)
+	query.SetQuestion("disco.net.", dns.TypeMX)
+	answer := resolver.Lookup(query)
+
+	if len(answer.Answer) != 2 {
+		t.Fatal("Expected two answers, got ", answer.Answer)
+	}
+	// Only the mail server within the zone is looked up
+	if len(answer.Extra) != 2 {
+		t.Fatal("Expected the addresses of the mail server, got ", answer.Extra)
+	}
+	for _, rr := range answer.Extra {
+		if rr.Header().Name != "mail.disco.net." {
+			t.Fatal("Expected additional records for mail.disco.net., got ", rr)
+		}
+	}
+
+	query.SetQuestion("disco.net.", dns.TypeNS)
+	if answer = resolver.Lookup(query); len(answer.Extra) != 1 || answer.Extra[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Fatal("Expected the address of the name server, got ", answer.Extra)
+	}
+}
+
+func TestLookupAdditionalSize(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupAdditionalSize/"
+	newTestZone("TestLookupAdditionalSize", testAdditionalRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	for i := 0; i < 6; i++ {
+		store.Set(fmt.Sprintf("TestLookupAdditionalSize/net/disco/_tcp/_http/.SRV/%d", i), fmt.Sprintf("10\t10\t80\tw%d.disco.net.", i))
+		store.Set(fmt.Sprintf("TestLookupAdditionalSize/net/disco/w%d/.A", i), fmt.Sprintf("1.1.2.%d", i))
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("_http._tcp.disco.net.", dns.TypeSRV)
+	answer := resolver.Lookup(query)
+	if len(answer.Answer) != 6 {
+		t.Fatal("Expected all of the answers, got ", len(answer.Answer))
+	}
+	if len(answer.Extra) == 0 || len(answer.Extra) == 6 || answer.Len() > dns.MinMsgSize {
+		t.Fatalf("Expected only as many additional records as fit in %d bytes, got %d (%d bytes)", dns.MinMsgSize, len(answer.Extra), answer.Len())
+	}
+
+	query.SetEdns0(4096, false)
+	if answer = resolver.Lookup(query); len(answer.Extra) != 6 {
+		t.Fatal("Expected every additional record to fit in a larger buffer, got ", len(answer.Extra))
+	}
+}
+
+func TestHandleAdditionalLimit(t *testing.T) {
+	resolver.etcdPrefix = "TestHandleAdditionalLimit/"
+	records := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		records[fmt.Sprintf("_tcp/_http/.SRV/%d", i)] = fmt.Sprintf("10\t10\t80\tw%d.disco.net.", i)
+		records[fmt.Sprintf("w%d/.A", i)] = fmt.Sprintf("1.1.2.%d", i)
+		records[fmt.Sprintf("w%d/.AAAA", i)] = fmt.Sprintf("fd00::%d", i)
+	}
+	newTestZone("TestHandleAdditionalLimit", records)
+	defer store.Delete(resolver.etcdPrefix)
+
+	query := func(addr net.Addr, size uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("_http._tcp.disco.net.", dns.TypeSRV)
+		if size > 0 {
+			req.SetEdns0(size, false)
+		}
+		w := &testResponseWriter{remoteAddr: addr}
+		newTestHandler().Handle(w, req)
+		return w.msgs[0]
+	}
+
+	// Over UDP the additional records are limited by our own 1232 byte limit,
+	// rather than the client's larger buffer
+	msg := query(testUDPAddr, 4096)
+	if msg.Truncated || len(msg.Answer) != 20 {
+		t.Fatal("Expected all of the answers, got ", len(msg.Answer))
+	}
+	if len(msg.Extra) <= 1 || len(msg.Extra) > 40 || msg.Len() > 1232 {
+		t.Fatalf("Expected as many additional records as fit in 1232 bytes, got %d (%d bytes)", len(msg.Extra)-1, msg.Len())
+	}
+	if opt := msg.Extra[len(msg.Extra)-1]; opt.Header().Rrtype != dns.TypeOPT {
+		t.Fatal("Expected the OPT record to be kept, got ", opt)
+	}
+
+	// Over TCP the response can be as big as it needs to be
+	if msg = query(testTCPAddr, 0); len(msg.Extra) != 40 {
+		t.Fatal("Expected every additional record over TCP, got ", len(msg.Extra))
+	}
+}
+
+func TestLookupSignedAdditional(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupSignedAdditional/"
+	newTestZone("TestLookupSignedAdditional", testAdditionalRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	zsk, _, _ := newTestSigningKey(t, "disco.net.", 256)
+	resolver.signer = newTestSigner(zsk)
+	defer func() { resolver.signer = nil }()
+
+	answer := resolver.Lookup(newTestDNSSECRequest("disco.net.", dns.TypeMX))
+	verifySigned(t, answer.Extra, dns.TypeA, zsk)
+	verifySigned(t, answer.Extra, dns.TypeAAAA, zsk)
+}
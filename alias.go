@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+// How long to wait for an answer from the upstream nameserver when looking up
+// the target of an ALIAS record
+const aliasUpstreamTimeout = 2 * time.Second
+
+// Number of answers from the upstream nameserver to cache for ALIAS records
+const aliasCacheSize = 10000
+
+// cachedAlias is an answer from the upstream nameserver for the target of an
+// ALIAS record, and when it was fetched and expires
+type cachedAlias struct {
+	records []dns.RR
+	fetched time.Time
+	expires time.Time
+}
+
+// AliasCache holds the answers from the upstream nameserver for the targets of
+// ALIAS records, for as long as their TTLs allow (and no longer than the TTL
+// of the ALIAS record the answer is for).
+type AliasCache struct {
+	sync.Mutex
+	size    int
+	answers map[string]*cachedAlias
+}
+
+// NewAliasCache creates an AliasCache holding up to size answers
+func NewAliasCache(size int) *AliasCache {
+	return &AliasCache{
+		size:    size,
+		answers: make(map[string]*cachedAlias)}
+}
+
+// Alias returns the A or AAAA records for a name with an ALIAS record, which
+// (unlike a CNAME record) can sit alongside other records, such as at the apex
+// of a zone. The name the ALIAS points to is looked up as each query is
+// answered, and its addresses returned as if they belonged to the name itself,
+// with their TTLs no higher than the ALIAS record's own.
+//
+// Targets within a zone served here are looked up directly (following CNAME
+// records, but not other ALIAS records), anything else is looked up with the
+// upstream nameserver if there is one. Answers from upstream are cached (see
+// AliasCache).
+func (r *Resolver) Alias(name string, rrType uint16) (answers []dns.RR, err error) {
+	aliasCounter := metrics.GetOrRegisterCounter("resolver.answers.alias", metrics.DefaultRegistry)
+
+	name = strings.ToLower(name)
+	nodes, err := r.GetFromStorage(nameToKey(name, "/.ALIAS"))
+	if err != nil {
+		if _, ok := err.(*KeyNotFoundError); ok {
+			return nil, nil
+		}
+		return
+	}
+	if len(nodes) != 1 {
+		return nil, &RecordValueError{
+			Message:       "Multiple ALIAS records is invalid",
+			AttemptedType: rrType}
+	}
+	alias := nodes[0]
+	target := dns.Fqdn(strings.ToLower(alias.node.Value))
+	if labels, ok := dns.IsDomainName(target); !ok || labels == 0 {
+		return nil, &NodeConversionError{
+			Node:          alias.node,
+			Message:       fmt.Sprintf("Value '%s' isn't a valid domain name", alias.node.Value),
+			AttemptedType: rrType}
+	}
+	aliasCounter.Inc(1)
+
+	var records []dns.RR
+	if r.Authority(target) != nil {
+		records, err = r.aliasLocal(target, rrType)
+	} else if r.aliasUpstream != "" {
+		records, err = r.aliasRemote(target, rrType, alias.ttl)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rr := range records {
+		if rr.Header().Rrtype != rrType {
+			continue
+		}
+		answer := dns.Copy(rr)
+		answer.Header().Name = name
+		if answer.Header().Ttl > alias.ttl {
+			answer.Header().Ttl = alias.ttl
+		}
+		answers = append(answers, answer)
+	}
+	return
+}
+
+// aliasLocal looks up the records for the target of an ALIAS in the store,
+// following any CNAME records
+func (r *Resolver) aliasLocal(target string, rrType uint16) ([]dns.RR, error) {
+	for i := 0; i <= maxCNAMEChain; i++ {
+		records, err := r.LookupAnswersForType(target, rrType)
+		if err != nil || len(records) > 0 {
+			return records, err
+		}
+		cnames, err := r.LookupAnswersForType(target, dns.TypeCNAME)
+		if err != nil || len(cnames) == 0 {
+			return nil, err
+		}
+		target = strings.ToLower(cnames[0].(*dns.CNAME).Target)
+	}
+	return nil, nil
+}
+
+// aliasRemote looks up the records for the target of an ALIAS with the
+// upstream nameserver, unless they're in the cache. Answers are cached for no
+// longer than the TTL of the ALIAS.
+func (r *Resolver) aliasRemote(target string, rrType uint16, maxTTL uint32) ([]dns.RR, error) {
+	if records, ok := r.aliasCache.get(target, rrType, maxTTL); ok {
+		return records, nil
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(target, rrType)
+	client := &dns.Client{Net: "udp", Timeout: aliasUpstreamTimeout}
+	resp, _, err := client.Exchange(req, r.aliasUpstream)
+	if err != nil {
+		return nil, &UpstreamError{Addr: r.aliasUpstream, Message: err.Error()}
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, &UpstreamError{
+			Addr:    r.aliasUpstream,
+			Message: fmt.Sprintf("%s for %s", dns.RcodeToString[resp.Rcode], target)}
+	}
+	r.aliasCache.add(target, rrType, resp, maxTTL)
+	return resp.Answer, nil
+}
+
+// get returns the cached answer for a target, as long as it hasn't expired
+// and was fetched no more than maxTTL seconds ago. The TTLs of the records
+// are reduced by the time they've been cached for.
+func (c *AliasCache) get(target string, rrType uint16, maxTTL uint32) ([]dns.RR, bool) {
+	hitCounter := metrics.GetOrRegisterCounter("resolver.alias.cache_hit", metrics.DefaultRegistry)
+	missCounter := metrics.GetOrRegisterCounter("resolver.alias.cache_miss", metrics.DefaultRegistry)
+	if c == nil {
+		return nil, false
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	cached, ok := c.answers[aliasCacheKey(target, rrType)]
+	if !ok || !now.Before(cached.expires) || !now.Before(cached.fetched.Add(time.Duration(maxTTL)*time.Second)) {
+		missCounter.Inc(1)
+		return nil, false
+	}
+	hitCounter.Inc(1)
+
+	elapsed := uint32(now.Sub(cached.fetched) / time.Second)
+	records := make([]dns.RR, len(cached.records))
+	for i, rr := range cached.records {
+		records[i] = dns.Copy(rr)
+		records[i].Header().Ttl -= elapsed
+	}
+	return records, true
+}
+
+// add caches an answer for a target, for the lowest TTL of its records (or
+// for an empty answer, the negative TTL of the SOA record that comes with it)
+// but no more than maxTTL seconds.
+func (c *AliasCache) add(target string, rrType uint16, resp *dns.Msg, maxTTL uint32) {
+	if c == nil {
+		return
+	}
+	ttl := maxTTL
+	if len(resp.Answer) > 0 {
+		for _, rr := range resp.Answer {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	} else {
+		var soa *dns.SOA
+		for _, rr := range resp.Ns {
+			if rrSOA, ok := rr.(*dns.SOA); ok {
+				soa = rrSOA
+			}
+		}
+		if soa == nil {
+			return
+		}
+		if negative := negativeTTL(soa); negative < ttl {
+			ttl = negative
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	if len(c.answers) >= c.size {
+		c.evict(now)
+	}
+	c.answers[aliasCacheKey(target, rrType)] = &cachedAlias{
+		records: resp.Answer,
+		fetched: now,
+		expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// evict makes room in the cache by removing any answers that have expired, or
+// if there aren't any an arbitrary entry. The caller must hold the lock.
+func (c *AliasCache) evict(now time.Time) {
+	for key, cached := range c.answers {
+		if !now.Before(cached.expires) {
+			delete(c.answers, key)
+		}
+	}
+	for key := range c.answers {
+		if len(c.answers) < c.size {
+			break
+		}
+		delete(c.answers, key)
+	}
+}
+
+// aliasCacheKey returns the key to cache the answer for a target with
+func aliasCacheKey(target string, rrType uint16) string {
+	return target + " " + dns.TypeToString[rrType]
+}
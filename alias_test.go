@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestUpstream starts a nameserver on a random local port that answers
+// queries for www.disco.org. and fails everything else
+func newTestUpstream(t *testing.T) (string, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unable to listen: ", err)
+	}
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		if q := req.Question[0]; q.Name != "www.disco.org." {
+			msg.Rcode = dns.RcodeServerFailure
+		} else if q.Qtype == dns.TypeA {
+			msg.Answer = []dns.RR{newTestRR(t, "www.disco.org. 30 IN A 2.2.2.2")}
+		}
+		w.WriteMsg(msg)
+	})
+
+	started := make(chan bool)
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	return conn.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestLookupAlias(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupAlias/"
+	store.Set("TestLookupAlias/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	store.Set("TestLookupAlias/net/disco/.ALIAS", "www.disco.net.")
+	store.Set("TestLookupAlias/net/disco/.ALIAS.ttl", "60")
+	store.Set("TestLookupAlias/net/disco/www/.CNAME", "web.disco.net.")
+	store.Set("TestLookupAlias/net/disco/web/.A/0", "1.1.1.1")
+	store.Set("TestLookupAlias/net/disco/web/.A/0.ttl", "600")
+	store.Set("TestLookupAlias/net/disco/web/.A/1", "1.1.1.2")
+	store.Set("TestLookupAlias/net/disco/web/.A/1.ttl", "30")
+	store.Set("TestLookupAlias/net/disco/remote/.ALIAS", "www.disco.org.")
+	store.Set("TestLookupAlias/net/disco/remote/.ALIAS.ttl", "300")
+	store.Set("TestLookupAlias/net/disco/broken/.ALIAS", "broken.disco.org.")
+	defer store.Delete(resolver.etcdPrefix)
+
+	addr, shutdown := newTestUpstream(t)
+	defer shutdown()
+	resolver.aliasUpstream = addr
+	defer func() { resolver.aliasUpstream = "" }()
+
+	query := new(dns.Msg)
+	query.SetQuestion("disco.net.", dns.TypeA)
+	answer := resolver.Lookup(query)
+	if len(answer.Answer) != 2 {
+		t.Fatal("Expected the addresses of the alias target, got ", answer.Answer)
+	}
+	for _, rr := range answer.Answer {
+		if rr.Header().Name != "disco.net." || rr.Header().Rrtype != dns.TypeA {
+			t.Fatal("Expected A records for the alias, got ", rr)
+		}
+	}
+	// TTLs are capped at the alias record's own
+	if answer.Answer[0].Header().Ttl != 60 || answer.Answer[1].Header().Ttl != 30 {
+		t.Fatal("Expected TTLs no higher than the alias record's, got ", answer.Answer)
+	}
+
+	query.SetQuestion("disco.net.", dns.TypeAAAA)
+	if answer = resolver.Lookup(query); answer.Rcode != dns.RcodeSuccess || len(answer.Answer) != 0 {
+		t.Fatal("Expected an empty answer for a type the target doesn't have, got ", answer)
+	}
+
+	query.SetQuestion("remote.disco.net.", dns.TypeA)
+	answer = resolver.Lookup(query)
+	if len(answer.Answer) != 1 || answer.Answer[0].(*dns.A).A.String() != "2.2.2.2" || answer.Answer[0].Header().Ttl != 30 {
+		t.Fatal("Expected the address of the alias target from upstream, got ", answer.Answer)
+	}
+
+	query.SetQuestion("broken.disco.net.", dns.TypeA)
+	if answer = resolver.Lookup(query); answer.Rcode != dns.RcodeServerFailure {
+		t.Fatal("Expected a failure from upstream to fail the query, got ", dns.RcodeToString[answer.Rcode])
+	}
+}
+
+func TestAliasCache(t *testing.T) {
+	cache := NewAliasCache(2)
+	resp := new(dns.Msg)
+	resp.Answer = []dns.RR{newTestRR(t, "www.disco.org. 30 IN A 2.2.2.2")}
+	cache.add("www.disco.org.", dns.TypeA, resp, 300)
+
+	records, ok := cache.get("www.disco.org.", dns.TypeA, 300)
+	if !ok || len(records) != 1 || records[0].Header().Ttl != 30 {
+		t.Fatal("Expected the cached answer, got ", records, ok)
+	}
+	if _, ok := cache.get("www.disco.org.", dns.TypeAAAA, 300); ok {
+		t.Fatal("Expected nothing cached for AAAA")
+	}
+
+	// The TTL counts down as the answer sits in the cache
+	cached := cache.answers[aliasCacheKey("www.disco.org.", dns.TypeA)]
+	cached.fetched = cached.fetched.Add(-10 * time.Second)
+	if records, ok := cache.get("www.disco.org.", dns.TypeA, 300); !ok || records[0].Header().Ttl != 20 {
+		t.Fatal("Expected the TTL to have been reduced, got ", records, ok)
+	}
+	// And it's not used for an ALIAS with a lower TTL than it's been cached for
+	if _, ok := cache.get("www.disco.org.", dns.TypeA, 5); ok {
+		t.Fatal("Expected the answer to have expired for an ALIAS TTL of 5")
+	}
+	cached.expires = time.Now()
+	if _, ok := cache.get("www.disco.org.", dns.TypeA, 300); ok {
+		t.Fatal("Expected the answer to have expired")
+	}
+
+	// Answers are cached for no longer than the ALIAS TTL
+	cache.add("www.disco.org.", dns.TypeA, resp, 5)
+	if cached := cache.answers[aliasCacheKey("www.disco.org.", dns.TypeA)]; cached.expires.After(cached.fetched.Add(5 * time.Second)) {
+		t.Fatal("Expected the answer to expire within 5 seconds, got ", cached.expires.Sub(cached.fetched))
+	}
+
+	// Empty answers are only cached along with an SOA record
+	cache.add("empty.disco.org.", dns.TypeA, new(dns.Msg), 300)
+	if _, ok := cache.get("empty.disco.org.", dns.TypeA, 300); ok {
+		t.Fatal("Expected an empty answer without an SOA not to be cached")
+	}
+	resp = new(dns.Msg)
+	resp.Ns = []dns.RR{newTestRR(t, "disco.org. 3600 IN SOA ns1.disco.org. admin.disco.org. 1 3600 600 86400 10")}
+	cache.add("empty.disco.org.", dns.TypeA, resp, 300)
+	if records, ok := cache.get("empty.disco.org.", dns.TypeA, 300); !ok || len(records) != 0 {
+		t.Fatal("Expected the empty answer to be cached, got ", records, ok)
+	}
+
+	// The cache doesn't grow beyond its size
+	cache.add("other.disco.org.", dns.TypeA, resp, 300)
+	if len(cache.answers) > 2 {
+		t.Fatal("Expected at most 2 cached answers, got ", len(cache.answers))
+	}
+}
+
+func TestLookupAliasCached(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupAliasCached/"
+	store.Set("TestLookupAliasCached/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	store.Set("TestLookupAliasCached/net/disco/.ALIAS", "www.disco.org.")
+	store.Set("TestLookupAliasCached/net/disco/.ALIAS.ttl", "60")
+	defer store.Delete(resolver.etcdPrefix)
+
+	addr, shutdown := newTestUpstream(t)
+	cachingResolver := *resolver
+	cachingResolver.aliasUpstream = addr
+	cachingResolver.aliasCache = NewAliasCache(aliasCacheSize)
+
+	query := new(dns.Msg)
+	query.SetQuestion("disco.net.", dns.TypeA)
+	if answer := cachingResolver.Lookup(query); len(answer.Answer) != 1 {
+		t.Fatal("Expected the address of the alias target from upstream, got ", answer.Answer)
+	}
+
+	// Once cached the upstream nameserver isn't needed
+	shutdown()
+	answer := cachingResolver.Lookup(query)
+	if answer.Rcode != dns.RcodeSuccess || len(answer.Answer) != 1 || answer.Answer[0].(*dns.A).A.String() != "2.2.2.2" {
+		t.Fatal("Expected the cached address of the alias target, got ", answer)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// How long to wait before trying to reload the cache after the watch fails
+const cacheRetryInterval = time.Second
+
+// CachedStore is a RecordStore that keeps a copy of every key beneath a prefix
+// of another store in memory, kept up to date by watching the store for
+// changes. Reads are answered from memory while the watch is healthy. If the
+// watch fails (or falls too far behind and has to be restarted) the cache
+// carries on serving the data it has for up to maxStaleness, after which
+// reads go directly to the underlying store until the cache has caught up.
+type CachedStore struct {
+	sync.RWMutex
+	store        RecordStore
+	prefix       string
+	maxStaleness time.Duration
+
+	root       *Node
+	index      uint64
+	synced     bool
+	lastSynced time.Time
+}
+
+// NewCachedStore creates a cache of all keys beneath the prefix of the store.
+// The cache is empty (and all reads go directly to the store) until Run has
+// been called.
+func NewCachedStore(store RecordStore, prefix string, maxStaleness time.Duration) *CachedStore {
+	return &CachedStore{
+		store:        store,
+		prefix:       cleanKey(prefix),
+		maxStaleness: maxStaleness}
+}
+
+// Run loads the cache and keeps it up to date, blocking until the stop
+// channel is closed. Whenever the watch fails the cache is reloaded.
+func (c *CachedStore) Run(stop chan bool) {
+	for {
+		err := c.sync(stop)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		c.watchLost()
+		logger.Printf("[WARNING] Lost watch on %s, reloading cache: %s", c.prefix, err)
+
+		select {
+		case <-time.After(cacheRetryInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Get implements RecordStore
+func (c *CachedStore) Get(key string) (*Node, error) {
+	key = cleanKey(key)
+	hitCounter := metrics.GetOrRegisterCounter("store.cache.hit", metrics.DefaultRegistry)
+	fallbackCounter := metrics.GetOrRegisterCounter("store.cache.fallback", metrics.DefaultRegistry)
+
+	c.RLock()
+	if !keyWithin(key, c.prefix) || !c.fresh() {
+		loaded := c.root != nil
+		c.RUnlock()
+		fallbackCounter.Inc(1)
+
+		// Failing to read a key the cache hasn't loaded yet means we're
+		// still starting up
+		node, err := c.store.Get(key)
+		if _, ok := err.(*KeyNotFoundError); err != nil && !ok && !loaded && keyWithin(key, c.prefix) {
+			return nil, &NotReadyError{Key: key, Message: err.Error()}
+		}
+		return node, err
+	}
+	defer c.RUnlock()
+
+	hitCounter.Inc(1)
+	node := c.root.find(key)
+	if node == nil {
+		return nil, &KeyNotFoundError{Key: key}
+	}
+	return node.copy(), nil
+}
+
+// Watch implements RecordStore, passing the watch on to the underlying store
+func (c *CachedStore) Watch(key string, waitIndex uint64, events chan *StoreEvent, stop chan bool) error {
+	return c.store.Watch(key, waitIndex, events, stop)
+}
+
+// Create implements WritableRecordStore, writing to the underlying store
+func (c *CachedStore) Create(key string, value string) error {
+	store, err := writableStore(c.store, key)
+	if err != nil {
+		return err
+	}
+	return store.Create(key, value)
+}
+
+// CompareAndSwap implements WritableRecordStore, writing to the underlying store
+func (c *CachedStore) CompareAndSwap(key string, value string, prevIndex uint64) error {
+	store, err := writableStore(c.store, key)
+	if err != nil {
+		return err
+	}
+	return store.CompareAndSwap(key, value, prevIndex)
+}
+
+// CompareAndDelete implements WritableRecordStore, writing to the underlying store
+func (c *CachedStore) CompareAndDelete(key string, prevIndex uint64) error {
+	store, err := writableStore(c.store, key)
+	if err != nil {
+		return err
+	}
+	return store.CompareAndDelete(key, prevIndex)
+}
+
+// Delete implements WritableRecordStore, writing to the underlying store
+func (c *CachedStore) Delete(key string) error {
+	store, err := writableStore(c.store, key)
+	if err != nil {
+		return err
+	}
+	return store.Delete(key)
+}
+
+// watchLost marks the cache as no longer being kept up to date. The staleness
+// window starts from when the watch was lost rather than from the last change
+// it saw, which could have been long before on a quiet cluster.
+func (c *CachedStore) watchLost() {
+	c.Lock()
+	defer c.Unlock()
+	if c.synced {
+		c.synced = false
+		c.lastSynced = time.Now()
+	}
+}
+
+// fresh returns true if reads can be served from the cache. The caller must
+// hold the read lock.
+func (c *CachedStore) fresh() bool {
+	if c.root == nil {
+		return false
+	}
+	return c.synced || time.Since(c.lastSynced) <= c.maxStaleness
+}
+
+// sync loads everything beneath the prefix into memory then applies changes
+// from a watch on the prefix until the watch fails or is stopped.
+func (c *CachedStore) sync(stop chan bool) error {
+	root, index, err := c.snapshot()
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.root = root
+	c.index = index
+	c.synced = true
+	c.lastSynced = time.Now()
+	c.Unlock()
+	debugMsg("Loaded cache of ", c.prefix, " at index ", index)
+
+	eventCounter := metrics.GetOrRegisterCounter("store.cache.events", metrics.DefaultRegistry)
+	events := make(chan *StoreEvent)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.store.Watch(c.prefix, index+1, events, stop)
+	}()
+
+	for event := range events {
+		eventCounter.Inc(1)
+		c.apply(event)
+	}
+	return <-done
+}
+
+// snapshot reads the whole prefix from the underlying store, returning it as
+// a tree rooted at "/" along with the index to start watching from.
+func (c *CachedStore) snapshot() (root *Node, index uint64, err error) {
+	var node *Node
+	if store, ok := c.store.(SnapshotRecordStore); ok {
+		node, index, err = store.Snapshot(c.prefix)
+	} else {
+		node, err = c.store.Get(c.prefix)
+		if node != nil {
+			for _, leaf := range node.Leaves() {
+				if leaf.ModifiedIndex > index {
+					index = leaf.ModifiedIndex
+				}
+			}
+		}
+	}
+
+	if _, ok := err.(*KeyNotFoundError); ok {
+		node, err = &Node{Key: c.prefix, Dir: true}, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	node.Key = c.prefix
+	if c.prefix == "/" {
+		return node, index, nil
+	}
+	root = &Node{Key: "/", Dir: true}
+	_, err = root.insert(node)
+	return root, index, err
+}
+
+// apply updates the cache with a single change from the watch
+func (c *CachedStore) apply(event *StoreEvent) {
+	c.Lock()
+	defer c.Unlock()
+
+	key := cleanKey(event.Node.Key)
+	switch event.Action {
+	case "delete", "expire", "compareAndDelete":
+		if key == "/" {
+			c.root = &Node{Key: "/", Dir: true}
+		} else {
+			c.root.remove(key)
+		}
+	default:
+		node := event.Node.copy()
+		node.Key = key
+		if existing := c.root.find(key); node.Dir && existing != nil && existing.Dir {
+			break
+		}
+		if _, err := c.root.insert(node); err != nil {
+			debugMsg("Unable to apply change to cache: ", err)
+		}
+	}
+
+	if event.Node.ModifiedIndex > c.index {
+		c.index = event.Node.ModifiedIndex
+	}
+	c.lastSynced = time.Now()
+}
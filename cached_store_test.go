@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// waitForValue polls the store until the key holds the expected value
+func waitForValue(t *testing.T, s RecordStore, key string, value string) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if node, err := s.Get(key); err == nil && node.Value == value {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for ", key, " to be ", value)
+}
+
+func TestCachedStoreLoadsAndWatches(t *testing.T) {
+	backend := NewMemoryStore()
+	backend.Set("/net/disco/.A", "1.1.1.1")
+
+	cache := NewCachedStore(backend, "/", 0)
+	stop := make(chan bool)
+	defer close(stop)
+	go cache.Run(stop)
+
+	waitForValue(t, cache, "/net/disco/.A", "1.1.1.1")
+
+	backend.Set("/net/disco/.A", "1.1.1.2")
+	backend.Set("/net/disco/.TXT/0", "foo")
+	waitForValue(t, cache, "/net/disco/.A", "1.1.1.2")
+	waitForValue(t, cache, "/net/disco/.TXT/0", "foo")
+
+	backend.Delete("/net/disco/.TXT")
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := cache.Get("/net/disco/.TXT"); err != nil {
+			if _, ok := err.(*KeyNotFoundError); !ok {
+				t.Fatal("Expected a KeyNotFoundError, got ", err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for /net/disco/.TXT to be deleted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCachedStorePrefix(t *testing.T) {
+	backend := NewMemoryStore()
+	backend.Set("/net/disco/.A", "1.1.1.1")
+	backend.Set("/com/other/.A", "2.2.2.2")
+
+	cache := NewCachedStore(backend, "/net", 0)
+	stop := make(chan bool)
+	defer close(stop)
+	go cache.Run(stop)
+
+	waitForValue(t, cache, "/net/disco/.A", "1.1.1.1")
+
+	// Keys outside of the prefix are read from the backend
+	node, err := cache.Get("/com/other/.A")
+	if err != nil {
+		t.Fatal("Error returned from store", err)
+	}
+	if node.Value != "2.2.2.2" {
+		t.Fatal("Node value should be 2.2.2.2: ", node.Value)
+	}
+}
+
+func TestCachedStoreFallsBackBeforeLoad(t *testing.T) {
+	backend := NewMemoryStore()
+	backend.Set("/net/disco/.A", "1.1.1.1")
+
+	cache := NewCachedStore(backend, "/", time.Minute)
+
+	node, err := cache.Get("/net/disco/.A")
+	if err != nil {
+		t.Fatal("Error returned from store", err)
+	}
+	if node.Value != "1.1.1.1" {
+		t.Fatal("Node value should be 1.1.1.1: ", node.Value)
+	}
+}
+
+func TestCachedStoreStaleness(t *testing.T) {
+	backend := NewMemoryStore()
+	backend.Set("/net/disco/.A", "1.1.1.1")
+
+	cache := NewCachedStore(backend, "/", time.Minute)
+	root, index, err := cache.snapshot()
+	if err != nil {
+		t.Fatal("Error returned from snapshot", err)
+	}
+	cache.root, cache.index = root, index
+
+	// Pretend the watch was lost a little while ago
+	backend.Set("/net/disco/.A", "1.1.1.2")
+	cache.synced = false
+	cache.lastSynced = time.Now().Add(-time.Second)
+
+	if node, _ := cache.Get("/net/disco/.A"); node.Value != "1.1.1.1" {
+		t.Fatal("Expected the cached value 1.1.1.1 within the staleness window: ", node.Value)
+	}
+
+	// ...and now a long time ago
+	cache.lastSynced = time.Now().Add(-time.Hour)
+
+	if node, _ := cache.Get("/net/disco/.A"); node.Value != "1.1.1.2" {
+		t.Fatal("Expected the backend value 1.1.1.2 outside the staleness window: ", node.Value)
+	}
+}
+
+func TestCachedStoreStalenessFromLostWatch(t *testing.T) {
+	backend := NewMemoryStore()
+	backend.Set("/net/disco/.A", "1.1.1.1")
+
+	cache := NewCachedStore(backend, "/", time.Minute)
+	root, index, err := cache.snapshot()
+	if err != nil {
+		t.Fatal("Error returned from snapshot", err)
+	}
+	cache.root, cache.index = root, index
+
+	// Nothing has changed for a long time before the watch is lost
+	cache.synced = true
+	cache.lastSynced = time.Now().Add(-time.Hour)
+	backend.Set("/net/disco/.A", "1.1.1.2")
+	cache.watchLost()
+
+	if node, _ := cache.Get("/net/disco/.A"); node.Value != "1.1.1.1" {
+		t.Fatal("Expected the cached value 1.1.1.1 just after losing the watch: ", node.Value)
+	}
+
+	// Failing to get the watch back doesn't extend the window
+	cache.lastSynced = time.Now().Add(-time.Hour)
+	cache.watchLost()
+
+	if node, _ := cache.Get("/net/disco/.A"); node.Value != "1.1.1.2" {
+		t.Fatal("Expected the backend value 1.1.1.2 once the window has passed: ", node.Value)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+// ZoneCut returns the name and NS records of the delegation that the name
+// falls beneath, if there is one. A name is delegated by NS records held below
+// the apex of a zone, on a name without an SOA record of its own (which would
+// make it the apex of another zone served from the same store). DS records
+// belong to the parent side of a zone cut, so DS queries for the delegated
+// name itself aren't delegated.
+func (r *Resolver) ZoneCut(name string, qtype uint16) (cut string, ns []dns.RR, err error) {
+	name = strings.ToLower(name)
+	soa := r.Authority(name)
+	if soa == nil {
+		return
+	}
+
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - dns.CountLabel(soa.Hdr.Name) - 1; i >= 0; i-- {
+		if i == 0 && qtype == dns.TypeDS {
+			break
+		}
+		candidate := dns.Fqdn(strings.Join(labels[i:], "."))
+		if ns, err = r.LookupAnswersForType(candidate, dns.TypeNS); err != nil {
+			return "", nil, err
+		} else if len(ns) > 0 {
+			return candidate, ns, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// Referral turns the message into a referral to the name servers of a
+// delegated zone, with the addresses of any name servers within the delegated
+// zone as glue (as nobody could look them up otherwise). Signed referrals
+// include the DS records of the delegated zone.
+func (r *Resolver) Referral(req *dns.Msg, msg *dns.Msg, cut string, ns []dns.RR) error {
+	referralCounter := metrics.GetOrRegisterCounter("resolver.answers.referral", metrics.DefaultRegistry)
+	referralCounter.Inc(1)
+
+	msg.Authoritative = false
+	msg.Answer = nil
+	msg.Ns = ns
+	for _, rr := range ns {
+		target := strings.ToLower(rr.(*dns.NS).Ns)
+		if !dns.IsSubDomain(cut, target) {
+			continue
+		}
+		for _, rrType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			glue, err := r.LookupAnswersForType(target, rrType)
+			if err != nil {
+				return err
+			}
+			msg.Extra = append(msg.Extra, glue...)
+		}
+	}
+
+	// The delegation itself isn't signed, but a signed zone has to vouch for
+	// the keys of the delegated zone with its DS records, or if it has none
+	// prove that there aren't any, as the delegated zone isn't signed
+	if r.signer != nil && dnssecOK(req) {
+		msg.SetEdns0(dns.DefaultMsgSize, true)
+		parent, _ := dns.NextLabel(cut, 0)
+		if zone := r.signer.Zone(cut[parent:]); zone != "" {
+			ds, err := r.LookupAnswersForType(cut, dns.TypeDS)
+			if err != nil {
+				return err
+			}
+			if len(ds) == 0 {
+				soa := r.Authority(zone)
+				types, _, err := r.nameTypes(cut)
+				if soa == nil || err != nil {
+					return err
+				}
+				ds = []dns.RR{r.matchingNSEC(zone, cut, types, negativeTTL(soa))}
+			}
+			msg.Ns = append(msg.Ns, ds...)
+			msg.Ns = append(msg.Ns, r.signer.Sign(ds)...)
+		}
+	}
+	return nil
+}
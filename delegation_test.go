@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func hasType(types []uint16, rrType uint16) bool {
+	for _, t := range types {
+		if t == rrType {
+			return true
+		}
+	}
+	return false
+}
+
+var testDelegationRecords = map[string]string{
+	".SOA.ttl":      "3600",
+	"ns1/.A":        "1.1.1.1",
+	"sub/.NS/0":     "ns1.sub.disco.net.",
+	"sub/.NS/1":     "ns.elsewhere.org.",
+	"sub/ns1/.A":    "1.1.1.2",
+	"sub/ns1/.AAAA": "::2",
+	"sub/www/.A":    "1.1.1.3",
+	"child/.SOA":    "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10",
+	"child/.NS":     "ns1.disco.net.",
+}
+
+func TestZoneCut(t *testing.T) {
+	resolver.etcdPrefix = "TestZoneCut/"
+	newTestZone("TestZoneCut", testDelegationRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		cut   string
+	}{
+		{"disco.net.", dns.TypeNS, ""},
+		{"ns1.disco.net.", dns.TypeA, ""},
+		{"sub.disco.net.", dns.TypeNS, "sub.disco.net."},
+		{"sub.disco.net.", dns.TypeDS, ""},
+		{"www.sub.disco.net.", dns.TypeA, "sub.disco.net."},
+		{"a.b.Sub.disco.net.", dns.TypeDS, "sub.disco.net."},
+		// Child zones with their own SOA are served here too
+		{"child.disco.net.", dns.TypeNS, ""},
+		{"www.child.disco.net.", dns.TypeA, ""},
+	}
+	for _, test := range tests {
+		cut, _, err := resolver.ZoneCut(test.name, test.qtype)
+		if err != nil {
+			t.Fatal("Unable to find zone cut: ", err)
+		}
+		if cut != test.cut {
+			t.Fatalf("Expected zone cut of %s to be '%s', got '%s'", test.name, test.cut, cut)
+		}
+	}
+}
+
+func TestLookupReferral(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupReferral/"
+	newTestZone("TestLookupReferral", testDelegationRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.sub.disco.net.", dns.TypeA)
+	answer := resolver.Lookup(query)
+
+	if answer.Rcode != dns.RcodeSuccess || answer.Authoritative {
+		t.Fatal("Expected a non-authoritative referral: ", answer)
+	}
+	if len(answer.Answer) != 0 {
+		t.Fatal("Didn't expect any answers, got ", answer.Answer)
+	}
+	if len(answer.Ns) != 2 || answer.Ns[0].Header().Name != "sub.disco.net." {
+		t.Fatal("Expected the delegation's NS records in the authority section: ", answer.Ns)
+	}
+	// Only the name server within the delegated zone needs glue
+	if len(answer.Extra) != 2 || answer.Extra[0].Header().Name != "ns1.sub.disco.net." {
+		t.Fatal("Expected glue records in the additional section: ", answer.Extra)
+	}
+}
+
+func TestLookupSignedReferral(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupSignedReferral/"
+	newTestZone("TestLookupSignedReferral", testDelegationRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	zsk, _, _ := newTestSigningKey(t, "disco.net.", 256)
+	resolver.signer = newTestSigner(zsk)
+	defer func() { resolver.signer = nil }()
+
+	answer := resolver.Lookup(newTestDNSSECRequest("www.sub.disco.net.", dns.TypeA))
+	for _, rr := range answer.Ns {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeNS {
+			t.Fatal("Didn't expect the delegation to be signed: ", answer.Ns)
+		}
+	}
+	verifySigned(t, answer.Ns, dns.TypeNSEC, zsk)
+
+	// The NSEC record proves there's no DS record for the delegation
+	for _, rr := range answer.Ns {
+		if nsec, ok := rr.(*dns.NSEC); ok {
+			if nsec.Hdr.Name != "sub.disco.net." || hasType(nsec.TypeBitMap, dns.TypeDS) || !hasType(nsec.TypeBitMap, dns.TypeNS) {
+				t.Fatal("Expected an NSEC record for the delegation without DS: ", nsec)
+			}
+		}
+	}
+
+	// With a DS record the referral vouches for the delegated zone's keys
+	// instead
+	store.Set("TestLookupSignedReferral/net/disco/sub/.DS", "12345\t13\t2\t3b5a8c6d4e1f2a7b9c0d8e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b")
+	answer = resolver.Lookup(newTestDNSSECRequest("www.sub.disco.net.", dns.TypeA))
+	verifySigned(t, answer.Ns, dns.TypeDS, zsk)
+	for _, rr := range answer.Ns {
+		if _, ok := rr.(*dns.NSEC); ok {
+			t.Fatal("Didn't expect an NSEC record for a delegation with DS: ", answer.Ns)
+		}
+	}
+
+	// The DS record itself is answered by the parent zone
+	answer = resolver.Lookup(newTestDNSSECRequest("sub.disco.net.", dns.TypeDS))
+	if !answer.Authoritative || len(answer.Answer) == 0 {
+		t.Fatal("Expected an authoritative answer for the DS record: ", answer)
+	}
+	verifySigned(t, answer.Answer, dns.TypeDS, zsk)
+	if ds := answer.Answer[0].(*dns.DS); ds.KeyTag != 12345 || ds.Algorithm != dns.ECDSAP256SHA256 || ds.DigestType != dns.SHA256 {
+		t.Fatal("Unexpected DS record: ", ds)
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	// How far in the past signatures start being valid, to allow for clocks
+	// on validating resolvers that are slightly behind
+	signatureInceptionSkew = time.Hour
+	// TTL of DNSKEY records that don't have one in their key file
+	dnskeyDefaultTTL = 3600
+)
+
+// SigningKey is a DNSSEC key used to sign the records of a zone. Keys with the
+// SEP flag set are treated as key signing keys, and only sign the DNSKEY
+// records of the zone, while the others (zone signing keys) sign everything
+// else. A zone with only one kind of key uses it for everything.
+//
+// The times a key is published in the zone's DNSKEY records, starts signing,
+// stops signing and is removed from the DNSKEY records can be set to roll
+// keys over. A zero time means the key has always been (or never stops being)
+// published or active.
+type SigningKey struct {
+	DNSKEY   *dns.DNSKEY
+	Private  crypto.Signer
+	Publish  time.Time
+	Activate time.Time
+	Inactive time.Time
+	Delete   time.Time
+}
+
+// isKSK returns true if the key is a key signing key
+func (k *SigningKey) isKSK() bool {
+	return k.DNSKEY.Flags&dns.SEP != 0
+}
+
+// published returns true if the key should be in the zone's DNSKEY records
+func (k *SigningKey) published(now time.Time) bool {
+	return !now.Before(k.Publish) && (k.Delete.IsZero() || now.Before(k.Delete))
+}
+
+// active returns true if the key should be used to sign records
+func (k *SigningKey) active(now time.Time) bool {
+	return k.published(now) && !now.Before(k.Activate) && (k.Inactive.IsZero() || now.Before(k.Inactive))
+}
+
+// cachedSignatures holds the signatures made over an RRset, and when they
+// should be replaced with new ones
+type cachedSignatures struct {
+	sigs    []*dns.RRSIG
+	refresh time.Time
+}
+
+// Signer signs responses for zones it has DNSSEC keys for, as they're sent
+// (online signing). Keys are read from a directory of the files written by
+// dnssec-keygen, and from the store beneath a prefix where they're held in
+// the same form, for example
+//
+//	/_dnssec/net/disco/12345.key -> disco.net. IN DNSKEY 257 3 13 ...
+//	/_dnssec/net/disco/12345.private -> Private-key-format: v1.3 ...
+//	/_dnssec/net/disco/12345.state -> 1500000000	1500000000	0	0
+//
+// where the optional state holds the times the key is published, activated,
+// made inactive and deleted (see SigningKey).
+//
+// Signatures are cached, so an RRset is only signed again once it changes or
+// half of the signature's validity period has passed.
+type Signer struct {
+	sync.Mutex
+	store      RecordStore
+	keyDir     string
+	keysPrefix string
+	validity   time.Duration
+	cacheSize  int
+	keys       map[string][]*SigningKey
+	cache      map[string]*cachedSignatures
+}
+
+// NewSigner creates a Signer with the keys found in the directory and beneath
+// the prefix in the store (either of which can be empty), returning an error
+// if any of them can't be loaded.
+func NewSigner(store RecordStore, keyDir string, keysPrefix string, validity time.Duration, cacheSize int) (*Signer, error) {
+	s := &Signer{
+		store:      store,
+		keyDir:     keyDir,
+		keysPrefix: keysPrefix,
+		validity:   validity,
+		cacheSize:  cacheSize,
+		keys:       make(map[string][]*SigningKey),
+		cache:      make(map[string]*cachedSignatures)}
+	if err := s.Load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Run reloads the keys every interval, so keys can be added and removed
+// without restarting. It blocks until the stop channel is closed.
+func (s *Signer) Run(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Load(); err != nil {
+				logger.Printf("[WARNING] Failed to reload DNSSEC keys, keeping existing keys: %s", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Load reads all of the keys, replacing those currently in use. If any of the
+// keys fail to load the existing keys are left untouched.
+func (s *Signer) Load() error {
+	keys := make(map[string][]*SigningKey)
+	if len(s.keyDir) > 0 {
+		if err := loadKeyDir(s.keyDir, keys); err != nil {
+			return err
+		}
+	}
+	if len(s.keysPrefix) > 0 {
+		if err := loadKeyStore(s.store, s.keysPrefix, keys); err != nil {
+			return err
+		}
+	}
+	s.SetKeys(keys)
+	return nil
+}
+
+// SetKeys replaces the keys used to sign each zone
+func (s *Signer) SetKeys(keys map[string][]*SigningKey) {
+	s.Lock()
+	defer s.Unlock()
+	if !sameKeys(s.keys, keys) {
+		s.cache = make(map[string]*cachedSignatures)
+	}
+	s.keys = keys
+}
+
+// Zone returns the closest zone enclosing the name that there are keys for,
+// or an empty string if there isn't one.
+func (s *Signer) Zone(name string) string {
+	s.Lock()
+	defer s.Unlock()
+	name = dns.Fqdn(strings.ToLower(name))
+	for i, end := 0, false; !end; i, end = dns.NextLabel(name, i) {
+		if _, ok := s.keys[name[i:]]; ok {
+			return name[i:]
+		}
+	}
+	if _, ok := s.keys["."]; ok {
+		return "."
+	}
+	return ""
+}
+
+// KeyRecords returns the DNSKEY records for the zone, or the CDS or CDNSKEY
+// records telling the parent zone which key signing keys to trust (RFC 7344).
+// Nothing is returned if there are no keys for the zone.
+func (s *Signer) KeyRecords(zone string, rrType uint16) (records []dns.RR) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for _, key := range s.keys[dns.Fqdn(strings.ToLower(zone))] {
+		if !key.published(now) || (rrType != dns.TypeDNSKEY && !key.isKSK()) {
+			continue
+		}
+		dnskey := dns.Copy(key.DNSKEY).(*dns.DNSKEY)
+		dnskey.Hdr.Name = zone
+		switch rrType {
+		case dns.TypeDNSKEY:
+			records = append(records, dnskey)
+		case dns.TypeCDNSKEY:
+			records = append(records, dnskey.ToCDNSKEY())
+		case dns.TypeCDS:
+			records = append(records, dnskey.ToDS(dns.SHA256).ToCDS())
+		}
+	}
+	return
+}
+
+// isKeyType returns true if records of the type are answered from the keys
+func isKeyType(rrType uint16) bool {
+	return rrType == dns.TypeDNSKEY || rrType == dns.TypeCDNSKEY || rrType == dns.TypeCDS
+}
+
+// Sign returns the signatures for each RRset in the records. Signatures (and
+// OPT records) among the records are left alone.
+func (s *Signer) Sign(records []dns.RR) (sigs []dns.RR) {
+	for _, rrset := range splitRRsets(records) {
+		sigs = append(sigs, s.signRRset(rrset)...)
+	}
+	return
+}
+
+// signRRset returns signatures for a single RRset from the cache, signing it
+// if there aren't any or they need refreshing. The TTLs of the records are
+// lowered to match the lowest in the RRset, as they must all be the same.
+func (s *Signer) signRRset(rrset []dns.RR) (sigs []dns.RR) {
+	hitCounter := metrics.GetOrRegisterCounter("dnssec.signatures.cache_hit", metrics.DefaultRegistry)
+	missCounter := metrics.GetOrRegisterCounter("dnssec.signatures.cache_miss", metrics.DefaultRegistry)
+	errorCounter := metrics.GetOrRegisterCounter("dnssec.signatures.error", metrics.DefaultRegistry)
+
+	zone := s.Zone(rrset[0].Header().Name)
+	if zone == "" {
+		return
+	}
+	ttl := rrsetTTL(rrset)
+	for _, rr := range rrset {
+		rr.Header().Ttl = ttl
+	}
+	now := time.Now()
+
+	s.Lock()
+	keys := signingKeys(s.keys[zone], rrset[0].Header().Rrtype, now)
+	cacheKey := rrsetCacheKey(zone, rrset, keys)
+	cached, ok := s.cache[cacheKey]
+	s.Unlock()
+
+	if ok && now.Before(cached.refresh) {
+		hitCounter.Inc(1)
+	} else {
+		missCounter.Inc(1)
+		cached = &cachedSignatures{refresh: now.Add(s.validity / 2)}
+		for _, key := range keys {
+			sig := &dns.RRSIG{
+				Hdr:        dns.RR_Header{Ttl: ttl},
+				Algorithm:  key.DNSKEY.Algorithm,
+				KeyTag:     key.DNSKEY.KeyTag(),
+				SignerName: zone,
+				OrigTtl:    ttl,
+				Inception:  uint32(now.Add(-signatureInceptionSkew).Unix()),
+				Expiration: uint32(now.Add(s.validity).Unix())}
+			if err := sig.Sign(key.Private, rrset); err != nil {
+				errorCounter.Inc(1)
+				logger.Printf("[WARNING] Failed to sign %s %s with key %d: %s", rrset[0].Header().Name,
+					dns.TypeToString[rrset[0].Header().Rrtype], sig.KeyTag, err)
+				continue
+			}
+			cached.sigs = append(cached.sigs, sig)
+		}
+
+		s.Lock()
+		if len(s.cache) >= s.cacheSize {
+			s.evict(now)
+		}
+		s.cache[cacheKey] = cached
+		s.Unlock()
+	}
+
+	for _, sig := range cached.sigs {
+		sigs = append(sigs, dns.Copy(sig))
+	}
+	return
+}
+
+// evict makes room in the signature cache by removing any signatures that
+// need refreshing, or if there aren't any an arbitrary entry.
+func (s *Signer) evict(now time.Time) {
+	for key, cached := range s.cache {
+		if !now.Before(cached.refresh) {
+			delete(s.cache, key)
+		}
+	}
+	for key := range s.cache {
+		if len(s.cache) < s.cacheSize {
+			break
+		}
+		delete(s.cache, key)
+	}
+}
+
+// signingKeys returns the active keys that should sign an RRset of the given
+// type
+func signingKeys(keys []*SigningKey, rrType uint16, now time.Time) (signing []*SigningKey) {
+	var active []*SigningKey
+	for _, key := range keys {
+		if key.active(now) {
+			active = append(active, key)
+		}
+	}
+	wantKSK := isKeyType(rrType)
+	for _, key := range active {
+		if key.isKSK() == wantKSK {
+			signing = append(signing, key)
+		}
+	}
+	if len(signing) == 0 {
+		return active
+	}
+	return
+}
+
+// splitRRsets groups records into RRsets (records with the same name and
+// type), in the order they first appear.
+func splitRRsets(records []dns.RR) (rrsets [][]dns.RR) {
+	index := make(map[string]int)
+	for _, rr := range records {
+		rrType := rr.Header().Rrtype
+		if rrType == dns.TypeRRSIG || rrType == dns.TypeOPT {
+			continue
+		}
+		key := strings.ToLower(rr.Header().Name) + "/" + dns.TypeToString[rrType]
+		if i, ok := index[key]; ok {
+			rrsets[i] = append(rrsets[i], rr)
+		} else {
+			index[key] = len(rrsets)
+			rrsets = append(rrsets, []dns.RR{rr})
+		}
+	}
+	return
+}
+
+// rrsetTTL returns the lowest TTL of the records in an RRset
+func rrsetTTL(rrset []dns.RR) uint32 {
+	ttl := rrset[0].Header().Ttl
+	for _, rr := range rrset[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
+
+// rrsetCacheKey returns a string identifying the contents of an RRset, and
+// the keys signing it, to look up its signatures in the cache with.
+func rrsetCacheKey(zone string, rrset []dns.RR, keys []*SigningKey) string {
+	records := make([]string, len(rrset))
+	for i, rr := range rrset {
+		records[i] = strings.ToLower(rr.String())
+	}
+	sort.Strings(records)
+	tags := make([]string, len(keys))
+	for i, key := range keys {
+		tags[i] = fmt.Sprint(key.DNSKEY.KeyTag())
+	}
+	return zone + " " + strings.Join(tags, " ") + "\n" + strings.Join(records, "\n")
+}
+
+// sameKeys returns true if both sets of keys hold the same DNSKEYs for each zone
+func sameKeys(a, b map[string][]*SigningKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for zone, keys := range a {
+		if len(keys) != len(b[zone]) {
+			return false
+		}
+		for i, key := range keys {
+			if key.DNSKEY.String() != b[zone][i].DNSKEY.String() || key.keyState() != b[zone][i].keyState() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// dnssecOK returns true if the sender of the request wants DNSSEC records
+func dnssecOK(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// parseSigningKey creates a SigningKey from the contents of a .key file and the
+// matching .private file
+func parseSigningKey(public string, private string, file string) (*SigningKey, error) {
+	rr, err := dns.ReadRR(strings.NewReader(public), file)
+	if err != nil {
+		return nil, err
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("Not a DNSKEY record: %s", file)
+	}
+	dnskey.Hdr.Name = dns.Fqdn(strings.ToLower(dnskey.Hdr.Name))
+	if dnskey.Hdr.Ttl == 0 {
+		dnskey.Hdr.Ttl = dnskeyDefaultTTL
+	}
+
+	key, err := dnskey.NewPrivateKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read private key for %s: %s", file, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported key algorithm %s: %s", dns.AlgorithmToString[dnskey.Algorithm], file)
+	}
+	return &SigningKey{DNSKEY: dnskey, Private: signer}, nil
+}
+
+// loadKeyDir reads every key in the directory, adding them to the keys for
+// each zone
+func loadKeyDir(dir string, keys map[string][]*SigningKey) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.key"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		public, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		private, err := ioutil.ReadFile(strings.TrimSuffix(file, ".key") + ".private")
+		if os.IsNotExist(err) {
+			debugMsg("Skipping key without a private key: ", file)
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		key, err := parseSigningKey(string(public), string(private), file)
+		if err != nil {
+			return err
+		}
+		debugMsg("Loaded DNSSEC key ", key.DNSKEY.KeyTag(), " for zone ", key.DNSKEY.Hdr.Name)
+		keys[key.DNSKEY.Hdr.Name] = append(keys[key.DNSKEY.Hdr.Name], key)
+	}
+	return nil
+}
+
+// loadKeyStore reads every key beneath the prefix in the store, adding them to
+// the keys for each zone
+func loadKeyStore(store RecordStore, prefix string, keys map[string][]*SigningKey) error {
+	root, err := store.Get(prefix)
+	if _, ok := err.(*KeyNotFoundError); ok {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	values := make(map[string]string)
+	for _, leaf := range root.Leaves() {
+		values[leaf.Key] = leaf.Value
+	}
+	var files []string
+	for file := range values {
+		if path.Ext(file) == ".key" {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		private, ok := values[strings.TrimSuffix(file, ".key")+".private"]
+		if !ok {
+			debugMsg("Skipping key without a private key: ", file)
+			continue
+		}
+		key, err := parseSigningKey(values[file], private, file)
+		if err != nil {
+			return err
+		}
+		if state, ok := values[strings.TrimSuffix(file, ".key")+".state"]; ok {
+			if err := key.parseKeyState(state); err != nil {
+				return fmt.Errorf("Unable to read key state for %s: %s", file, err)
+			}
+		}
+		debugMsg("Loaded DNSSEC key ", key.DNSKEY.KeyTag(), " for zone ", key.DNSKEY.Hdr.Name)
+		keys[key.DNSKEY.Hdr.Name] = append(keys[key.DNSKEY.Hdr.Name], key)
+	}
+	return nil
+}
+
+// keyState returns the times the key is published, activated, made inactive
+// and deleted, as they're stored alongside the key. Each is a unix timestamp
+// separated by tabs, with zero for times that aren't set.
+func (k *SigningKey) keyState() string {
+	times := []time.Time{k.Publish, k.Activate, k.Inactive, k.Delete}
+	values := make([]string, len(times))
+	for i, t := range times {
+		values[i] = "0"
+		if !t.IsZero() {
+			values[i] = strconv.FormatInt(t.Unix(), 10)
+		}
+	}
+	return strings.Join(values, "\t")
+}
+
+// parseKeyState sets the times of the key from a stored state, the reverse of
+// keyState
+func (k *SigningKey) parseKeyState(state string) error {
+	values := strings.Split(state, "\t")
+	if len(values) != 4 {
+		return fmt.Errorf("Expected publish, activate, inactive and delete times: %s", state)
+	}
+	times := make([]time.Time, len(values))
+	for i, value := range values {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		if seconds != 0 {
+			times[i] = time.Unix(seconds, 0)
+		}
+	}
+	k.Publish, k.Activate, k.Inactive, k.Delete = times[0], times[1], times[2], times[3]
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestSigningKey generates an ECDSA key for the zone, returning it along
+// with the contents of its .key and .private files
+func newTestSigningKey(t *testing.T, zone string, flags uint16) (*SigningKey, string, string) {
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256}
+	private, err := dnskey.Generate(256)
+	if err != nil {
+		t.Fatal("Unable to generate key: ", err)
+	}
+	key := &SigningKey{DNSKEY: dnskey, Private: private.(crypto.Signer)}
+	return key, dnskey.String() + "\n", dnskey.PrivateKeyString(private)
+}
+
+func newTestSigner(keys ...*SigningKey) *Signer {
+	signer := &Signer{validity: 24 * time.Hour, cacheSize: 10, cache: make(map[string]*cachedSignatures)}
+	zones := make(map[string][]*SigningKey)
+	for _, key := range keys {
+		zones[key.DNSKEY.Hdr.Name] = append(zones[key.DNSKEY.Hdr.Name], key)
+	}
+	signer.SetKeys(zones)
+	return signer
+}
+
+func newTestDNSSECRequest(name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(4096, true)
+	return req
+}
+
+// verifySigned checks that the RRset of the given type in the records has a
+// valid signature from the key
+func verifySigned(t *testing.T, records []dns.RR, rrType uint16, key *SigningKey) {
+	var rrset []dns.RR
+	var sig *dns.RRSIG
+	for _, rr := range records {
+		if rr.Header().Rrtype == rrType {
+			rrset = append(rrset, rr)
+		} else if rrsig, ok := rr.(*dns.RRSIG); ok && rrsig.TypeCovered == rrType && rrsig.KeyTag == key.DNSKEY.KeyTag() {
+			sig = rrsig
+		}
+	}
+	if len(rrset) == 0 || sig == nil {
+		t.Fatalf("Expected signed %s records: %v", dns.TypeToString[rrType], records)
+	}
+	if err := sig.Verify(key.DNSKEY, rrset); err != nil {
+		t.Fatalf("Invalid signature over %s records: %s", dns.TypeToString[rrType], err)
+	}
+	if !sig.ValidityPeriod(time.Now()) {
+		t.Fatal("Signature isn't currently valid: ", sig)
+	}
+}
+
+func TestSignerZone(t *testing.T) {
+	key, _, _ := newTestSigningKey(t, "disco.net.", 256)
+	subKey, _, _ := newTestSigningKey(t, "sub.disco.net.", 256)
+	signer := newTestSigner(key, subKey)
+
+	tests := map[string]string{
+		"disco.net.":         "disco.net.",
+		"www.Disco.net.":     "disco.net.",
+		"sub.disco.net.":     "sub.disco.net.",
+		"www.sub.disco.net.": "sub.disco.net.",
+		"disco.org.":         "",
+		"net.":               "",
+	}
+	for name, zone := range tests {
+		if found := signer.Zone(name); found != zone {
+			t.Fatalf("Expected zone of %s to be '%s', got '%s'", name, zone, found)
+		}
+	}
+}
+
+func TestSignerSign(t *testing.T) {
+	ksk, _, _ := newTestSigningKey(t, "disco.net.", 257)
+	zsk, _, _ := newTestSigningKey(t, "disco.net.", 256)
+	signer := newTestSigner(ksk, zsk)
+
+	records := []dns.RR{
+		newTestRR(t, "www.disco.net. 300 IN A 1.1.1.1"),
+		newTestRR(t, "www.disco.net. 60 IN A 1.1.1.2"),
+		newTestRR(t, "www.disco.org. 300 IN A 1.1.1.3")}
+	sigs := signer.Sign(records)
+	if len(sigs) != 1 {
+		t.Fatal("Expected a single signature from the zone signing key: ", sigs)
+	}
+	if ttl := records[0].Header().Ttl; ttl != 60 || sigs[0].Header().Ttl != 60 {
+		t.Fatal("Expected the RRset and signature to have the lowest TTL: ", records, sigs)
+	}
+	verifySigned(t, append([]dns.RR{records[0], records[1]}, sigs...), dns.TypeA, zsk)
+
+	// Signatures are cached until the RRset changes
+	if again := signer.Sign(records[:2]); again[0].(*dns.RRSIG).Signature != sigs[0].(*dns.RRSIG).Signature {
+		t.Fatal("Expected the cached signature to be reused")
+	}
+	records[1].(*dns.A).A = records[2].(*dns.A).A
+	if again := signer.Sign(records[:2]); again[0].(*dns.RRSIG).Signature == sigs[0].(*dns.RRSIG).Signature {
+		t.Fatal("Expected a changed RRset to be signed again")
+	}
+
+	dnskeys := signer.KeyRecords("disco.net.", dns.TypeDNSKEY)
+	dnskeys = append(dnskeys, signer.Sign(dnskeys)...)
+	if len(dnskeys) != 3 {
+		t.Fatal("Expected the DNSKEY records to only be signed by the key signing key: ", dnskeys)
+	}
+	verifySigned(t, dnskeys, dns.TypeDNSKEY, ksk)
+}
+
+func TestSignerCacheSize(t *testing.T) {
+	key, _, _ := newTestSigningKey(t, "disco.net.", 256)
+	signer := newTestSigner(key)
+	signer.cacheSize = 2
+
+	for _, rr := range []string{"a.disco.net. 300 IN A 1.1.1.1", "b.disco.net. 300 IN A 1.1.1.1", "c.disco.net. 300 IN A 1.1.1.1"} {
+		signer.Sign([]dns.RR{newTestRR(t, rr)})
+	}
+	if len(signer.cache) != 2 {
+		t.Fatal("Expected the cache to be limited to 2 RRsets: ", len(signer.cache))
+	}
+}
+
+func TestLookupSigned(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupSigned/"
+	store.Set("TestLookupSigned/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	store.Set("TestLookupSigned/net/disco/www/.A", "1.1.1.1")
+	store.Set("TestLookupSigned/net/disco/*/.TXT", "wildcard")
+	store.Set("TestLookupSigned/net/disco/alias/.CNAME", "www.disco.net.")
+	defer store.Delete(resolver.etcdPrefix)
+
+	ksk, _, _ := newTestSigningKey(t, "disco.net.", 257)
+	zsk, _, _ := newTestSigningKey(t, "disco.net.", 256)
+	resolver.signer = newTestSigner(ksk, zsk)
+	defer func() { resolver.signer = nil }()
+
+	answer := resolver.Lookup(newTestDNSSECRequest("www.disco.net.", dns.TypeA))
+	verifySigned(t, answer.Answer, dns.TypeA, zsk)
+	if opt := answer.IsEdns0(); opt == nil || !opt.Do() {
+		t.Fatal("Expected the DO bit to be set in the response: ", answer)
+	}
+
+	answer = resolver.Lookup(newTestDNSSECRequest("disco.net.", dns.TypeDNSKEY))
+	verifySigned(t, answer.Answer, dns.TypeDNSKEY, ksk)
+
+	answer = resolver.Lookup(newTestDNSSECRequest("missing.disco.net.", dns.TypeA))
+	verifySigned(t, answer.Ns, dns.TypeSOA, zsk)
+
+	// Wildcard answers are signed with the wildcard's labels
+	answer = resolver.Lookup(newTestDNSSECRequest("foo.disco.net.", dns.TypeTXT))
+	if len(answer.Answer) != 2 {
+		t.Fatal("Expected a signed wildcard answer: ", answer.Answer)
+	}
+	if sig := answer.Answer[1].(*dns.RRSIG); sig.Labels != 2 || sig.Hdr.Name != "foo.disco.net." {
+		t.Fatal("Expected the signature to cover the wildcard: ", sig)
+	}
+
+	// Each record in a CNAME chain is signed
+	answer = resolver.Lookup(newTestDNSSECRequest("alias.disco.net.", dns.TypeA))
+	verifySigned(t, answer.Answer, dns.TypeCNAME, zsk)
+	verifySigned(t, answer.Answer, dns.TypeA, zsk)
+
+	// Without the DO bit nothing is signed
+	req := new(dns.Msg)
+	req.SetQuestion("www.disco.net.", dns.TypeA)
+	if answer = resolver.Lookup(req); len(answer.Answer) != 1 {
+		t.Fatal("Expected an unsigned answer: ", answer.Answer)
+	}
+}
+
+func TestLoadSigningKeys(t *testing.T) {
+	_, public, private := newTestSigningKey(t, "disco.net.", 257)
+	_, otherPublic, otherPrivate := newTestSigningKey(t, "disco.org.", 256)
+
+	dir, err := ioutil.TempDir("", "discodns-keys")
+	if err != nil {
+		t.Fatal("Unable to create key directory: ", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "Kdisco.net.+013+00001.key"), []byte(public), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "Kdisco.net.+013+00001.private"), []byte(private), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "Kdisco.net.+013+00002.key"), []byte(otherPublic), 0600)
+
+	keyStore := NewMemoryStore()
+	keyStore.Set("/_dnssec/org/disco/1.key", otherPublic)
+	keyStore.Set("/_dnssec/org/disco/1.private", otherPrivate)
+
+	signer, err := NewSigner(keyStore, dir, "/_dnssec", time.Hour, 10)
+	if err != nil {
+		t.Fatal("Unable to load keys: ", err)
+	}
+	if keys := signer.KeyRecords("disco.net.", dns.TypeDNSKEY); len(keys) != 1 || keys[0].(*dns.DNSKEY).Flags != 257 {
+		t.Fatal("Expected the key with a private key to be loaded from the directory: ", keys)
+	}
+	if keys := signer.KeyRecords("disco.org.", dns.TypeDNSKEY); len(keys) != 1 {
+		t.Fatal("Expected a key to be loaded from the store: ", keys)
+	}
+
+	keyStore.Set("/_dnssec/org/disco/2.key", "disco.org. IN A 1.1.1.1")
+	keyStore.Set("/_dnssec/org/disco/2.private", otherPrivate)
+	if err := signer.Load(); err == nil {
+		t.Fatal("Expected an invalid key to fail to load")
+	}
+	if keys := signer.KeyRecords("disco.org.", dns.TypeDNSKEY); len(keys) != 1 {
+		t.Fatal("Expected the existing keys to be kept: ", keys)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// The EDNS0 option code of Extended DNS Errors (RFC 8914), which the dns
+// package doesn't know about
+const edeOptionCode = 15
+
+// Extended DNS Error info codes
+const (
+	edeOther                = 0
+	edeNotReady             = 14
+	edeBlocked              = 15
+	edeNoReachableAuthority = 22
+	edeNetworkError         = 23
+)
+
+// serverFailure makes the response a SERVFAIL, explaining what went wrong with
+// an Extended DNS Error.
+func serverFailure(req *dns.Msg, msg *dns.Msg, err error) {
+	msg.SetRcode(req, dns.RcodeServerFailure)
+	msg.Answer = nil
+	msg.Ns = nil
+	code, text := extendedError(err)
+	setExtendedError(req, msg, code, text)
+}
+
+// extendedError returns the Extended DNS Error info code and text describing
+// an error encountered while answering a query
+func extendedError(err error) (uint16, string) {
+	switch err := err.(type) {
+	case *NodeConversionError:
+		key := ""
+		if err.Node != nil {
+			key = " at " + err.Node.Key
+		}
+		return edeOther, fmt.Sprintf("Invalid %s record%s: %s", dns.TypeToString[err.AttemptedType], key, err.Message)
+	case *RecordValueError:
+		return edeOther, fmt.Sprintf("Invalid %s record: %s", dns.TypeToString[err.AttemptedType], err.Message)
+	case *UpstreamError:
+		return edeNoReachableAuthority, err.Error()
+	case *NotReadyError:
+		return edeNotReady, "Records haven't been loaded from the store yet"
+	}
+	return edeNetworkError, "Unable to read records from the store"
+}
+
+// setExtendedError adds an Extended DNS Error to the response, as long as the
+// client supports EDNS.
+func setExtendedError(req *dns.Msg, msg *dns.Msg, code uint16, text string) {
+	if req.IsEdns0() == nil {
+		return
+	}
+	data := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	copy(data[2:], text)
+	opt := ednsOption(msg)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: edeOptionCode, Data: data})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// extendedErrorOf returns the info code and text of the Extended DNS Error in
+// a response, after a round trip through the wire format
+func extendedErrorOf(t *testing.T, msg *dns.Msg) (code uint16, text string, ok bool) {
+	buf, err := msg.Pack()
+	if err != nil {
+		t.Fatal("Unable to pack response: ", err)
+	}
+	msg = new(dns.Msg)
+	if err := msg.Unpack(buf); err != nil {
+		t.Fatal("Unable to unpack response: ", err)
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, option := range opt.Option {
+		if local, isLocal := option.(*dns.EDNS0_LOCAL); isLocal && local.Code == edeOptionCode && len(local.Data) >= 2 {
+			return binary.BigEndian.Uint16(local.Data), string(local.Data[2:]), true
+		}
+	}
+	return
+}
+
+func TestLookupExtendedError(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupExtendedError/"
+	store.Set("TestLookupExtendedError/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	store.Set("TestLookupExtendedError/net/disco/bad/.A", "not-an-ip")
+	store.Set("TestLookupExtendedError/net/disco/broken/.ALIAS", "broken.disco.org.")
+	defer store.Delete(resolver.etcdPrefix)
+
+	addr, shutdown := newTestUpstream(t)
+	defer shutdown()
+	resolver.aliasUpstream = addr
+	defer func() { resolver.aliasUpstream = "" }()
+
+	tests := []struct {
+		name string
+		code uint16
+		text string
+	}{
+		{"bad.disco.net.", edeOther, "Invalid A record at /TestLookupExtendedError/net/disco/bad/.A"},
+		{"broken.disco.net.", edeNoReachableAuthority, "SERVFAIL for broken.disco.org."},
+	}
+	for _, test := range tests {
+		query := new(dns.Msg)
+		query.SetQuestion(test.name, dns.TypeA)
+		query.SetEdns0(4096, false)
+		answer := resolver.Lookup(query)
+		if answer.Rcode != dns.RcodeServerFailure {
+			t.Fatalf("Expected SERVFAIL for %s, got %s", test.name, dns.RcodeToString[answer.Rcode])
+		}
+		code, text, ok := extendedErrorOf(t, answer)
+		if !ok || code != test.code || !strings.Contains(text, test.text) {
+			t.Fatalf("Expected extended error %d containing '%s' for %s, got %d '%s'", test.code, test.text, test.name, code, text)
+		}
+
+		// Clients that don't support EDNS only get the response code
+		query.Extra = nil
+		if answer = resolver.Lookup(query); answer.IsEdns0() != nil {
+			t.Fatal("Expected no OPT record without EDNS, got ", answer.Extra)
+		}
+	}
+}
+
+func TestHandleFilteredExtendedError(t *testing.T) {
+	h := newTestHandler()
+	h.queryFilterer = &QueryFilterer{rejectFilters: parseFilters([]string{"disco.net:"})}
+	req := new(dns.Msg)
+	req.SetQuestion("disco.net.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	w := &testResponseWriter{remoteAddr: testUDPAddr}
+	h.Handle(w, req)
+
+	msg := w.msgs[0]
+	if msg.Rcode != dns.RcodeNameError || len(msg.Ns) != 0 {
+		t.Fatal("Expected NXDOMAIN without any records, got ", msg)
+	}
+	if code, text, ok := extendedErrorOf(t, msg); !ok || code != edeBlocked || text != "Rejected query based on matched filters" {
+		t.Fatalf("Expected the query to be blocked, got %d '%s'", code, text)
+	}
+}
+
+// failingStore is a RecordStore that can't be read from
+type failingStore struct {
+	*MemoryStore
+}
+
+func (s failingStore) Get(key string) (*Node, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestLookupStoreExtendedError(t *testing.T) {
+	failing := failingStore{NewMemoryStore()}
+	tests := []struct {
+		store RecordStore
+		code  uint16
+		text  string
+	}{
+		{failing, edeNetworkError, "Unable to read records from the store"},
+		// A cache that hasn't loaded yet isn't ready, rather than broken
+		{NewCachedStore(failing, "/", time.Minute), edeNotReady, "Records haven't been loaded from the store yet"},
+	}
+	for _, test := range tests {
+		query := new(dns.Msg)
+		query.SetQuestion("www.disco.net.", dns.TypeA)
+		query.SetEdns0(4096, false)
+		answer := (&Resolver{store: test.store}).Lookup(query)
+		if answer.Rcode != dns.RcodeServerFailure {
+			t.Fatal("Expected SERVFAIL, got ", dns.RcodeToString[answer.Rcode])
+		}
+		if code, text, ok := extendedErrorOf(t, answer); !ok || code != test.code || text != test.text {
+			t.Fatalf("Expected extended error %d '%s', got %d '%s'", test.code, test.text, code, text)
+		}
+	}
+}
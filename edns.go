@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+// The only version of EDNS there is (RFC 6891)
+const ednsVersion = 0
+
+// badVersion returns the response to a request using a version of EDNS that
+// isn't supported, or nil if the request doesn't use one.
+func badVersion(req *dns.Msg, size uint16) *dns.Msg {
+	opt := req.IsEdns0()
+	if opt == nil || opt.Version() <= ednsVersion {
+		return nil
+	}
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	msg.SetEdns0(size, false)
+
+	// BADVERS doesn't fit in the 4 bits of the header, so the rest of it goes
+	// in the OPT record. This is set directly as the dns package doesn't get it
+	// right for BADVERS itself.
+	msg.Rcode = dns.RcodeBadVers & 0xF
+	reply := msg.IsEdns0()
+	reply.Hdr.Ttl = reply.Hdr.Ttl&0x00FFFFFF | uint32(dns.RcodeBadVers>>4)<<24
+	return msg
+}
+
+// ednsOption returns the OPT record of a response, adding one if there isn't
+// one already
+func ednsOption(msg *dns.Msg) *dns.OPT {
+	if opt := msg.IsEdns0(); opt != nil {
+		return opt
+	}
+	msg.SetEdns0(dns.DefaultMsgSize, false)
+	return msg.IsEdns0()
+}
+
+// optSize returns the number of bytes taken up by the OPT record added to the
+// response to the request, or 0 if there won't be one
+func optSize(req *dns.Msg) int {
+	if req.IsEdns0() == nil {
+		return 0
+	}
+	msg := new(dns.Msg)
+	ednsOption(msg)
+	if subnet := clientSubnet(req); subnet != nil {
+		echoClientSubnet(msg, subnet, subnet.SourceNetmask)
+	}
+	return msg.Len() - new(dns.Msg).Len()
+}
+
+// responseLimit returns the largest response that can be sent to the client
+// making the request, taking the size of the TSIG record into account when
+// the response is going to be signed. Over UDP that's the size of the client's
+// buffer (or our own limit, if that's smaller), or 512 bytes for clients that
+// don't support EDNS.
+func responseLimit(w dns.ResponseWriter, req *dns.Msg, size uint16) int {
+	limit := dns.MaxMsgSize
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		limit = dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			if clientSize := int(opt.UDPSize()); clientSize > limit {
+				limit = clientSize
+			}
+			if limit > int(size) {
+				limit = int(size)
+			}
+		}
+	}
+	if signing, ok := w.(*tsigResponseWriter); ok {
+		limit -= signing.key.size()
+	}
+	return limit
+}
+
+// fitResponse makes the response to a query ready to send to the client. If
+// the client supports EDNS an OPT record is included with the size of the
+// largest UDP response we'll send, otherwise none is. UDP responses too big for
+// the client's buffer (or our own limit) first lose the optional records in
+// their additional section, and if that isn't enough everything else, with the
+// TC bit set to tell the client to ask again over TCP.
+func fitResponse(w dns.ResponseWriter, req *dns.Msg, msg *dns.Msg, size uint16) {
+	truncatedCounter := metrics.GetOrRegisterCounter("request.handler.truncated", metrics.DefaultRegistry)
+
+	msg.Compress = true
+	var opt *dns.OPT
+	extra := make([]dns.RR, 0, len(msg.Extra))
+	for _, rr := range msg.Extra {
+		if rrOpt, ok := rr.(*dns.OPT); ok {
+			opt = rrOpt
+		} else {
+			extra = append(extra, rr)
+		}
+	}
+
+	var echo []dns.RR
+	if req.IsEdns0() != nil {
+		if opt == nil {
+			opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		}
+		opt.SetVersion(ednsVersion)
+		opt.SetUDPSize(size)
+		echo = []dns.RR{opt}
+	}
+	msg.Extra = append(extra, echo...)
+
+	limit := responseLimit(w, req, size)
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok || msg.Len() <= limit {
+		return
+	}
+
+	// Only the OPT record is kept once the additional section is trimmed
+	msg.Extra = echo
+	if msg.Len() <= limit {
+		return
+	}
+	truncatedCounter.Inc(1)
+	msg.Truncated = true
+	msg.Answer = nil
+	msg.Ns = nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	testUDPAddr = &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}
+	testTCPAddr = &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}
+)
+
+func newTestHandler() *handler {
+	return &handler{
+		resolver:       resolver,
+		queryFilterer:  &QueryFilterer{},
+		ednsSize:       1232,
+		requestCounter: metrics.NewCounter(),
+		acceptCounter:  metrics.NewCounter(),
+		rejectCounter:  metrics.NewCounter(),
+		responseTimer:  metrics.NewTimer()}
+}
+
+// testLargeRecords holds 40 TXT records for big.disco.net., which don't fit in
+// 1232 bytes, and an MX record pointing at a name with 40 addresses
+var testLargeRecords = func() map[string]string {
+	records := map[string]string{".MX": "10\tmail.disco.net."}
+	for i := 0; i < 40; i++ {
+		records[fmt.Sprintf("big/.TXT/%d", i)] = fmt.Sprintf("%040d", i)
+		records[fmt.Sprintf("mail/.A/%d", i)] = fmt.Sprintf("1.1.1.%d", i)
+	}
+	return records
+}()
+
+func TestHandleEdns(t *testing.T) {
+	resolver.etcdPrefix = "TestHandleEdns/"
+	newTestZone("TestHandleEdns", testLargeRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	tests := []struct {
+		addr      net.Addr
+		size      uint16
+		truncated bool
+		answers   int
+		extra     int
+	}{
+		// Without EDNS there's no OPT record, and 512 bytes to fit in
+		{testUDPAddr, 0, true, 0, 0},
+		{testUDPAddr, 1024, true, 0, 1},
+		{testUDPAddr, 4096, false, 40, 1},
+		// Our own limit applies if the client's buffer is bigger
+		{testUDPAddr, 65000, false, 40, 1},
+		{testTCPAddr, 0, false, 40, 0},
+	}
+	for i, test := range tests {
+		h := newTestHandler()
+		h.ednsSize = 4096
+		req := new(dns.Msg)
+		req.SetQuestion("big.disco.net.", dns.TypeTXT)
+		if test.size > 0 {
+			req.SetEdns0(test.size, false)
+		}
+		w := &testResponseWriter{remoteAddr: test.addr}
+		h.Handle(w, req)
+
+		msg := w.msgs[0]
+		if msg.Truncated != test.truncated || len(msg.Answer) != test.answers || len(msg.Extra) != test.extra {
+			t.Fatalf("Test %d: expected truncated %t with %d answers and %d additional records, got %t with %d and %d", i, test.truncated, test.answers, test.extra, msg.Truncated, len(msg.Answer), len(msg.Extra))
+		}
+		if opt := msg.IsEdns0(); opt != nil && (opt.UDPSize() != 4096 || opt.Version() != 0) {
+			t.Fatalf("Test %d: expected our own buffer size in the OPT record, got %v", i, opt)
+		}
+		if buf, err := msg.Pack(); err != nil || (test.addr == testUDPAddr && len(buf) > int(test.size) && len(buf) > dns.MinMsgSize) {
+			t.Fatalf("Test %d: expected the response to fit in the buffer, got %d bytes (%v)", i, len(buf), err)
+		}
+	}
+}
+
+func TestHandleEdnsAdditional(t *testing.T) {
+	resolver.etcdPrefix = "TestHandleEdnsAdditional/"
+	newTestZone("TestHandleEdnsAdditional", testLargeRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	// The additional records are dropped before truncating the answers
+	h := newTestHandler()
+	h.ednsSize = 512
+	req := new(dns.Msg)
+	req.SetQuestion("disco.net.", dns.TypeMX)
+	req.SetEdns0(4096, false)
+	w := &testResponseWriter{remoteAddr: testUDPAddr}
+	h.Handle(w, req)
+
+	if msg := w.msgs[0]; msg.Truncated || len(msg.Answer) != 1 || len(msg.Extra) != 1 || msg.Extra[0].Header().Rrtype != dns.TypeOPT {
+		t.Fatal("Expected the answer with only the OPT record, got ", msg)
+	}
+}
+
+func TestHandleBadVersion(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("disco.net.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	req.IsEdns0().SetVersion(1)
+
+	w := &testResponseWriter{remoteAddr: testUDPAddr}
+	newTestHandler().Handle(w, req)
+
+	buf, err := w.msgs[0].Pack()
+	if err != nil {
+		t.Fatal("Unable to pack response: ", err)
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buf); err != nil {
+		t.Fatal("Unable to unpack response: ", err)
+	}
+	opt := msg.IsEdns0()
+	if opt == nil || opt.Version() != 0 || msg.Rcode|(opt.ExtendedRcode()-15)<<4 != dns.RcodeBadVers {
+		t.Fatal("Expected BADVERS, got ", msg)
+	}
+}
@@ -3,20 +3,19 @@ package main
 import (
 	"fmt"
 
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/miekg/dns"
 )
 
-// NodeConversionError holds the details for when an error occurs converting an etcd node into the expected resource record.
+// NodeConversionError holds the details for when an error occurs converting a storage node into the expected resource record.
 type NodeConversionError struct {
 	Message       string
-	Node          *etcd.Node
+	Node          *Node
 	AttemptedType uint16
 }
 
 func (e *NodeConversionError) Error() string {
 	return fmt.Sprintf(
-		"Unable to convert etc Node into a RR of type %d ('%s'): %s. Node details: %+v",
+		"Unable to convert Node into a RR of type %d ('%s'): %s. Node details: %+v",
 		e.AttemptedType,
 		dns.TypeToString[e.AttemptedType],
 		e.Message,
@@ -35,3 +34,67 @@ func (e *RecordValueError) Error() string {
 		e.AttemptedType,
 		e.Message)
 }
+
+// KeyNotFoundError is returned by a RecordStore when the requested key doesn't exist.
+type KeyNotFoundError struct {
+	Key string
+}
+
+func (e *KeyNotFoundError) Error() string {
+	return fmt.Sprintf("Key not found: %s", e.Key)
+}
+
+// CompareFailedError is returned by a WritableRecordStore when a conditional
+// write fails, because the key has been changed since it was read.
+type CompareFailedError struct {
+	Key string
+}
+
+func (e *CompareFailedError) Error() string {
+	return fmt.Sprintf("Key has been modified: %s", e.Key)
+}
+
+// ReadOnlyError is returned when writing to a key held by a store that can't
+// be written to.
+type ReadOnlyError struct {
+	Key string
+}
+
+func (e *ReadOnlyError) Error() string {
+	return fmt.Sprintf("Key is read only: %s", e.Key)
+}
+
+// IndexClearedError is returned by a RecordStore when asked to watch for
+// changes from an index that has already fallen out of its event history, so
+// the changes since then can't be sent. The watcher needs to read the keys
+// again and carry on from the current index.
+type IndexClearedError struct {
+	Key   string
+	Index uint64
+}
+
+func (e *IndexClearedError) Error() string {
+	return fmt.Sprintf("Index %d has been cleared from the history of %s", e.Index, e.Key)
+}
+
+// UpstreamError is returned when a query sent on to another nameserver fails,
+// or is answered with an error.
+type UpstreamError struct {
+	Addr    string
+	Message string
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("Query to %s failed: %s", e.Addr, e.Message)
+}
+
+// NotReadyError is returned by a CachedStore when a key can't be read before
+// the cache has loaded for the first time.
+type NotReadyError struct {
+	Key     string
+	Message string
+}
+
+func (e *NotReadyError) Error() string {
+	return fmt.Sprintf("Store isn't ready to read %s: %s", e.Key, e.Message)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// EtcdStore is a RecordStore backed by an etcd cluster, using the v2 keys API
+type EtcdStore struct {
+	client *etcd.Client
+}
+
+// NewEtcdStore creates a RecordStore talking to the given etcd hosts
+func NewEtcdStore(hosts []string) *EtcdStore {
+	return &EtcdStore{client: etcd.NewClient(hosts)}
+}
+
+// SyncCluster refreshes the list of etcd cluster members, returning false if
+// no members could be reached.
+func (s *EtcdStore) SyncCluster() bool {
+	return s.client.SyncCluster()
+}
+
+// Get implements RecordStore
+func (s *EtcdStore) Get(key string) (*Node, error) {
+	response, err := s.client.Get(key, true, true)
+	if err != nil {
+		return nil, convertEtcdError(key, err)
+	}
+	return convertEtcdNode(response.Node), nil
+}
+
+// Snapshot implements SnapshotRecordStore
+func (s *EtcdStore) Snapshot(key string) (*Node, uint64, error) {
+	response, err := s.client.Get(key, true, true)
+	if err != nil {
+		if e, ok := err.(*etcd.EtcdError); ok {
+			return nil, e.Index, convertEtcdError(key, err)
+		}
+		return nil, 0, err
+	}
+	return convertEtcdNode(response.Node), response.EtcdIndex, nil
+}
+
+// Create implements WritableRecordStore
+func (s *EtcdStore) Create(key string, value string) error {
+	_, err := s.client.Create(key, value, 0)
+	return convertEtcdError(key, err)
+}
+
+// CompareAndSwap implements WritableRecordStore
+func (s *EtcdStore) CompareAndSwap(key string, value string, prevIndex uint64) error {
+	_, err := s.client.CompareAndSwap(key, value, 0, "", prevIndex)
+	return convertEtcdError(key, err)
+}
+
+// CompareAndDelete implements WritableRecordStore
+func (s *EtcdStore) CompareAndDelete(key string, prevIndex uint64) error {
+	_, err := s.client.CompareAndDelete(key, "", prevIndex)
+	return convertEtcdError(key, err)
+}
+
+// Delete implements WritableRecordStore
+func (s *EtcdStore) Delete(key string) error {
+	_, err := s.client.Delete(key, true)
+	return convertEtcdError(key, err)
+}
+
+// Watch implements RecordStore
+func (s *EtcdStore) Watch(key string, waitIndex uint64, events chan *StoreEvent, stop chan bool) error {
+	defer close(events)
+
+	receiver := make(chan *etcd.Response)
+	errors := make(chan error, 1)
+	go func() {
+		_, err := s.client.Watch(key, waitIndex, true, receiver, stop)
+		errors <- err
+	}()
+
+	for response := range receiver {
+		events <- &StoreEvent{
+			Action:   response.Action,
+			Node:     convertEtcdNode(response.Node),
+			PrevNode: convertEtcdNode(response.PrevNode)}
+	}
+
+	err := <-errors
+	if err == etcd.ErrWatchStoppedByUser {
+		return nil
+	}
+	return convertEtcdError(key, err)
+}
+
+// convertEtcdNode copies an etcd node (and any children) into a Node
+func convertEtcdNode(node *etcd.Node) *Node {
+	if node == nil {
+		return nil
+	}
+	converted := &Node{
+		Key:           node.Key,
+		Value:         node.Value,
+		Dir:           node.Dir,
+		ModifiedIndex: node.ModifiedIndex}
+	for _, child := range node.Nodes {
+		converted.Nodes = append(converted.Nodes, convertEtcdNode(child))
+	}
+	return converted
+}
+
+// convertEtcdError turns etcd's "key not found" error into a KeyNotFoundError,
+// and its "compare failed" and "node exists" errors into a CompareFailedError,
+// leaving any other error untouched.
+func convertEtcdError(key string, err error) error {
+	if e, ok := err.(*etcd.EtcdError); ok {
+		switch e.ErrorCode {
+		case 100:
+			return &KeyNotFoundError{Key: key}
+		case 101, 105:
+			return &CompareFailedError{Key: key}
+		case 401:
+			return &IndexClearedError{Key: key, Index: e.Index}
+		}
+	}
+	return err
+}
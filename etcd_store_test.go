@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEtcd(t *testing.T) {
+	// Enable debug logging
+	logDebug = true
+
+	etcdStore := NewEtcdStore([]string{"http://127.0.0.1:4001"})
+	if !etcdStore.SyncCluster() {
+		t.Skip("Failed to sync etcd cluster, skipping etcd tests")
+	}
+
+	etcdStore.client.Set("TestEtcd/net/disco/.A", "1.1.1.1", 0)
+	defer etcdStore.client.Delete("TestEtcd/", true)
+
+	node, err := etcdStore.Get("TestEtcd/net/disco/.A")
+	if err != nil {
+		t.Fatal("Error returned from etcd", err)
+	}
+	if node.Value != "1.1.1.1" {
+		t.Fatal("Node value should be 1.1.1.1: ", node.Value)
+	}
+
+	_, err = etcdStore.Get("TestEtcd/net/disco/.AAAA")
+	if _, ok := err.(*KeyNotFoundError); !ok {
+		t.Fatal("Expected a KeyNotFoundError, got ", err)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EtcdV3Store is a RecordStore backed by an etcd v3 cluster. It speaks to the
+// v3 KV, lease and watch services through etcd's JSON gRPC gateway.
+//
+// The v3 key space is flat, so the directory structure of the v2 layout is
+// emulated by treating "/" in keys as a separator; the key /net/disco/.A is
+// a directory if any keys beginning with /net/disco/.A/ exist. The mod
+// revision of each key is used as its modified index.
+type EtcdV3Store struct {
+	endpoints []string
+	client    *http.Client
+}
+
+// NewEtcdV3Store creates a RecordStore talking to the given etcd v3 hosts
+func NewEtcdV3Store(hosts []string) *EtcdV3Store {
+	endpoints := make([]string, len(hosts))
+	for i, host := range hosts {
+		if !strings.HasPrefix(host, "http://") && !strings.HasPrefix(host, "https://") {
+			host = "http://" + host
+		}
+		endpoints[i] = strings.TrimRight(host, "/")
+	}
+	return &EtcdV3Store{endpoints: endpoints, client: &http.Client{}}
+}
+
+// Structures used by the v3 JSON gateway. Byte fields are base64 encoded and
+// 64 bit integers are encoded as strings.
+type etcdV3Header struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdV3KeyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+	Lease       int64  `json:"lease,string"`
+}
+
+type etcdV3RangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type etcdV3RangeResponse struct {
+	Header etcdV3Header      `json:"header"`
+	Kvs    []*etcdV3KeyValue `json:"kvs"`
+}
+
+type etcdV3PutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease int64  `json:"lease,string,omitempty"`
+}
+
+type etcdV3DeleteRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type etcdV3Compare struct {
+	Target         string `json:"target"`
+	Key            []byte `json:"key"`
+	CreateRevision int64  `json:"create_revision,string,omitempty"`
+	ModRevision    int64  `json:"mod_revision,string,omitempty"`
+}
+
+type etcdV3RequestOp struct {
+	RequestPut         *etcdV3PutRequest    `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdV3DeleteRequest `json:"request_delete_range,omitempty"`
+}
+
+type etcdV3TxnRequest struct {
+	Compare []*etcdV3Compare   `json:"compare"`
+	Success []*etcdV3RequestOp `json:"success"`
+}
+
+type etcdV3TxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+type etcdV3LeaseGrantRequest struct {
+	TTL int64 `json:"TTL,string"`
+}
+
+type etcdV3LeaseGrantResponse struct {
+	ID int64 `json:"ID,string"`
+}
+
+type etcdV3WatchCreateRequest struct {
+	Key           []byte `json:"key"`
+	RangeEnd      []byte `json:"range_end,omitempty"`
+	StartRevision int64  `json:"start_revision,string,omitempty"`
+	PrevKv        bool   `json:"prev_kv"`
+}
+
+type etcdV3WatchRequest struct {
+	CreateRequest etcdV3WatchCreateRequest `json:"create_request"`
+}
+
+type etcdV3Event struct {
+	Type   string          `json:"type"`
+	Kv     *etcdV3KeyValue `json:"kv"`
+	PrevKv *etcdV3KeyValue `json:"prev_kv"`
+}
+
+type etcdV3WatchResponse struct {
+	Result struct {
+		Header          etcdV3Header   `json:"header"`
+		Canceled        bool           `json:"canceled"`
+		CancelReason    string         `json:"cancel_reason"`
+		CompactRevision int64          `json:"compact_revision,string"`
+		Events          []*etcdV3Event `json:"events"`
+	} `json:"result"`
+	Error *etcdV3Error `json:"error"`
+}
+
+type etcdV3Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Get implements RecordStore
+func (s *EtcdV3Store) Get(key string) (*Node, error) {
+	node, _, err := s.Snapshot(key)
+	return node, err
+}
+
+// Snapshot implements SnapshotRecordStore
+func (s *EtcdV3Store) Snapshot(key string) (*Node, uint64, error) {
+	key = cleanKey(key)
+	var response etcdV3RangeResponse
+	request := &etcdV3RangeRequest{Key: []byte(key), RangeEnd: etcdV3PrefixEnd(key)}
+	if err := s.call("/v3/kv/range", request, &response); err != nil {
+		return nil, 0, err
+	}
+	index := uint64(response.Header.Revision)
+
+	var leaf *Node
+	root := &Node{Key: "/", Dir: true}
+	for _, kv := range response.Kvs {
+		node := convertEtcdV3KeyValue(kv)
+		if node.Key == key {
+			leaf = node
+		} else if keyWithin(node.Key, key) {
+			if _, err := root.insert(node); err != nil {
+				debugMsg("Ignoring etcd v3 key: ", err)
+			}
+		}
+	}
+
+	if node := root.find(key); node != nil && (key == "/" || len(node.Nodes) > 0) {
+		return node, index, nil
+	} else if leaf != nil {
+		return leaf, index, nil
+	}
+	return nil, index, &KeyNotFoundError{Key: key}
+}
+
+// Set stores the value at the given key. If the ttl is greater than zero, the
+// key is attached to a new lease so that it expires after ttl seconds.
+func (s *EtcdV3Store) Set(key string, value string, ttl uint64) error {
+	request := &etcdV3PutRequest{Key: []byte(cleanKey(key)), Value: []byte(value)}
+	if ttl > 0 {
+		var lease etcdV3LeaseGrantResponse
+		if err := s.call("/v3/lease/grant", &etcdV3LeaseGrantRequest{TTL: int64(ttl)}, &lease); err != nil {
+			return err
+		}
+		request.Lease = lease.ID
+	}
+	return s.call("/v3/kv/put", request, nil)
+}
+
+// Delete removes the given key, and every key beneath it
+func (s *EtcdV3Store) Delete(key string) error {
+	key = cleanKey(key)
+	if err := s.call("/v3/kv/deleterange", &etcdV3DeleteRequest{Key: []byte(key)}, nil); err != nil {
+		return err
+	}
+	prefix := strings.TrimRight(key, "/") + "/"
+	return s.call("/v3/kv/deleterange", &etcdV3DeleteRequest{Key: []byte(prefix), RangeEnd: etcdV3PrefixEnd(prefix)}, nil)
+}
+
+// Create implements WritableRecordStore
+func (s *EtcdV3Store) Create(key string, value string) error {
+	key = cleanKey(key)
+	return s.txn(key,
+		&etcdV3Compare{Target: "CREATE", Key: []byte(key), CreateRevision: 0},
+		&etcdV3RequestOp{RequestPut: &etcdV3PutRequest{Key: []byte(key), Value: []byte(value)}})
+}
+
+// CompareAndSwap implements WritableRecordStore
+func (s *EtcdV3Store) CompareAndSwap(key string, value string, prevIndex uint64) error {
+	key = cleanKey(key)
+	return s.txn(key,
+		&etcdV3Compare{Target: "MOD", Key: []byte(key), ModRevision: int64(prevIndex)},
+		&etcdV3RequestOp{RequestPut: &etcdV3PutRequest{Key: []byte(key), Value: []byte(value)}})
+}
+
+// CompareAndDelete implements WritableRecordStore
+func (s *EtcdV3Store) CompareAndDelete(key string, prevIndex uint64) error {
+	key = cleanKey(key)
+	return s.txn(key,
+		&etcdV3Compare{Target: "MOD", Key: []byte(key), ModRevision: int64(prevIndex)},
+		&etcdV3RequestOp{RequestDeleteRange: &etcdV3DeleteRequest{Key: []byte(key)}})
+}
+
+// txn performs the operation if the comparison holds, returning a
+// CompareFailedError if it doesn't.
+func (s *EtcdV3Store) txn(key string, compare *etcdV3Compare, op *etcdV3RequestOp) error {
+	var response etcdV3TxnResponse
+	request := &etcdV3TxnRequest{Compare: []*etcdV3Compare{compare}, Success: []*etcdV3RequestOp{op}}
+	if err := s.call("/v3/kv/txn", request, &response); err != nil {
+		return err
+	}
+	if !response.Succeeded {
+		return &CompareFailedError{Key: key}
+	}
+	return nil
+}
+
+// Watch implements RecordStore
+func (s *EtcdV3Store) Watch(key string, waitIndex uint64, events chan *StoreEvent, stop chan bool) error {
+	defer close(events)
+	key = cleanKey(key)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	request := &etcdV3WatchRequest{CreateRequest: etcdV3WatchCreateRequest{
+		Key:           []byte(key),
+		RangeEnd:      etcdV3PrefixEnd(key),
+		StartRevision: int64(waitIndex),
+		PrevKv:        true}}
+	response, err := s.post(ctx, "/v3/watch", request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer response.Body.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(response.Body))
+	for {
+		var message etcdV3WatchResponse
+		if err := decoder.Decode(&message); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if message.Error != nil {
+			return fmt.Errorf("etcd v3 watch error %d: %s", message.Error.Code, message.Error.Message)
+		}
+		if message.Result.CompactRevision > 0 {
+			return &IndexClearedError{Key: key, Index: waitIndex}
+		}
+		if message.Result.Canceled {
+			return fmt.Errorf("etcd v3 watch on %s was cancelled: %s", key, message.Result.CancelReason)
+		}
+
+		for _, event := range message.Result.Events {
+			node := convertEtcdV3KeyValue(event.Kv)
+			if !keyWithin(node.Key, key) {
+				continue
+			}
+			storeEvent := &StoreEvent{Action: "set", Node: node}
+			if event.Type == "DELETE" {
+				storeEvent.Action = "delete"
+			}
+			if event.PrevKv != nil {
+				storeEvent.PrevNode = convertEtcdV3KeyValue(event.PrevKv)
+			}
+
+			select {
+			case events <- storeEvent:
+			case <-stop:
+				return nil
+			}
+		}
+	}
+}
+
+// call posts a request to each endpoint in turn until one of them succeeds,
+// decoding the response into the given value (if any).
+func (s *EtcdV3Store) call(path string, request interface{}, response interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	httpResponse, err := s.post(ctx, path, request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(httpResponse.Body).Decode(response)
+}
+
+// post sends the request to the first endpoint that accepts it
+func (s *EtcdV3Store) post(ctx context.Context, path string, request interface{}) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fmt.Errorf("No etcd v3 endpoints configured")
+	for _, endpoint := range s.endpoints {
+		var httpRequest *http.Request
+		httpRequest, err = http.NewRequest("POST", endpoint+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		httpRequest.Header.Set("Content-Type", "application/json")
+
+		var response *http.Response
+		response, err = s.client.Do(httpRequest.WithContext(ctx))
+		if err != nil {
+			debugMsg("etcd v3 request to ", endpoint, " failed: ", err)
+			continue
+		}
+		if response.StatusCode != http.StatusOK {
+			var message etcdV3Error
+			json.NewDecoder(response.Body).Decode(&message)
+			response.Body.Close()
+			return nil, fmt.Errorf("etcd v3 request %s failed (%d): %s", path, response.StatusCode, message.Message)
+		}
+		return response, nil
+	}
+	return nil, err
+}
+
+// convertEtcdV3KeyValue turns a v3 key value pair into a (leaf) Node
+func convertEtcdV3KeyValue(kv *etcdV3KeyValue) *Node {
+	return &Node{
+		Key:           cleanKey(string(kv.Key)),
+		Value:         string(kv.Value),
+		ModifiedIndex: uint64(kv.ModRevision)}
+}
+
+// etcdV3PrefixEnd returns the end of the range covering every key that begins
+// with the given prefix.
+func etcdV3PrefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// The prefix is all 0xff bytes, so range to the end of the key space
+	return []byte{0}
+}
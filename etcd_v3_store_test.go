@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeEtcdV3 serves canned responses for the etcd v3 JSON gateway
+func fakeEtcdV3(t *testing.T, handlers map[string]func(request map[string]interface{}) interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[r.URL.Path]
+		if !ok {
+			t.Error("Unexpected request to ", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		var request map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&request)
+		json.NewEncoder(w).Encode(handler(request))
+	}))
+}
+
+func etcdV3KV(key string, value string, revision int64) *etcdV3KeyValue {
+	return &etcdV3KeyValue{Key: []byte(key), Value: []byte(value), ModRevision: revision}
+}
+
+func TestEtcdV3StoreGetSingleKey(t *testing.T) {
+	server := fakeEtcdV3(t, map[string]func(map[string]interface{}) interface{}{
+		"/v3/kv/range": func(request map[string]interface{}) interface{} {
+			return &etcdV3RangeResponse{
+				Header: etcdV3Header{Revision: 12},
+				Kvs: []*etcdV3KeyValue{
+					etcdV3KV("/net/disco/.A", "1.1.1.1", 10),
+					etcdV3KV("/net/disco/.A.ttl", "60", 11)}}
+		}})
+	defer server.Close()
+
+	node, index, err := NewEtcdV3Store([]string{server.URL}).Snapshot("/net/disco/.A")
+	if err != nil {
+		t.Fatal("Error returned from etcd", err)
+	}
+	if index != 12 {
+		t.Fatal("Expected index 12: ", index)
+	}
+	if node.Dir {
+		t.Fatal("Expected a file node")
+	}
+	if node.Value != "1.1.1.1" || node.ModifiedIndex != 10 {
+		t.Fatal("Expected value 1.1.1.1 at index 10: ", node)
+	}
+}
+
+func TestEtcdV3StoreGetDirectory(t *testing.T) {
+	server := fakeEtcdV3(t, map[string]func(map[string]interface{}) interface{}{
+		"/v3/kv/range": func(request map[string]interface{}) interface{} {
+			return &etcdV3RangeResponse{
+				Header: etcdV3Header{Revision: 12},
+				Kvs: []*etcdV3KeyValue{
+					etcdV3KV("/net/disco/.A/0", "1.1.1.1", 10),
+					etcdV3KV("/net/disco/.A/1", "1.1.1.2", 11),
+					etcdV3KV("/net/disco/.A/2/0", "1.1.1.3", 12),
+					etcdV3KV("/net/disco/.AAAA", "::1", 9)}}
+		}})
+	defer server.Close()
+
+	node, err := NewEtcdV3Store([]string{server.URL}).Get("/net/disco/.A")
+	if err != nil {
+		t.Fatal("Error returned from etcd", err)
+	}
+	if !node.Dir {
+		t.Fatal("Expected a directory node")
+	}
+
+	leaves := node.Leaves()
+	if len(leaves) != 3 {
+		t.Fatal("Expected 3 leaves, got ", len(leaves))
+	}
+	if leaves[2].Key != "/net/disco/.A/2/0" || leaves[2].Value != "1.1.1.3" {
+		t.Fatal("Expected the nested key /net/disco/.A/2/0: ", leaves[2])
+	}
+}
+
+func TestEtcdV3StoreGetMissingKey(t *testing.T) {
+	server := fakeEtcdV3(t, map[string]func(map[string]interface{}) interface{}{
+		"/v3/kv/range": func(request map[string]interface{}) interface{} {
+			return &etcdV3RangeResponse{Header: etcdV3Header{Revision: 12}}
+		}})
+	defer server.Close()
+
+	_, err := NewEtcdV3Store([]string{server.URL}).Get("/net/disco/.A")
+	if _, ok := err.(*KeyNotFoundError); !ok {
+		t.Fatal("Expected a KeyNotFoundError, got ", err)
+	}
+}
+
+func TestEtcdV3StoreSetWithLease(t *testing.T) {
+	var put map[string]interface{}
+	server := fakeEtcdV3(t, map[string]func(map[string]interface{}) interface{}{
+		"/v3/lease/grant": func(request map[string]interface{}) interface{} {
+			if request["TTL"] != "30" {
+				t.Error("Expected a lease TTL of 30: ", request["TTL"])
+			}
+			return &etcdV3LeaseGrantResponse{ID: 1234}
+		},
+		"/v3/kv/put": func(request map[string]interface{}) interface{} {
+			put = request
+			return struct{}{}
+		}})
+	defer server.Close()
+
+	if err := NewEtcdV3Store([]string{server.URL}).Set("/net/disco/.A", "1.1.1.1", 30); err != nil {
+		t.Fatal("Error returned from etcd", err)
+	}
+	if put["lease"] != "1234" {
+		t.Fatal("Expected the key to be attached to lease 1234: ", put["lease"])
+	}
+}
+
+func TestEtcdV3StoreCompareAndSwap(t *testing.T) {
+	succeeded := true
+	var txn map[string]interface{}
+	server := fakeEtcdV3(t, map[string]func(map[string]interface{}) interface{}{
+		"/v3/kv/txn": func(request map[string]interface{}) interface{} {
+			txn = request
+			return &etcdV3TxnResponse{Succeeded: succeeded}
+		}})
+	defer server.Close()
+	etcdStore := NewEtcdV3Store([]string{server.URL})
+
+	if err := etcdStore.CompareAndSwap("/net/disco/.A", "1.1.1.1", 7); err != nil {
+		t.Fatal("Error returned from etcd", err)
+	}
+	compare := txn["compare"].([]interface{})[0].(map[string]interface{})
+	if compare["target"] != "MOD" || compare["mod_revision"] != "7" {
+		t.Fatal("Expected a comparison of the mod revision: ", compare)
+	}
+	if _, ok := txn["success"].([]interface{})[0].(map[string]interface{})["request_put"]; !ok {
+		t.Fatal("Expected a put if the comparison succeeds: ", txn["success"])
+	}
+
+	succeeded = false
+	if _, ok := etcdStore.CompareAndDelete("/net/disco/.A", 7).(*CompareFailedError); !ok {
+		t.Fatal("Expected a CompareFailedError when the transaction fails")
+	}
+}
+
+func TestEtcdV3StoreWatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoder := json.NewEncoder(w)
+		var created etcdV3WatchResponse
+		created.Result.Header.Revision = 10
+		encoder.Encode(&created)
+
+		var changes etcdV3WatchResponse
+		changes.Result.Header.Revision = 12
+		changes.Result.Events = []*etcdV3Event{
+			{Kv: etcdV3KV("/net/disco/.A", "1.1.1.2", 11), PrevKv: etcdV3KV("/net/disco/.A", "1.1.1.1", 5)},
+			{Type: "DELETE", Kv: etcdV3KV("/net/disco/.TXT", "", 12)}}
+		encoder.Encode(&changes)
+	}))
+	defer server.Close()
+
+	events := make(chan *StoreEvent)
+	stop := make(chan bool)
+	defer close(stop)
+	go NewEtcdV3Store([]string{server.URL}).Watch("/net/disco", 11, events, stop)
+
+	event := <-events
+	if event.Action != "set" || event.Node.Value != "1.1.1.2" || event.PrevNode.Value != "1.1.1.1" {
+		t.Fatal("Expected a set event from 1.1.1.1 to 1.1.1.2: ", event.Action, event.Node, event.PrevNode)
+	}
+	event = <-events
+	if event.Action != "delete" || event.Node.Key != "/net/disco/.TXT" || event.Node.ModifiedIndex != 12 {
+		t.Fatal("Expected a delete event for /net/disco/.TXT at index 12: ", event.Action, event.Node)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+// How long to wait before restarting the journal's watch after it fails
+const journalRetryInterval = time.Second
+
+// JournalEntry is a single change to a zone, taking it from one serial to
+// another by deleting and adding records.
+type JournalEntry struct {
+	From    uint32
+	To      uint32
+	Deleted []dns.RR
+	Added   []dns.RR
+}
+
+// zoneJournal is the latest version of a zone, and the changes leading up to it
+type zoneJournal struct {
+	soa     *dns.SOA
+	records []dns.RR
+	entries []*JournalEntry
+}
+
+// Journal keeps a bounded history of the changes made to each zone that has
+// been transferred, used to answer IXFR queries.
+//
+// Zones are tracked from the first time they're asked for, using a watch on
+// the store to find out when they change. Whenever a key within a tracked zone
+// changes the zone is read again and compared with the previous version to
+// find which records were deleted and added. Each version has the serial of
+// the zone's SOA at the time. If the records change without the serial
+// increasing (an SOA record with a serial set that wasn't updated along with
+// them) the change can't be described, so the history is forgotten and
+// clients fall back to a full transfer. Note that when zones are routed to
+// several backends the indexes of each backend are independent, so serials
+// are only meaningful for zones served from a single backend.
+type Journal struct {
+	sync.Mutex
+	resolver *Resolver
+	size     int
+	zones    map[string]*zoneJournal
+}
+
+// NewJournal creates a Journal keeping up to size changes for each zone
+func NewJournal(resolver *Resolver, size int) *Journal {
+	return &Journal{
+		resolver: resolver,
+		size:     size,
+		zones:    make(map[string]*zoneJournal)}
+}
+
+// Run watches the store for changes to tracked zones, blocking until the stop
+// channel is closed. Changes can be missed while the watch is down, so the
+// history of every zone is forgotten whenever it fails.
+func (j *Journal) Run(stop chan bool) {
+	for {
+		err := j.watch(stop)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		j.Lock()
+		j.zones = make(map[string]*zoneJournal)
+		j.Unlock()
+		logger.Printf("[WARNING] Lost watch for zone journal, discarding history: %s", err)
+
+		select {
+		case <-time.After(journalRetryInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Zone returns the latest version of a zone, starting to track it if it isn't
+// already. The SOA is nil if the zone doesn't exist.
+func (j *Journal) Zone(zone string) (soa *dns.SOA, records []dns.RR, err error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	j.Lock()
+	defer j.Unlock()
+
+	zj, ok := j.zones[zone]
+	if !ok {
+		if zj, err = j.load(zone); err != nil || zj == nil {
+			return
+		}
+		j.zones[zone] = zj
+	}
+	return dns.Copy(zj.soa).(*dns.SOA), zj.records, nil
+}
+
+// Changes returns the latest SOA of a zone and the changes made to it since
+// the given serial. If the zone isn't tracked, or its history doesn't go back
+// as far as the serial, ok is false.
+func (j *Journal) Changes(zone string, serial uint32) (soa *dns.SOA, entries []*JournalEntry, ok bool) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	j.Lock()
+	defer j.Unlock()
+
+	zj, tracked := j.zones[zone]
+	if !tracked {
+		return nil, nil, false
+	}
+	soa = dns.Copy(zj.soa).(*dns.SOA)
+	if soa.Serial == serial {
+		return soa, nil, true
+	}
+	for i, entry := range zj.entries {
+		if entry.From == serial {
+			return soa, append([]*JournalEntry(nil), zj.entries[i:]...), true
+		}
+	}
+	return nil, nil, false
+}
+
+// watch applies changes from a watch on the store until it fails or is stopped
+func (j *Journal) watch(stop chan bool) error {
+	eventCounter := metrics.GetOrRegisterCounter("journal.events", metrics.DefaultRegistry)
+	events := make(chan *StoreEvent)
+	done := make(chan error, 1)
+	go func() {
+		done <- j.resolver.store.Watch(cleanKey(j.resolver.etcdPrefix), 0, events, stop)
+	}()
+
+	for event := range events {
+		eventCounter.Inc(1)
+		j.apply(event)
+	}
+	return <-done
+}
+
+// apply updates every tracked zone containing the key changed by the event
+func (j *Journal) apply(event *StoreEvent) {
+	key := cleanKey(event.Node.Key)
+	if isSerialKey(key) {
+		return
+	}
+	// The serial may not have seen the change yet, it has a watch of its own
+	if zone := j.resolver.zoneForEvent(event); zone != "" {
+		j.resolver.observeSerial(zone, event)
+	}
+
+	j.Lock()
+	defer j.Unlock()
+	for zone := range j.zones {
+		if keyWithin(key, j.zoneKey(zone)) {
+			j.update(zone)
+		}
+	}
+}
+
+// update reads the zone again, adding an entry to its journal if it has
+// changed. The caller must hold the lock.
+func (j *Journal) update(zone string) {
+	entryCounter := metrics.GetOrRegisterCounter("journal.entries", metrics.DefaultRegistry)
+	zj := j.zones[zone]
+
+	soa, records, err := j.resolver.ZoneRecords(zone)
+	if err != nil || soa == nil {
+		debugMsg("Forgetting history of zone ", zone, ": ", err)
+		delete(j.zones, zone)
+		return
+	}
+
+	deleted := diffRecords(zj.records, records)
+	added := diffRecords(records, zj.records)
+	serial := soa.Serial
+	if serial <= zj.soa.Serial {
+		if len(deleted) > 0 || len(added) > 0 {
+			debugMsg("Zone ", zone, " changed without its serial increasing, forgetting history")
+			zj.entries = nil
+			zj.records = records
+		}
+		zj.soa = soa
+		return
+	}
+
+	entryCounter.Inc(1)
+	zj.entries = append(zj.entries, &JournalEntry{
+		From:    zj.soa.Serial,
+		To:      serial,
+		Deleted: deleted,
+		Added:   added})
+	if len(zj.entries) > j.size {
+		zj.entries = zj.entries[len(zj.entries)-j.size:]
+	}
+
+	zj.soa = soa
+	zj.records = records
+}
+
+// load reads the current version of a zone, returning nil if it doesn't exist
+func (j *Journal) load(zone string) (*zoneJournal, error) {
+	soa, records, err := j.resolver.ZoneRecords(zone)
+	if err != nil || soa == nil {
+		return nil, err
+	}
+	return &zoneJournal{soa: soa, records: records}, nil
+}
+
+// zoneKey returns the store key of a zone
+func (j *Journal) zoneKey(zone string) string {
+	return cleanKey(j.resolver.etcdPrefix + nameToKey(zone, ""))
+}
+
+// diffRecords returns the records in a that aren't in b
+func diffRecords(a []dns.RR, b []dns.RR) (diff []dns.RR) {
+	existing := make(map[string]bool, len(b))
+	for _, rr := range b {
+		existing[rr.String()] = true
+	}
+	for _, rr := range a {
+		if !existing[rr.String()] {
+			diff = append(diff, rr)
+		}
+	}
+	return
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestJournal creates a running journal with its own store, holding a
+// small zone.
+func newTestJournal(t *testing.T, size int) (*MemoryStore, *Journal, chan bool) {
+	journalStore := NewMemoryStore()
+	journalStore.Set("/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	journalStore.Set("/net/disco/www/.A/0", "1.1.1.1")
+
+	resolver := &Resolver{store: journalStore}
+	resolver.serials = NewZoneSerials(resolver)
+	journal := NewJournal(resolver, size)
+	stop := make(chan bool)
+	go journal.Run(stop)
+
+	soa, records, err := journal.Zone("disco.net.")
+	if err != nil || soa == nil {
+		t.Fatal("Expected zone disco.net. to be tracked: ", soa, err)
+	}
+	if soa.Serial != 2 || len(records) != 1 {
+		t.Fatal("Expected serial 2 with one record: ", soa, records)
+	}
+	return journalStore, journal, stop
+}
+
+// waitForSerial waits for the journal to reach the given serial for a zone
+func waitForSerial(t *testing.T, journal *Journal, zone string, serial uint32) {
+	for i := 0; i < 100; i++ {
+		if soa, _, ok := journal.Changes(zone, serial); ok && soa.Serial == serial {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for serial ", serial, " of ", zone)
+}
+
+func TestJournalChanges(t *testing.T) {
+	journalStore, journal, stop := newTestJournal(t, 10)
+	defer close(stop)
+	time.Sleep(10 * time.Millisecond)
+
+	journalStore.Set("/net/disco/www/.A/1", "1.1.1.2")
+	waitForSerial(t, journal, "disco.net.", 3)
+	journalStore.Delete("/net/disco/www/.A/0")
+	waitForSerial(t, journal, "disco.net.", 4)
+
+	soa, entries, ok := journal.Changes("disco.net.", 2)
+	if !ok || soa.Serial != 4 {
+		t.Fatal("Expected changes up to serial 4: ", soa, ok)
+	}
+	if len(entries) != 2 {
+		t.Fatal("Expected 2 journal entries: ", entries)
+	}
+	if entries[0].From != 2 || entries[0].To != 3 || len(entries[0].Deleted) != 0 || len(entries[0].Added) != 1 {
+		t.Fatal("Unexpected first entry: ", entries[0])
+	}
+	if entries[0].Added[0].(*dns.A).A.String() != "1.1.1.2" {
+		t.Fatal("Expected 1.1.1.2 to be added: ", entries[0].Added)
+	}
+	if entries[1].From != 3 || entries[1].To != 4 || len(entries[1].Deleted) != 1 || len(entries[1].Added) != 0 {
+		t.Fatal("Unexpected second entry: ", entries[1])
+	}
+	if entries[1].Deleted[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Fatal("Expected 1.1.1.1 to be deleted: ", entries[1].Deleted)
+	}
+
+	if _, entries, ok := journal.Changes("disco.net.", 4); !ok || len(entries) != 0 {
+		t.Fatal("Expected no changes since the latest serial: ", entries, ok)
+	}
+	if _, _, ok := journal.Changes("disco.net.", 1); ok {
+		t.Fatal("Expected changes from an unknown serial to be unavailable")
+	}
+}
+
+func TestJournalSize(t *testing.T) {
+	journalStore, journal, stop := newTestJournal(t, 1)
+	defer close(stop)
+	time.Sleep(10 * time.Millisecond)
+
+	journalStore.Set("/net/disco/www/.A/1", "1.1.1.2")
+	waitForSerial(t, journal, "disco.net.", 3)
+	journalStore.Set("/net/disco/www/.A/2", "1.1.1.3")
+	waitForSerial(t, journal, "disco.net.", 4)
+
+	if _, _, ok := journal.Changes("disco.net.", 2); ok {
+		t.Fatal("Expected the oldest change to have been discarded")
+	}
+	if _, entries, ok := journal.Changes("disco.net.", 3); !ok || len(entries) != 1 {
+		t.Fatal("Expected the latest change to be kept: ", entries, ok)
+	}
+}
+
+func TestTransferIncremental(t *testing.T) {
+	journalStore, journal, stop := newTestJournal(t, 10)
+	defer close(stop)
+	time.Sleep(10 * time.Millisecond)
+
+	journalStore.Set("/net/disco/www/.A/1", "1.1.1.2")
+	waitForSerial(t, journal, "disco.net.", 3)
+
+	h := &handler{resolver: journal.resolver, transferAllow: parseNetworks([]string{"10.0.0.0/8"}), journal: journal}
+	req := new(dns.Msg)
+	req.SetIxfr("disco.net.", 2, "ns1.disco.net.", "admin.disco.net.")
+
+	w := &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}}
+	h.Transfer(w, req)
+
+	var rrs []dns.RR
+	for _, msg := range w.msgs {
+		rrs = append(rrs, msg.Answer...)
+	}
+	// SOA 3, SOA 2, SOA 3, added A, SOA 3
+	if len(rrs) != 5 {
+		t.Fatal("Expected 5 records in incremental transfer: ", rrs)
+	}
+	serials := []uint32{3, 2, 3}
+	for i, serial := range serials {
+		if soa, ok := rrs[i].(*dns.SOA); !ok || soa.Serial != serial {
+			t.Fatal("Expected SOA with serial ", serial, ": ", rrs[i])
+		}
+	}
+	if a, ok := rrs[3].(*dns.A); !ok || a.A.String() != "1.1.1.2" {
+		t.Fatal("Expected the added A record: ", rrs[3])
+	}
+
+	// A client that's up to date only gets the SOA
+	req.SetIxfr("disco.net.", 3, "ns1.disco.net.", "admin.disco.net.")
+	w = &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}}
+	h.Transfer(w, req)
+	if len(w.msgs) != 1 || len(w.msgs[0].Answer) != 1 {
+		t.Fatal("Expected a single SOA: ", w.msgs)
+	}
+
+	// A client that's too far behind gets the whole zone
+	req.SetIxfr("disco.net.", 1, "ns1.disco.net.", "admin.disco.net.")
+	w = &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}}
+	h.Transfer(w, req)
+	if len(w.msgs) != 1 || len(w.msgs[0].Answer) != 4 {
+		t.Fatal("Expected a full transfer of 4 records: ", w.msgs)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/base64"
 	"log"
 	"net"
 	"os"
@@ -9,7 +10,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/jessevdk/go-flags"
 	"github.com/miekg/dns"
 	"github.com/rcrowley/go-metrics"
@@ -21,16 +21,44 @@ var (
 
 	// Define all of the command line arguments
 	options struct {
-		ListenAddress    string   `short:"l" long:"listen" description:"Listen IP address" default:"0.0.0.0" env:"DISCODNS_LISTEN_ADDRESS"`
-		ListenPort       int      `short:"p" long:"port" description:"Port to listen on" default:"53" env:"DISCODNS_LISTEN_PORT"`
-		EtcdHosts        []string `short:"e" long:"etcd" description:"host:port[,host:port] for etcd hosts" default:"127.0.0.1:4001" env:"DISCODNS_ETCD_HOSTS"`
-		Debug            bool     `short:"v" long:"debug" description:"Enable debug logging" env:"DISCODNS_DEBUG"`
-		MetricsDuration  int      `short:"m" long:"metrics" description:"Dump metrics to stderr every N seconds" default:"30" env:"DISCODNS_METRICS_DURATION"`
-		GraphiteServer   string   `long:"graphite" description:"Graphite server to send metrics to" env:"DISCODNS_GRAPHITE_SERVER"`
-		GraphiteDuration int      `long:"graphite-duration" description:"Duration to periodically send metrics to the graphite server" default:"10" env:"DISCODNS_GRAPHITE_DURATION"`
-		DefaultTTL       uint32   `short:"t" long:"default-ttl" description:"Default TTL to return on records without an explicit TTL" default:"300" env:"DISCODNS_DEFAULT_TTL"`
-		Accept           []string `long:"accept" description:"Limit DNS queries to a set of domain:[type,...] pairs" env:"DISCODNS_ACCEPT"`
-		Reject           []string `long:"reject" description:"Limit DNS queries to a set of domain:[type,...] pairs" env:"DISCODNS_REJECT"`
+		ListenAddress     string   `short:"l" long:"listen" description:"Listen IP address" default:"0.0.0.0" env:"DISCODNS_LISTEN_ADDRESS"`
+		ListenPort        int      `short:"p" long:"port" description:"Port to listen on" default:"53" env:"DISCODNS_LISTEN_PORT"`
+		Backend           string   `long:"backend" description:"Where to read records from, when no routes are given" default:"etcd" choice:"etcd" choice:"zonefile" env:"DISCODNS_BACKEND"`
+		Routes            []string `long:"route" description:"Serve a zone from a set of backends, as zone:backend[,backend...][:merge]" env:"DISCODNS_ROUTES"`
+		EtcdHosts         []string `short:"e" long:"etcd" description:"host:port[,host:port] for etcd hosts" default:"127.0.0.1:4001" env:"DISCODNS_ETCD_HOSTS"`
+		EtcdAPI           string   `long:"etcd-api" description:"Version of the etcd API to use" default:"v2" choice:"v2" choice:"v3" env:"DISCODNS_ETCD_API"`
+		EtcdCache         bool     `long:"etcd-cache" description:"Answer queries from an in-memory copy of etcd, kept up to date with a watch" env:"DISCODNS_ETCD_CACHE"`
+		EtcdCacheStale    int      `long:"etcd-cache-staleness" description:"Seconds to keep answering from the cache after losing the etcd watch, before reading from etcd directly" default:"30" env:"DISCODNS_ETCD_CACHE_STALENESS"`
+		ZoneFiles         []string `long:"zone-file" description:"[origin:]path of an RFC 1035 zone file to serve records from" env:"DISCODNS_ZONE_FILES"`
+		ZoneFileInterval  int      `long:"zone-file-interval" description:"Seconds between checking zone files for changes" default:"5" env:"DISCODNS_ZONE_FILE_INTERVAL"`
+		Debug             bool     `short:"v" long:"debug" description:"Enable debug logging" env:"DISCODNS_DEBUG"`
+		MetricsDuration   int      `short:"m" long:"metrics" description:"Dump metrics to stderr every N seconds" default:"30" env:"DISCODNS_METRICS_DURATION"`
+		GraphiteServer    string   `long:"graphite" description:"Graphite server to send metrics to" env:"DISCODNS_GRAPHITE_SERVER"`
+		GraphiteDuration  int      `long:"graphite-duration" description:"Duration to periodically send metrics to the graphite server" default:"10" env:"DISCODNS_GRAPHITE_DURATION"`
+		DefaultTTL        uint32   `short:"t" long:"default-ttl" description:"Default TTL to return on records without an explicit TTL" default:"300" env:"DISCODNS_DEFAULT_TTL"`
+		Accept            []string `long:"accept" description:"Limit DNS queries to a set of domain:[type,...] pairs" env:"DISCODNS_ACCEPT"`
+		Reject            []string `long:"reject" description:"Limit DNS queries to a set of domain:[type,...] pairs" env:"DISCODNS_REJECT"`
+		TransferAllow     []string `long:"allow-transfer" description:"Networks (in CIDR notation) allowed to make zone transfers" env:"DISCODNS_ALLOW_TRANSFER"`
+		UpdateAllow       []string `long:"allow-update" description:"Networks (in CIDR notation) allowed to make dynamic updates" env:"DISCODNS_ALLOW_UPDATE"`
+		TsigKeys          []string `long:"tsig-key" description:"TSIG key for zone transfers, dynamic updates and notifications, as name:algorithm:secret[:zone,zone...]" env:"DISCODNS_TSIG_KEYS"`
+		TsigAllowUnsigned bool     `long:"tsig-allow-unsigned" description:"Accept unsigned zone transfers and dynamic updates from the allowed networks, even when there are TSIG keys" env:"DISCODNS_TSIG_ALLOW_UNSIGNED"`
+		JournalSize       int      `long:"ixfr-journal-size" description:"Number of changes to each zone to keep for incremental zone transfers" default:"100" env:"DISCODNS_IXFR_JOURNAL_SIZE"`
+		Notify            []string `long:"notify" description:"Secondary nameservers (host[:port]) to send NOTIFY messages to when zones change" env:"DISCODNS_NOTIFY"`
+		NotifyNS          bool     `long:"notify-ns" description:"Send NOTIFY messages to the nameservers in the NS records of zones that change" env:"DISCODNS_NOTIFY_NS"`
+		NotifyDelay       int      `long:"notify-delay" description:"Seconds to wait for changes to a zone to settle before sending NOTIFY messages" default:"5" env:"DISCODNS_NOTIFY_DELAY"`
+		DnssecKeyDir      string   `long:"dnssec-key-dir" description:"Directory of DNSSEC keys (as written by dnssec-keygen) to sign zones with" env:"DISCODNS_DNSSEC_KEY_DIR"`
+		DnssecKeyPrefix   string   `long:"dnssec-key-prefix" description:"Key in etcd beneath which DNSSEC keys to sign zones with are stored" env:"DISCODNS_DNSSEC_KEY_PREFIX"`
+		DnssecValidity    int      `long:"dnssec-signature-validity" description:"Hours that DNSSEC signatures are valid for" default:"168" env:"DISCODNS_DNSSEC_SIGNATURE_VALIDITY"`
+		DnssecCacheSize   int      `long:"dnssec-cache-size" description:"Number of signed RRsets to cache signatures for" default:"10000" env:"DISCODNS_DNSSEC_CACHE_SIZE"`
+		DnssecManage      []string `long:"dnssec-manage" description:"Zone to generate and roll over DNSSEC keys for, stored beneath the --dnssec-key-prefix" env:"DISCODNS_DNSSEC_MANAGE"`
+		DnssecAlgorithm   string   `long:"dnssec-algorithm" description:"Algorithm of the DNSSEC keys to generate" default:"ECDSAP256SHA256" env:"DISCODNS_DNSSEC_ALGORITHM"`
+		DnssecZSKLife     int      `long:"dnssec-zsk-lifetime" description:"Days to use a zone signing key for before rolling it over" default:"30" env:"DISCODNS_DNSSEC_ZSK_LIFETIME"`
+		DnssecKSKLife     int      `long:"dnssec-ksk-lifetime" description:"Days to use a key signing key for before rolling it over" default:"365" env:"DISCODNS_DNSSEC_KSK_LIFETIME"`
+		DnssecDSDelay     int      `long:"dnssec-ds-delay" description:"Hours to allow for the parent zone to publish the DS record of a new key signing key, before the old key is removed" default:"48" env:"DISCODNS_DNSSEC_DS_DELAY"`
+		EdnsSize          uint16   `long:"edns-udp-size" description:"Largest UDP response to send to clients that support EDNS0" default:"1232" env:"DISCODNS_EDNS_UDP_SIZE"`
+		AliasUpstream     string   `long:"alias-upstream" description:"Nameserver (host[:port]) to look up the targets of ALIAS records with, when they aren't in a zone served here" env:"DISCODNS_ALIAS_UPSTREAM"`
+		NotifyKey         string   `long:"notify-key" description:"Name of the TSIG key to sign NOTIFY messages with" env:"DISCODNS_NOTIFY_KEY"`
+		Views             []string `long:"view" description:"Answer clients from some networks (or using some TSIG keys) with the records beneath a prefix in etcd, as prefix:network|key[,network|key...]" env:"DISCODNS_VIEWS"`
 	}
 )
 
@@ -46,10 +74,25 @@ func main() {
 		debugMsg("Debug mode enabled")
 	}
 
-	// Create an ETCD client
-	etcd := etcd.NewClient(options.EtcdHosts)
-	if !etcd.SyncCluster() {
-		logger.Printf("[WARNING] Failed to connect to etcd cluster at launch time")
+	// Create the record stores for each backend in use
+	routes := parseRoutes(options.Routes)
+	if len(routes) == 0 {
+		routes = []*Route{{Zone: ".", Backends: []string{options.Backend}}}
+	}
+	backends := make(map[string]RecordStore)
+	for _, route := range routes {
+		for _, name := range route.Backends {
+			if _, ok := backends[name]; !ok {
+				backends[name] = createBackend(name)
+			}
+		}
+	}
+
+	var store RecordStore
+	if len(routes) == 1 && routes[0].Zone == "." && len(routes[0].Backends) == 1 {
+		store = backends[routes[0].Backends[0]]
+	} else if store, err = NewRoutingStore(routes, backends); err != nil {
+		logger.Fatal("Failed to set up routes: ", err.Error())
 	}
 
 	// Register the metrics writer
@@ -80,24 +123,77 @@ func main() {
 		logger.Printf("Metric logging disabled")
 	}
 
+	tsigKeys := parseTsigKeys(options.TsigKeys)
+	var notifyKey *TsigKey
+	if len(options.NotifyKey) > 0 {
+		var ok bool
+		if notifyKey, ok = tsigKeys[dns.Fqdn(strings.ToLower(options.NotifyKey))]; !ok {
+			logger.Fatal("Unknown TSIG key for notifications: ", options.NotifyKey)
+		}
+	}
+	if options.TsigAllowUnsigned && len(tsigKeys) == 0 {
+		logger.Fatal("Unsigned requests are always allowed without any TSIG keys")
+	}
+
+	var signer *Signer
+	if len(options.DnssecKeyDir) > 0 || len(options.DnssecKeyPrefix) > 0 {
+		validity := time.Duration(options.DnssecValidity) * time.Hour
+		if signer, err = NewSigner(store, options.DnssecKeyDir, options.DnssecKeyPrefix, validity, options.DnssecCacheSize); err != nil {
+			logger.Fatal("Failed to load DNSSEC keys: ", err.Error())
+		}
+		go signer.Run(time.Minute, nil)
+	}
+	if len(options.DnssecManage) > 0 {
+		if len(options.DnssecKeyPrefix) == 0 {
+			logger.Fatal("DNSSEC keys can only be managed when they're stored in etcd, with --dnssec-key-prefix")
+		}
+		algorithm := dns.StringToAlgorithm[strings.ToUpper(options.DnssecAlgorithm)]
+		if _, supported := keyBits[algorithm]; !supported {
+			logger.Fatal("Unsupported DNSSEC key algorithm: ", options.DnssecAlgorithm)
+		}
+		manager := NewKeyManager(&Resolver{store: store, defaultTTL: options.DefaultTTL}, signer, options.DnssecManage, algorithm,
+			time.Duration(options.DnssecZSKLife)*24*time.Hour,
+			time.Duration(options.DnssecKSKLife)*24*time.Hour,
+			time.Duration(options.DnssecDSDelay)*time.Hour)
+		go manager.Run(time.Minute, nil)
+	}
+
 	// Start up the DNS resolver server
 	server := &server{
 		addr:       options.ListenAddress,
 		port:       options.ListenPort,
-		etcd:       etcd,
+		store:      store,
 		rTimeout:   time.Duration(5) * time.Second,
 		wTimeout:   time.Duration(5) * time.Second,
 		defaultTTL: options.DefaultTTL,
 		queryFilterer: &QueryFilterer{
 			acceptFilters: parseFilters(options.Accept),
 			rejectFilters: parseFilters(options.Reject)},
+		transferAllow: parseNetworks(options.TransferAllow),
+		updateAllow:   parseNetworks(options.UpdateAllow),
+		tsigKeys:      tsigKeys,
+		allowUnsigned: options.TsigAllowUnsigned,
+		journalSize:   options.JournalSize,
+		notifyTargets: options.Notify,
+		notifyNS:      options.NotifyNS,
+		notifyDelay:   time.Duration(options.NotifyDelay) * time.Second,
+		notifyKey:     notifyKey,
+		signer:        signer,
+		ednsSize:      options.EdnsSize,
+		views:         parseViews(options.Views, tsigKeys),
+	}
+	if options.EdnsSize < dns.MinMsgSize {
+		logger.Fatalf("The EDNS0 UDP size can't be less than %d bytes", dns.MinMsgSize)
+	}
+	if len(options.AliasUpstream) > 0 {
+		server.aliasUpstream = withDefaultPort(options.AliasUpstream)
 	}
 
 	server.Run()
 
 	logger.Printf("Listening on %s:%d\n", options.ListenAddress, options.ListenPort)
 
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
 
 forever:
@@ -110,6 +206,40 @@ forever:
 	}
 }
 
+// createBackend creates the record store for a named backend
+func createBackend(name string) (store RecordStore) {
+	switch name {
+	case "zonefile":
+		// Create a record store from the zone files
+		zoneFileStore, err := NewZoneFileStore(parseZoneFiles(options.ZoneFiles))
+		if err != nil {
+			logger.Fatal("Failed to load zone files: ", err.Error())
+		}
+		go zoneFileStore.Run(time.Duration(options.ZoneFileInterval)*time.Second, nil)
+		store = zoneFileStore
+	case "etcd":
+		// Create an ETCD backed record store
+		if options.EtcdAPI == "v3" {
+			store = NewEtcdV3Store(options.EtcdHosts)
+		} else {
+			etcdStore := NewEtcdStore(options.EtcdHosts)
+			if !etcdStore.SyncCluster() {
+				logger.Printf("[WARNING] Failed to connect to etcd cluster at launch time")
+			}
+			store = etcdStore
+		}
+
+		if options.EtcdCache {
+			cache := NewCachedStore(store, "/", time.Duration(options.EtcdCacheStale)*time.Second)
+			go cache.Run(nil)
+			store = cache
+		}
+	default:
+		logger.Fatalf("Unknown backend '%s', expected etcd or zonefile", name)
+	}
+	return
+}
+
 func debugMsg(v ...interface{}) {
 	if logDebug {
 		vars := []interface{}{"[", runtime.NumGoroutine(), "]"}
@@ -148,6 +278,166 @@ func parseFilters(filters []string) []QueryFilter {
 	return parsedFilters
 }
 
+// parseNetworks converts a list of networks in CIDR notation (or single IP
+// addresses) into net.IPNet structures.
+func parseNetworks(networks []string) []*net.IPNet {
+	var parsedNetworks []*net.IPNet
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			logger.Fatal("Failed to parse network: ", err.Error())
+		}
+
+		debugMsg("Adding network '" + ipNet.String() + "'")
+		parsedNetworks = append(parsedNetworks, ipNet)
+	}
+
+	return parsedNetworks
+}
+
+// parseTsigKeys converts a list of strings in the format
+// name:algorithm:secret[:zone,zone...] into TsigKey structures, indexed by the
+// fully qualified key name. For example...
+//
+// - "transfer:hmac-sha256:c2VjcmV0" # Key usable for any zone
+// - "acme:hmac-sha256:c2VjcmV0:disco.net,disco.org" # Only for these zones
+func parseTsigKeys(keys []string) map[string]*TsigKey {
+	parsedKeys := make(map[string]*TsigKey)
+	for _, key := range keys {
+		components := strings.Split(key, ":")
+		if len(components) < 3 || len(components) > 4 {
+			logger.Fatal("Failed to parse TSIG key, expected name:algorithm:secret[:zone,zone...]")
+		}
+
+		algorithm, ok := tsigAlgorithms[strings.TrimSuffix(strings.ToLower(components[1]), ".")]
+		if !ok {
+			logger.Fatal("Unknown TSIG algorithm: ", components[1])
+		}
+		if _, err := base64.StdEncoding.DecodeString(components[2]); err != nil {
+			logger.Fatal("Failed to parse TSIG secret: ", err.Error())
+		}
+
+		tsigKey := &TsigKey{
+			Name:      dns.Fqdn(strings.ToLower(components[0])),
+			Algorithm: algorithm,
+			Secret:    components[2]}
+		if len(components) == 4 && len(components[3]) > 0 {
+			for _, zone := range strings.Split(components[3], ",") {
+				tsigKey.Zones = append(tsigKey.Zones, dns.Fqdn(zone))
+			}
+		}
+
+		debugMsg("Adding TSIG key '" + tsigKey.Name + "' for zones '" + strings.Join(tsigKey.Zones, ",") + "'")
+		parsedKeys[tsigKey.Name] = tsigKey
+	}
+
+	return parsedKeys
+}
+
+// parseViews converts a list of strings in the format
+// prefix:network|key[,network|key...] into View structures, in the order given.
+// Each client is answered from the first view it matches. For example...
+//
+// - "/views/internal:10.0.0.0/8,192.168.0.0/16" # Clients on internal networks
+// - "/views/partner:partner" # Clients signing queries with the partner key
+func parseViews(views []string, tsigKeys map[string]*TsigKey) []*View {
+	var parsedViews []*View
+	for _, view := range views {
+		components := strings.SplitN(view, ":", 2)
+		if len(components) != 2 || len(components[0]) == 0 || len(components[1]) == 0 {
+			logger.Fatal("Failed to parse view, expected prefix:network|key[,network|key...]")
+		}
+
+		parsedView := &View{Prefix: cleanKey(components[0])}
+		for _, match := range strings.Split(components[1], ",") {
+			if strings.Contains(match, "/") || net.ParseIP(match) != nil {
+				parsedView.Networks = append(parsedView.Networks, parseNetworks([]string{match})...)
+			} else if _, ok := tsigKeys[dns.Fqdn(strings.ToLower(match))]; ok {
+				parsedView.Keys = append(parsedView.Keys, dns.Fqdn(strings.ToLower(match)))
+			} else {
+				logger.Fatal("Unknown TSIG key for view: ", match)
+			}
+		}
+
+		debugMsg("Adding view '" + parsedView.Prefix + "'")
+		parsedViews = append(parsedViews, parsedView)
+	}
+
+	return parsedViews
+}
+
+// parseZoneFiles converts a list of strings in the format [origin:]path into
+// ZoneFile structures. Without an origin, the zone file itself must contain
+// an $ORIGIN directive or use fully qualified names.
+func parseZoneFiles(files []string) []ZoneFile {
+	var zoneFiles []ZoneFile
+	for _, file := range files {
+		// Paths can contain colons too, so anything before the first colon
+		// is only taken as the origin if it looks like a domain name with a
+		// dot in it (so that C:\zones\db is still a path)
+		zoneFile := ZoneFile{Origin: ".", Path: file}
+		if components := strings.SplitN(file, ":", 2); len(components) == 2 && isOrigin(components[0]) {
+			zoneFile = ZoneFile{Origin: dns.Fqdn(components[0]), Path: components[1]}
+		}
+
+		debugMsg("Adding zone file '" + zoneFile.Path + "' with origin '" + zoneFile.Origin + "'")
+		zoneFiles = append(zoneFiles, zoneFile)
+	}
+
+	return zoneFiles
+}
+
+// isOrigin returns true if the string can be the origin of a zone file, rather
+// than part of its path. Origins need at least one dot, so a name with a
+// single label has to be written fully qualified (localhost.).
+func isOrigin(origin string) bool {
+	if !strings.Contains(origin, ".") || strings.ContainsAny(origin, "/\\ ") {
+		return false
+	}
+	_, ok := dns.IsDomainName(origin)
+	return ok
+}
+
+// parseRoutes converts a list of strings in the format
+// [zone]:backend[,backend...][:merge] into Route structures. For example...
+//
+// - "corp.example:etcd" # Serve corp.example from etcd
+// - "lab.example:etcd,zonefile" # Prefer etcd, falling back to the zone files
+// - "lab.example:etcd,zonefile:merge" # Combine records from both
+// - ":zonefile" # Serve everything else from the zone files
+func parseRoutes(routes []string) []*Route {
+	var parsedRoutes []*Route
+	for _, route := range routes {
+		components := strings.Split(route, ":")
+		if len(components) < 2 || len(components) > 3 {
+			logger.Printf("Expected zone:backend[,backend...][:merge]")
+			continue
+		}
+
+		merge := len(components) == 3 && components[2] == "merge"
+		if len(components) == 3 && !merge {
+			logger.Printf("Unknown route precedence '%s', expected merge", components[2])
+			continue
+		}
+
+		zone := dns.Fqdn(components[0])
+		backends := strings.Split(components[1], ",")
+
+		debugMsg("Adding route for zone '" + zone + "' to backends '" + strings.Join(backends, ",") + "'")
+		parsedRoutes = append(parsedRoutes, &Route{Zone: zone, Backends: backends, Merge: merge})
+	}
+
+	return parsedRoutes
+}
+
 func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+)
+
+// Number of events the MemoryStore remembers, for watchers that ask for
+// changes from an index in the past. This matches the size of etcd's own
+// event history.
+const memoryStoreHistorySize = 1000
+
+// MemoryStore is a RecordStore that holds all keys in memory, laid out in the
+// same way as etcd. It's useful for tests and for embedding discodns with a
+// seeded set of records.
+type MemoryStore struct {
+	sync.RWMutex
+	root    *Node
+	index   uint64
+	history []*StoreEvent
+	cleared uint64
+	changed chan struct{}
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		root:    &Node{Key: "/", Dir: true},
+		changed: make(chan struct{})}
+}
+
+// Set stores the value at the given key, creating any parent directories
+func (s *MemoryStore) Set(key string, value string) error {
+	key = cleanKey(key)
+	s.Lock()
+	defer s.Unlock()
+	return s.set(key, value, "set")
+}
+
+// Create implements WritableRecordStore
+func (s *MemoryStore) Create(key string, value string) error {
+	key = cleanKey(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if s.root.find(key) != nil {
+		return &CompareFailedError{Key: key}
+	}
+	return s.set(key, value, "create")
+}
+
+// CompareAndSwap implements WritableRecordStore
+func (s *MemoryStore) CompareAndSwap(key string, value string, prevIndex uint64) error {
+	key = cleanKey(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if existing := s.root.find(key); existing == nil {
+		return &KeyNotFoundError{Key: key}
+	} else if existing.ModifiedIndex != prevIndex {
+		return &CompareFailedError{Key: key}
+	}
+	return s.set(key, value, "compareAndSwap")
+}
+
+// CompareAndDelete implements WritableRecordStore
+func (s *MemoryStore) CompareAndDelete(key string, prevIndex uint64) error {
+	key = cleanKey(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if existing := s.root.find(key); existing == nil {
+		return &KeyNotFoundError{Key: key}
+	} else if existing.Dir {
+		return fmt.Errorf("Not a file: %s", key)
+	} else if existing.ModifiedIndex != prevIndex {
+		return &CompareFailedError{Key: key}
+	}
+	return s.delete(key, "compareAndDelete")
+}
+
+// Delete removes the given key, and everything beneath it if it's a directory
+func (s *MemoryStore) Delete(key string) error {
+	key = cleanKey(key)
+	s.Lock()
+	defer s.Unlock()
+	return s.delete(key, "delete")
+}
+
+// Replace makes the store hold exactly the given keys and values, as a single
+// change that readers either see all or none of. Keys that aren't given are
+// deleted (along with any directories left empty) and keys whose values are
+// unchanged are left alone, so watchers only see the keys that really changed.
+func (s *MemoryStore) Replace(values map[string]string) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, leaf := range s.root.Leaves() {
+		if value, ok := values[leaf.Key]; !ok {
+			s.delete(leaf.Key, "delete")
+			for dir := path.Dir(leaf.Key); dir != "/"; dir = path.Dir(dir) {
+				if node := s.root.find(dir); node == nil || len(node.Nodes) > 0 {
+					break
+				}
+				s.delete(dir, "delete")
+			}
+		} else if value == leaf.Value {
+			delete(values, leaf.Key)
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := s.set(cleanKey(key), values[key], "set"); err != nil {
+			logger.Printf("[WARNING] Unable to store %s: %s", key, err)
+		}
+	}
+}
+
+// Snapshot implements SnapshotRecordStore
+func (s *MemoryStore) Snapshot(key string) (*Node, uint64, error) {
+	key = cleanKey(key)
+	s.RLock()
+	defer s.RUnlock()
+
+	node := s.root.find(key)
+	if node == nil {
+		return nil, s.index, &KeyNotFoundError{Key: key}
+	}
+	return node.copy(), s.index, nil
+}
+
+// Get implements RecordStore
+func (s *MemoryStore) Get(key string) (*Node, error) {
+	key = cleanKey(key)
+	s.RLock()
+	defer s.RUnlock()
+
+	node := s.root.find(key)
+	if node == nil {
+		return nil, &KeyNotFoundError{Key: key}
+	}
+	return node.copy(), nil
+}
+
+// Watch implements RecordStore
+func (s *MemoryStore) Watch(key string, waitIndex uint64, events chan *StoreEvent, stop chan bool) error {
+	defer close(events)
+	key = cleanKey(key)
+
+	s.RLock()
+	if waitIndex == 0 {
+		waitIndex = s.index + 1
+	}
+	s.RUnlock()
+
+	for {
+		s.RLock()
+		if waitIndex <= s.cleared {
+			s.RUnlock()
+			return &IndexClearedError{Key: key, Index: waitIndex}
+		}
+		changed := s.changed
+		var pending []*StoreEvent
+		for _, event := range s.history {
+			if event.Node.ModifiedIndex >= waitIndex && keyWithin(event.Node.Key, key) {
+				pending = append(pending, event)
+			}
+		}
+		s.RUnlock()
+
+		for _, event := range pending {
+			select {
+			case events <- event:
+				waitIndex = event.Node.ModifiedIndex + 1
+			case <-stop:
+				return nil
+			}
+		}
+
+		if len(pending) == 0 {
+			select {
+			case <-changed:
+			case <-stop:
+				return nil
+			}
+		}
+	}
+}
+
+// set stores the value at the key, recording the change as the given action.
+// The caller must hold the write lock.
+func (s *MemoryStore) set(key string, value string, action string) error {
+	if existing := s.root.find(key); existing != nil && existing.Dir {
+		return fmt.Errorf("Not a file: %s", key)
+	}
+	node := &Node{Key: key, Value: value, ModifiedIndex: s.index + 1}
+	prevNode, err := s.root.insert(node)
+	if err != nil {
+		return err
+	}
+	s.index++
+
+	s.record(&StoreEvent{Action: action, Node: node.copy(), PrevNode: prevNode})
+	return nil
+}
+
+// delete removes the key, recording the change as the given action. The
+// caller must hold the write lock.
+func (s *MemoryStore) delete(key string, action string) error {
+	var prevNode *Node
+	if key == "/" {
+		prevNode, s.root = s.root, &Node{Key: "/", Dir: true}
+	} else if prevNode = s.root.remove(key); prevNode == nil {
+		return &KeyNotFoundError{Key: key}
+	}
+	s.index++
+
+	node := &Node{Key: key, Dir: prevNode.Dir, ModifiedIndex: s.index}
+	s.record(&StoreEvent{Action: action, Node: node, PrevNode: prevNode})
+	return nil
+}
+
+// record adds an event to the history and wakes up any watchers. The caller
+// must hold the write lock.
+func (s *MemoryStore) record(event *StoreEvent) {
+	s.history = append(s.history, event)
+	if len(s.history) > memoryStoreHistorySize {
+		dropped := s.history[len(s.history)-memoryStoreHistorySize-1]
+		s.cleared = dropped.Node.ModifiedIndex
+		s.history = s.history[len(s.history)-memoryStoreHistorySize:]
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
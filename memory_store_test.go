@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreGetSingleKey(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	memoryStore.Set("net/disco/.A", "1.1.1.1")
+
+	node, err := memoryStore.Get("/net/disco/.A")
+	if err != nil {
+		t.Fatal("Error returned from store", err)
+	}
+	if node.Dir {
+		t.Fatal("Expected a file node")
+	}
+	if node.Key != "/net/disco/.A" {
+		t.Fatal("Expected key /net/disco/.A: ", node.Key)
+	}
+	if node.Value != "1.1.1.1" {
+		t.Fatal("Node value should be 1.1.1.1: ", node.Value)
+	}
+}
+
+func TestMemoryStoreGetDirectorySorted(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	memoryStore.Set("/net/disco/.A/1", "1.1.1.2")
+	memoryStore.Set("/net/disco/.A/0.ttl", "60")
+	memoryStore.Set("/net/disco/.A/0", "1.1.1.1")
+
+	node, err := memoryStore.Get("/net/disco/.A")
+	if err != nil {
+		t.Fatal("Error returned from store", err)
+	}
+	if !node.Dir {
+		t.Fatal("Expected a directory node")
+	}
+
+	expected := []string{"/net/disco/.A/0", "/net/disco/.A/0.ttl", "/net/disco/.A/1"}
+	if len(node.Nodes) != len(expected) {
+		t.Fatal("Expected 3 child nodes, got ", len(node.Nodes))
+	}
+	for i, key := range expected {
+		if node.Nodes[i].Key != key {
+			t.Fatal("Expected child ", i, " to be ", key, ": ", node.Nodes[i].Key)
+		}
+	}
+}
+
+func TestMemoryStoreGetMissingKey(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	memoryStore.Set("/net/disco/.A", "1.1.1.1")
+
+	_, err := memoryStore.Get("/net/disco/.AAAA")
+	if _, ok := err.(*KeyNotFoundError); !ok {
+		t.Fatal("Expected a KeyNotFoundError, got ", err)
+	}
+}
+
+func TestMemoryStoreSetFileOverDirectory(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	memoryStore.Set("/net/disco/.A/0", "1.1.1.1")
+
+	if err := memoryStore.Set("/net/disco/.A", "1.1.1.1"); err == nil {
+		t.Fatal("Expected an error setting a value on a directory")
+	}
+	if err := memoryStore.Set("/net/disco/.A/0/1", "1.1.1.1"); err == nil {
+		t.Fatal("Expected an error setting a value beneath a file")
+	}
+}
+
+func TestMemoryStoreDelete(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	memoryStore.Set("/net/disco/.A/0", "1.1.1.1")
+	memoryStore.Set("/net/disco/.A/1", "1.1.1.2")
+
+	if err := memoryStore.Delete("/net/disco/.A"); err != nil {
+		t.Fatal("Error returned from store", err)
+	}
+	if _, err := memoryStore.Get("/net/disco/.A/0"); err == nil {
+		t.Fatal("Expected the key to have been deleted")
+	}
+	if _, ok := memoryStore.Delete("/net/disco/.A").(*KeyNotFoundError); !ok {
+		t.Fatal("Expected a KeyNotFoundError deleting a missing key")
+	}
+}
+
+func TestMemoryStoreConditionalWrites(t *testing.T) {
+	memoryStore := NewMemoryStore()
+
+	if err := memoryStore.Create("/net/disco/.A/0", "1.1.1.1"); err != nil {
+		t.Fatal("Error returned from store", err)
+	}
+	if _, ok := memoryStore.Create("/net/disco/.A/0", "1.1.1.2").(*CompareFailedError); !ok {
+		t.Fatal("Expected a CompareFailedError creating an existing key")
+	}
+
+	node, _ := memoryStore.Get("/net/disco/.A/0")
+	if _, ok := memoryStore.CompareAndSwap("/net/disco/.A/0", "1.1.1.2", node.ModifiedIndex+1).(*CompareFailedError); !ok {
+		t.Fatal("Expected a CompareFailedError swapping with the wrong index")
+	}
+	if err := memoryStore.CompareAndSwap("/net/disco/.A/0", "1.1.1.2", node.ModifiedIndex); err != nil {
+		t.Fatal("Error returned from store", err)
+	}
+
+	if _, ok := memoryStore.CompareAndDelete("/net/disco/.A/0", node.ModifiedIndex).(*CompareFailedError); !ok {
+		t.Fatal("Expected a CompareFailedError deleting a modified key")
+	}
+	node, _ = memoryStore.Get("/net/disco/.A/0")
+	if node.Value != "1.1.1.2" {
+		t.Fatal("Expected the value to have been swapped: ", node.Value)
+	}
+	if err := memoryStore.CompareAndDelete("/net/disco/.A/0", node.ModifiedIndex); err != nil {
+		t.Fatal("Error returned from store", err)
+	}
+	if _, err := memoryStore.Get("/net/disco/.A/0"); err == nil {
+		t.Fatal("Expected the key to have been deleted")
+	}
+}
+
+func TestMemoryStoreWatch(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	memoryStore.Set("/net/disco/.A", "1.1.1.1")
+
+	events := make(chan *StoreEvent)
+	stop := make(chan bool)
+	go memoryStore.Watch("/net/disco", 0, events, stop)
+	defer close(stop)
+
+	// Give the watcher a chance to start before making any changes
+	time.Sleep(10 * time.Millisecond)
+	memoryStore.Set("/com/other/.A", "2.2.2.2")
+	memoryStore.Set("/net/disco/.A", "1.1.1.2")
+	memoryStore.Delete("/net/disco/.A")
+
+	event := <-events
+	if event.Action != "set" || event.Node.Value != "1.1.1.2" {
+		t.Fatal("Expected a set event for 1.1.1.2: ", event.Action, event.Node)
+	}
+	if event.PrevNode == nil || event.PrevNode.Value != "1.1.1.1" {
+		t.Fatal("Expected the previous value to be 1.1.1.1: ", event.PrevNode)
+	}
+
+	event = <-events
+	if event.Action != "delete" || event.Node.Key != "/net/disco/.A" {
+		t.Fatal("Expected a delete event for /net/disco/.A: ", event.Action, event.Node)
+	}
+}
+
+func TestMemoryStoreWatchFromIndex(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	memoryStore.Set("/net/disco/.A", "1.1.1.1")
+	memoryStore.Set("/net/disco/.A", "1.1.1.2")
+
+	events := make(chan *StoreEvent)
+	stop := make(chan bool)
+	go memoryStore.Watch("/net/disco", 1, events, stop)
+	defer close(stop)
+
+	if event := <-events; event.Node.Value != "1.1.1.1" {
+		t.Fatal("Expected first event to be for 1.1.1.1: ", event.Node)
+	}
+	if event := <-events; event.Node.Value != "1.1.1.2" {
+		t.Fatal("Expected second event to be for 1.1.1.2: ", event.Node)
+	}
+}
+
+func TestMemoryStoreWatchCleared(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	for i := 0; i < memoryStoreHistorySize+10; i++ {
+		memoryStore.Set("/net/disco/.A", fmt.Sprintf("1.1.1.%d", i%256))
+	}
+
+	// The first events have fallen out of the history
+	events := make(chan *StoreEvent, memoryStoreHistorySize)
+	err := memoryStore.Watch("/net/disco", 5, events, make(chan bool))
+	if _, ok := err.(*IndexClearedError); !ok {
+		t.Fatal("Expected the index to have been cleared, got ", err)
+	}
+
+	// Watching from the oldest event still in the history works
+	events = make(chan *StoreEvent)
+	stop := make(chan bool)
+	go memoryStore.Watch("/net/disco", 11, events, stop)
+	defer close(stop)
+	if event := <-events; event.Node.ModifiedIndex != 11 {
+		t.Fatal("Expected the oldest event in the history, got ", event.Node)
+	}
+}
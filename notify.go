@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	// How long to wait before restarting the notifier's watch after it fails
+	notifyWatchRetryInterval = time.Second
+	// How many times to retry sending a NOTIFY that wasn't answered, and how
+	// long to wait before the first retry (doubling each time)
+	notifyRetries       = 3
+	notifyRetryInterval = 2 * time.Second
+	// How many times the delay a zone that keeps changing can put off its
+	// NOTIFY for
+	notifyMaxDelays = 4
+)
+
+// Notifier sends DNS NOTIFY messages (RFC 1996) to secondary nameservers when
+// the records in a zone change, so that they don't have to wait for the SOA
+// refresh interval before transferring it again.
+//
+// The store is watched for changes, and each change is attributed to the
+// zone it falls within. The secondaries are notified once a zone has gone
+// without changes for a short delay, so that a batch of updates to a zone only
+// results in a single NOTIFY. A zone that never settles is still notified
+// after a few delays.
+type Notifier struct {
+	sync.Mutex
+	resolver *Resolver
+	targets  []string
+	notifyNS bool
+	delay    time.Duration
+	key      *TsigKey
+	client   *dns.Client
+	pending  map[string]*pendingNotify
+}
+
+// pendingNotify is a NOTIFY waiting for changes to a zone to settle
+type pendingNotify struct {
+	due      time.Time
+	deadline time.Time
+}
+
+// NewNotifier creates a Notifier sending to the given addresses (host or
+// host:port) and, if notifyNS is set, to the nameservers listed in the NS
+// records of each zone. If a key is given, notifications for the zones it can
+// be used for are signed with it.
+func NewNotifier(resolver *Resolver, targets []string, notifyNS bool, delay time.Duration, key *TsigKey) *Notifier {
+	addrs := make([]string, len(targets))
+	for i, target := range targets {
+		addrs[i] = withDefaultPort(target)
+	}
+	client := &dns.Client{Net: "udp", Timeout: 2 * time.Second}
+	if key != nil {
+		client.TsigSecret = map[string]string{key.Name: key.Secret}
+	}
+	return &Notifier{
+		resolver: resolver,
+		targets:  addrs,
+		notifyNS: notifyNS,
+		delay:    delay,
+		key:      key,
+		client:   client,
+		pending:  make(map[string]*pendingNotify)}
+}
+
+// Run watches the store for changes, blocking until the stop channel is
+// closed.
+func (n *Notifier) Run(stop chan bool) {
+	for {
+		err := n.watch(stop)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		logger.Printf("[WARNING] Lost watch for zone notifications: %s", err)
+
+		select {
+		case <-time.After(notifyWatchRetryInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// watch handles changes from a watch on the store until it fails or is stopped
+func (n *Notifier) watch(stop chan bool) error {
+	events := make(chan *StoreEvent)
+	done := make(chan error, 1)
+	go func() {
+		done <- n.resolver.store.Watch(cleanKey(n.resolver.etcdPrefix), 0, events, stop)
+	}()
+
+	for event := range events {
+		if isSerialKey(event.Node.Key) {
+			continue
+		}
+		if zone := n.resolver.zoneForEvent(event); zone != "" {
+			// Make sure the serial sent includes the change
+			n.resolver.observeSerial(zone, event)
+			n.schedule(zone)
+		}
+	}
+	return <-done
+}
+
+// schedule arranges for the secondaries of the zone to be notified once the
+// delay has passed without any more changes to it. If a notification is
+// already waiting, it's put off until then, but never for longer than a few
+// delays since the first change.
+func (n *Notifier) schedule(zone string) {
+	n.Lock()
+	defer n.Unlock()
+	now := time.Now()
+	if pending, ok := n.pending[zone]; ok {
+		pending.due = now.Add(n.delay)
+		if pending.due.After(pending.deadline) {
+			pending.due = pending.deadline
+		}
+		return
+	}
+	n.pending[zone] = &pendingNotify{due: now.Add(n.delay), deadline: now.Add(notifyMaxDelays * n.delay)}
+	debugMsg("Zone ", zone, " changed, notifying secondaries in ", n.delay)
+
+	var fire func()
+	fire = func() {
+		n.Lock()
+		if wait := n.pending[zone].due.Sub(time.Now()); wait > 0 {
+			time.AfterFunc(wait, fire)
+			n.Unlock()
+			return
+		}
+		delete(n.pending, zone)
+		n.Unlock()
+		n.Notify(zone)
+	}
+	time.AfterFunc(n.delay, fire)
+}
+
+// Notify sends a NOTIFY for the zone to each of its secondaries
+func (n *Notifier) Notify(zone string) {
+	soa := n.resolver.Authority(zone)
+	if soa == nil || soa.Hdr.Name != zone {
+		return
+	}
+	for _, target := range n.targetsFor(zone, soa) {
+		go n.send(zone, soa, target)
+	}
+}
+
+// send sends a NOTIFY to a single secondary, retrying until it is answered
+func (n *Notifier) send(zone string, soa *dns.SOA, target string) {
+	sentCounter := metrics.GetOrRegisterCounter("notify.sent", metrics.DefaultRegistry)
+	retryCounter := metrics.GetOrRegisterCounter("notify.retries", metrics.DefaultRegistry)
+	failedCounter := metrics.GetOrRegisterCounter("notify.failed", metrics.DefaultRegistry)
+
+	msg := new(dns.Msg)
+	msg.SetNotify(zone)
+	msg.Answer = []dns.RR{soa}
+	if n.key != nil && n.key.allows(zone) {
+		n.key.sign(msg)
+	}
+
+	interval := notifyRetryInterval
+	for attempt := 0; ; attempt++ {
+		sentCounter.Inc(1)
+		response, _, err := n.client.Exchange(msg, target)
+		if err == nil && response.Rcode == dns.RcodeSuccess {
+			debugMsg("Notified ", target, " of serial ", soa.Serial, " for zone ", zone)
+			return
+		} else if err == nil {
+			err = fmt.Errorf("NOTIFY answered with %s", dns.RcodeToString[response.Rcode])
+		}
+
+		if attempt >= notifyRetries {
+			failedCounter.Inc(1)
+			logger.Printf("[WARNING] Failed to notify %s of changes to zone %s: %s", target, zone, err)
+			return
+		}
+		retryCounter.Inc(1)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// targetsFor returns the addresses to notify of changes to a zone. As well as
+// the configured targets this includes the nameservers in the zone's NS
+// records (if enabled), apart from the primary named in the SOA.
+func (n *Notifier) targetsFor(zone string, soa *dns.SOA) (targets []string) {
+	seen := make(map[string]bool)
+	add := func(addr string) {
+		if !seen[addr] {
+			seen[addr] = true
+			targets = append(targets, addr)
+		}
+	}
+	for _, target := range n.targets {
+		add(target)
+	}
+	if !n.notifyNS {
+		return
+	}
+
+	nameservers, err := n.resolver.LookupAnswersForType(zone, dns.TypeNS)
+	if err != nil {
+		debugMsg("Unable to find nameservers for zone ", zone, ": ", err)
+		return
+	}
+	for _, rr := range nameservers {
+		ns := strings.ToLower(rr.(*dns.NS).Ns)
+		if ns == strings.ToLower(soa.Ns) {
+			continue
+		}
+		for _, ip := range n.lookupHost(ns) {
+			add(net.JoinHostPort(ip, "53"))
+		}
+	}
+	return
+}
+
+// lookupHost returns the IP addresses of a nameserver, looking in the store
+// first and falling back to the system resolver.
+func (n *Notifier) lookupHost(name string) (ips []string) {
+	for _, rrType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answers, _ := n.resolver.LookupAnswersForType(name, rrType)
+		for _, rr := range answers {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A.String())
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA.String())
+			}
+		}
+	}
+	if len(ips) == 0 {
+		var err error
+		if ips, err = net.LookupHost(strings.TrimSuffix(name, ".")); err != nil {
+			debugMsg("Unable to resolve nameserver ", name, ": ", err)
+		}
+	}
+	return
+}
+
+// withDefaultPort adds the DNS port to an address that doesn't have one
+func withDefaultPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+	return addr
+}
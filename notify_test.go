@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestSecondary starts a nameserver on a random local port that passes any
+// NOTIFY messages it receives to the returned channel.
+func newTestSecondary(t *testing.T) (string, chan *dns.Msg, func()) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unable to listen: ", err)
+	}
+
+	notifies := make(chan *dns.Msg, 10)
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.Opcode == dns.OpcodeNotify {
+			notifies <- req
+		}
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		w.WriteMsg(msg)
+	})
+
+	started := make(chan bool)
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	return conn.LocalAddr().String(), notifies, func() { server.Shutdown() }
+}
+
+func TestNotifyOnChange(t *testing.T) {
+	addr, notifies, shutdown := newTestSecondary(t)
+	defer shutdown()
+
+	notifyStore := NewMemoryStore()
+	notifyStore.Set("/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+
+	resolver := &Resolver{store: notifyStore}
+	resolver.serials = NewZoneSerials(resolver)
+	notifier := NewNotifier(resolver, []string{addr}, false, 50*time.Millisecond, nil)
+	stop := make(chan bool)
+	defer close(stop)
+	go notifier.Run(stop)
+	time.Sleep(10 * time.Millisecond)
+
+	// Both changes should be sent in a single NOTIFY
+	notifyStore.Set("/net/disco/www/.A/0", "1.1.1.1")
+	notifyStore.Set("/net/disco/www/.A/1", "1.1.1.2")
+
+	select {
+	case msg := <-notifies:
+		if msg.Question[0].Name != "disco.net." || msg.Question[0].Qtype != dns.TypeSOA {
+			t.Fatal("Expected NOTIFY for the SOA of disco.net.: ", msg.Question[0])
+		}
+		if len(msg.Answer) != 1 || msg.Answer[0].(*dns.SOA).Serial != 3 {
+			t.Fatal("Expected NOTIFY to include the SOA with serial 3: ", msg.Answer)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for NOTIFY")
+	}
+
+	select {
+	case msg := <-notifies:
+		t.Fatal("Expected only one NOTIFY: ", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Deletions increase the serial too
+	notifyStore.Delete("/net/disco/www/.A/1")
+	select {
+	case msg := <-notifies:
+		if len(msg.Answer) != 1 || msg.Answer[0].(*dns.SOA).Serial != 4 {
+			t.Fatal("Expected NOTIFY to include the SOA with serial 4: ", msg.Answer)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for NOTIFY")
+	}
+
+	// Keys outside of any zone don't trigger a NOTIFY
+	notifyStore.Set("/net/other/.A", "1.1.1.3")
+	select {
+	case msg := <-notifies:
+		t.Fatal("Unexpected NOTIFY: ", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestNotifySettles(t *testing.T) {
+	addr, notifies, shutdown := newTestSecondary(t)
+	defer shutdown()
+
+	notifyStore := NewMemoryStore()
+	notifyStore.Set("/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+
+	resolver := &Resolver{store: notifyStore}
+	resolver.serials = NewZoneSerials(resolver)
+	notifier := NewNotifier(resolver, []string{addr}, false, 100*time.Millisecond, nil)
+	stop := make(chan bool)
+	defer close(stop)
+	go notifier.Run(stop)
+	time.Sleep(10 * time.Millisecond)
+
+	// A batch of changes spread over longer than the delay is sent once it
+	// has settled
+	for i := 0; i < 4; i++ {
+		notifyStore.Set("/net/disco/www/.TXT", fmt.Sprintf("change %d", i))
+		select {
+		case msg := <-notifies:
+			t.Fatal("Expected no NOTIFY while the zone is changing: ", msg.Answer)
+		case <-time.After(60 * time.Millisecond):
+		}
+	}
+	select {
+	case msg := <-notifies:
+		if serial := msg.Answer[0].(*dns.SOA).Serial; serial != 5 {
+			t.Fatal("Expected NOTIFY to include every change, got serial ", serial)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for NOTIFY")
+	}
+
+	// A zone that never settles is still notified after a few delays
+	deadline := time.After(notifyMaxDelays*100*time.Millisecond + 300*time.Millisecond)
+	for i := 0; ; i++ {
+		notifyStore.Set("/net/disco/www/.TXT", fmt.Sprintf("more %d", i))
+		select {
+		case <-notifies:
+			return
+		case <-deadline:
+			t.Fatal("Timed out waiting for NOTIFY while the zone keeps changing")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+func TestNotifyTargets(t *testing.T) {
+	notifyStore := NewMemoryStore()
+	notifyStore.Set("/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	notifyStore.Set("/net/disco/.NS/0", "ns1.disco.net.")
+	notifyStore.Set("/net/disco/.NS/1", "ns2.disco.net.")
+	notifyStore.Set("/net/disco/.NS/2", "ns3.disco.net.")
+	notifyStore.Set("/net/disco/ns1/.A", "10.0.0.1")
+	notifyStore.Set("/net/disco/ns2/.A", "10.0.0.2")
+	notifyStore.Set("/net/disco/ns3/.AAAA", "fd00::3")
+
+	resolver := &Resolver{store: notifyStore}
+	soa := resolver.Authority("disco.net.")
+	notifier := NewNotifier(resolver, []string{"10.0.0.9", "10.0.0.2:53"}, true, time.Second, nil)
+
+	targets := notifier.targetsFor("disco.net.", soa)
+	sort.Strings(targets)
+	expected := []string{"10.0.0.2:53", "10.0.0.9:53", "[fd00::3]:53"}
+	if len(targets) != len(expected) {
+		t.Fatal("Expected targets ", expected, ": ", targets)
+	}
+	for i := range expected {
+		if targets[i] != expected[i] {
+			t.Fatal("Expected targets ", expected, ": ", targets)
+		}
+	}
+}
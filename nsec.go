@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Maximum length of a single label, and of a whole name, in wire format
+const (
+	maxLabelLength = 63
+	maxNameLength  = 255
+)
+
+// Denial returns the NSEC records proving that the answer to a query for the
+// name in a signed zone is complete. Since the zone can change at any moment,
+// there's no sorted chain of NSEC records to draw from. Instead each record is
+// made up as it's needed, covering only the names either side of the one that
+// doesn't exist ("white lies", as described in RFC 4470), so that resolvers
+// can't use it to deny the existence of any other name.
+//
+// For a query with answers, only answers from a wildcard need proof, that the
+// name itself doesn't exist. When there are no answers, either the name exists
+// without any records of the type asked for, or it doesn't exist and neither
+// does a wildcard that could have matched it.
+func (r *Resolver) Denial(zone string, name string, wildcard string, empty bool) (records []dns.RR, err error) {
+	name = strings.ToLower(name)
+	if !empty && wildcard == "" {
+		return
+	}
+	soa := r.Authority(zone)
+	if soa == nil {
+		return
+	}
+	ttl := negativeTTL(soa)
+
+	if !empty {
+		ce := strings.TrimPrefix(strings.ToLower(wildcard), "*.")
+		return []dns.RR{coveringNSEC(nextCloser(name, ce), ttl)}, nil
+	}
+
+	types, exists, err := r.nameTypes(name)
+	if err != nil {
+		return nil, err
+	} else if exists {
+		return []dns.RR{r.matchingNSEC(zone, name, types, ttl)}, nil
+	}
+
+	ce, err := r.closestEncloser(name, zone)
+	if err != nil {
+		return nil, err
+	}
+	records = append(records, coveringNSEC(nextCloser(name, ce), ttl))
+
+	// The wildcard at the closest encloser might exist, without any records of
+	// the type asked for
+	source := "*." + ce
+	if ce == "." {
+		source = "*."
+	}
+	if types, exists, err = r.nameTypes(source); err != nil {
+		return nil, err
+	} else if exists {
+		records = append(records, r.matchingNSEC(zone, source, types, ttl))
+	} else {
+		records = append(records, coveringNSEC(source, ttl))
+	}
+	return
+}
+
+// negativeTTL returns how long the proof that a record doesn't exist can be
+// cached for, the lower of the SOA record's TTL and its minimum TTL (RFC 2308)
+func negativeTTL(soa *dns.SOA) uint32 {
+	if soa.Hdr.Ttl < soa.Minttl {
+		return soa.Hdr.Ttl
+	}
+	return soa.Minttl
+}
+
+// nameTypes returns the types of the records held for a name, and whether the
+// name exists at all. A name without any records exists if there are records
+// beneath it (an empty non-terminal). Directories without any records in them,
+// which etcd keeps once the records they held have been deleted, don't count.
+func (r *Resolver) nameTypes(name string) (types []uint16, exists bool, err error) {
+	node, err := r.store.Get(r.etcdPrefix + nameToKey(name, ""))
+	if err != nil {
+		if _, ok := err.(*KeyNotFoundError); ok {
+			return nil, false, nil
+		}
+		return
+	}
+	if !node.Dir {
+		return nil, false, nil
+	}
+
+	seen := make(map[uint16]bool)
+	for _, child := range node.Nodes {
+		base := path.Base(child.Key)
+		if !strings.HasPrefix(base, ".") || strings.HasSuffix(base, ".ttl") || !hasRecords(child) {
+			continue
+		}
+		// ALIAS records are answered as A and AAAA records
+		if strings.ToUpper(base) == ".ALIAS" {
+			for _, rrType := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				if !seen[rrType] {
+					seen[rrType] = true
+					types = append(types, rrType)
+				}
+			}
+			continue
+		}
+		rrType, ok := dns.StringToType[strings.ToUpper(base[1:])]
+		if _, supported := converters[rrType]; ok && supported && !seen[rrType] {
+			seen[rrType] = true
+			types = append(types, rrType)
+		}
+	}
+	return types, hasRecords(node), nil
+}
+
+// hasRecords returns true if there are any keys beneath the node, other than
+// the saved serial of a zone (see ZoneSerials)
+func hasRecords(node *Node) bool {
+	for _, leaf := range node.Leaves() {
+		if !isSerialKey(leaf.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// closestEncloser returns the closest ancestor of the name within the zone
+// that exists, stopping at the apex of the zone.
+func (r *Resolver) closestEncloser(name string, zone string) (string, error) {
+	zone = strings.ToLower(zone)
+	for i, end := dns.NextLabel(name, 0); !end; i, end = dns.NextLabel(name, i) {
+		ancestor := name[i:]
+		if ancestor == zone || !dns.IsSubDomain(zone, ancestor) {
+			break
+		}
+		if _, exists, err := r.nameTypes(ancestor); err != nil {
+			return "", err
+		} else if exists {
+			return ancestor, nil
+		}
+	}
+	return zone, nil
+}
+
+// matchingNSEC returns an NSEC record for a name that exists, listing the
+// types of the records it holds
+func (r *Resolver) matchingNSEC(zone string, name string, types []uint16, ttl uint32) *dns.NSEC {
+	types = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+	if name == zone && r.signer != nil {
+		for _, rrType := range []uint16{dns.TypeDNSKEY, dns.TypeCDS, dns.TypeCDNSKEY} {
+			if len(r.signer.KeyRecords(zone, rrType)) > 0 {
+				types = append(types, rrType)
+			}
+		}
+	}
+	sort.Sort(rrTypes(types))
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: "\\000." + name,
+		TypeBitMap: types}
+}
+
+// coveringNSEC returns an NSEC record proving that a name (and everything
+// beneath it) doesn't exist, running from the name immediately before it to
+// the name immediately after it.
+func coveringNSEC(name string, ttl uint32) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: predecessor(name), Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: successor(name),
+		TypeBitMap: []uint16{dns.TypeRRSIG, dns.TypeNSEC}}
+}
+
+// nextCloser returns the ancestor of the name that is one label longer than
+// the closest encloser
+func nextCloser(name string, ce string) string {
+	labels := dns.SplitDomainName(name)
+	return strings.Join(labels[len(labels)-dns.CountLabel(ce)-1:], ".") + "."
+}
+
+// predecessor returns a name that comes before the given one in the canonical
+// ordering of names (RFC 4034 section 6.1), with no name likely to exist
+// between them. The last octet of the first label is decremented, and the
+// label filled up with \255 octets, so b.disco.net. becomes a\255...\255.disco.net.
+func predecessor(name string) string {
+	first, rest := splitFirstLabel(name)
+	last := len(first) - 1
+	if first[last] == 0 {
+		// Dropping a trailing zero octet gives the name before
+		if first = first[:last]; len(first) == 0 {
+			return dns.Fqdn(rest)
+		}
+		return joinFirstLabel(first, rest)
+	}
+
+	// Upper case letters are lower cased in the canonical ordering, so they'd
+	// end up after the name rather than before it
+	first[last]--
+	if first[last] >= 'A' && first[last] <= 'Z' {
+		first[last] = 'A' - 1
+	}
+	room := maxNameLength - nameLength(rest) - len(first) - 1
+	for len(first) < maxLabelLength && room > 0 {
+		first = append(first, 0xff)
+		room--
+	}
+	return joinFirstLabel(first, rest)
+}
+
+// successor returns a name that comes after the given one, and all of the
+// names beneath it, in the canonical ordering of names. A zero octet is
+// appended to the first label, so a.disco.net. becomes a\000.disco.net.
+func successor(name string) string {
+	first, rest := splitFirstLabel(name)
+	if len(first) < maxLabelLength && nameLength(name) < maxNameLength {
+		first = append(first, 0)
+	} else {
+		// There's no room to lengthen the label, so increment the last octet
+		// that can be (dropping those that can't) instead
+		for len(first) > 1 && first[len(first)-1] == 0xff {
+			first = first[:len(first)-1]
+		}
+		first[len(first)-1]++
+	}
+	return joinFirstLabel(first, rest)
+}
+
+// splitFirstLabel returns the octets of the first label of a name (in lower
+// case), and the rest of the name
+func splitFirstLabel(name string) ([]byte, string) {
+	labels := dns.SplitDomainName(name)
+	return unescapeLabel(strings.ToLower(labels[0])), strings.Join(labels[1:], ".")
+}
+
+// joinFirstLabel is the reverse of splitFirstLabel
+func joinFirstLabel(first []byte, rest string) string {
+	return dns.Fqdn(escapeLabel(first) + "." + rest)
+}
+
+// nameLength returns the length of a name in wire format
+func nameLength(name string) int {
+	length := 1
+	for _, label := range dns.SplitDomainName(name) {
+		length += len(unescapeLabel(label)) + 1
+	}
+	return length
+}
+
+// unescapeLabel returns the octets of a label in presentation format, where
+// octets can be escaped as \DDD or \X
+func unescapeLabel(label string) (octets []byte) {
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' || i+1 >= len(label) {
+			octets = append(octets, label[i])
+		} else if i+3 < len(label) && isDigits(label[i+1:i+4]) {
+			var octet int
+			fmt.Sscanf(label[i+1:i+4], "%d", &octet)
+			octets = append(octets, byte(octet))
+			i += 3
+		} else {
+			octets = append(octets, label[i+1])
+			i++
+		}
+	}
+	return
+}
+
+// escapeLabel returns a label in presentation format, escaping any octets
+// that aren't letters, digits, hyphens, underscores or asterisks
+func escapeLabel(octets []byte) string {
+	var label []byte
+	for _, octet := range octets {
+		switch {
+		case octet >= 'a' && octet <= 'z', octet >= 'A' && octet <= 'Z', octet >= '0' && octet <= '9',
+			octet == '-', octet == '_', octet == '*':
+			label = append(label, octet)
+		default:
+			label = append(label, []byte(fmt.Sprintf("\\%03d", octet))...)
+		}
+	}
+	return string(label)
+}
+
+// isDigits returns true if the string is made up of decimal digits
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// rrTypes sorts a list of record types numerically
+type rrTypes []uint16
+
+func (t rrTypes) Len() int           { return len(t) }
+func (t rrTypes) Less(i, j int) bool { return t[i] < t[j] }
+func (t rrTypes) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
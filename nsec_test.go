@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// canonicalLess returns true if a comes before b in the canonical ordering of
+// names (RFC 4034 section 6.1)
+func canonicalLess(a string, b string) bool {
+	labelsA := dns.SplitDomainName(strings.ToLower(a))
+	labelsB := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(labelsA) && i <= len(labelsB); i++ {
+		octetsA := unescapeLabel(labelsA[len(labelsA)-i])
+		octetsB := unescapeLabel(labelsB[len(labelsB)-i])
+		if c := bytes.Compare(octetsA, octetsB); c != 0 {
+			return c < 0
+		}
+	}
+	return len(labelsA) < len(labelsB)
+}
+
+func TestPredecessorSuccessor(t *testing.T) {
+	names := []string{
+		"www.disco.net.",
+		"b.disco.net.",
+		"*.disco.net.",
+		"a\\000.disco.net.",
+		"\\000.disco.net.",
+		"\\[.disco.net.",
+		"WWW.Disco.net.",
+		strings.Repeat("a", 63) + ".disco.net.",
+		"net.",
+	}
+	for _, name := range names {
+		before, after := predecessor(name), successor(name)
+		if !canonicalLess(before, name) {
+			t.Fatalf("Expected %s to come before %s", before, name)
+		}
+		if !canonicalLess(name, after) || !canonicalLess("foo."+name, after) {
+			t.Fatalf("Expected %s to come after %s and the names beneath it", after, name)
+		}
+
+		// Make sure the names are valid
+		msg := new(dns.Msg)
+		msg.Ns = []dns.RR{coveringNSEC(name, 300)}
+		if _, err := msg.Pack(); err != nil {
+			t.Fatalf("Unable to pack NSEC covering %s: %s", name, err)
+		}
+	}
+
+	if before := predecessor("b.disco.net."); before != "a"+strings.Repeat("\\255", 62)+".disco.net." {
+		t.Fatal("Unexpected predecessor of b.disco.net.: ", before)
+	}
+	if after := successor("b.disco.net."); after != "b\\000.disco.net." {
+		t.Fatal("Unexpected successor of b.disco.net.: ", after)
+	}
+}
+
+var testDenialRecords = map[string]string{
+	".SOA.ttl":    "3600",
+	"www/.A":      "1.1.1.1",
+	"www/.A.ttl":  "60",
+	"www/.TXT":    "hello",
+	"deep/er/.A":  "1.1.1.2",
+	"wild/*/.TXT": "wildcard",
+}
+
+// covers returns true if the NSEC record proves the name doesn't exist
+func covers(nsec *dns.NSEC, name string) bool {
+	return canonicalLess(nsec.Hdr.Name, name) && canonicalLess(name, nsec.NextDomain)
+}
+
+func TestDenial(t *testing.T) {
+	resolver.etcdPrefix = "TestDenial/"
+	newTestZone("TestDenial", testDenialRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	// The name doesn't exist, and there's no wildcard
+	records, err := resolver.Denial("disco.net.", "missing.disco.net.", "", true)
+	if err != nil || len(records) != 2 {
+		t.Fatal("Expected two NSEC records: ", records, err)
+	}
+	if !covers(records[0].(*dns.NSEC), "missing.disco.net.") || !covers(records[1].(*dns.NSEC), "*.disco.net.") {
+		t.Fatal("Expected NSEC records covering the name and wildcard: ", records)
+	}
+	if records[0].Header().Ttl != 10 {
+		t.Fatal("Expected NSEC TTL to be the SOA minimum: ", records[0])
+	}
+	if covers(records[0].(*dns.NSEC), "www.disco.net.") || covers(records[0].(*dns.NSEC), "mississippi.disco.net.") {
+		t.Fatal("Expected NSEC record to only cover the missing name: ", records[0])
+	}
+
+	// The closest encloser is an empty non-terminal
+	records, _ = resolver.Denial("disco.net.", "foo.bar.deep.disco.net.", "", true)
+	if len(records) != 2 || !covers(records[0].(*dns.NSEC), "bar.deep.disco.net.") || !covers(records[1].(*dns.NSEC), "*.deep.disco.net.") {
+		t.Fatal("Expected NSEC records covering the next closer name and wildcard: ", records)
+	}
+
+	// The name exists, but not with the type asked for
+	records, _ = resolver.Denial("disco.net.", "www.disco.net.", "", true)
+	if len(records) != 1 || records[0].Header().Name != "www.disco.net." {
+		t.Fatal("Expected a single NSEC record for the name: ", records)
+	}
+	if types := records[0].(*dns.NSEC).TypeBitMap; len(types) != 4 || types[0] != dns.TypeA || types[1] != dns.TypeTXT {
+		t.Fatal("Expected the NSEC record to list A, TXT, RRSIG and NSEC: ", types)
+	}
+	records, _ = resolver.Denial("disco.net.", "deep.disco.net.", "", true)
+	if len(records) != 1 || len(records[0].(*dns.NSEC).TypeBitMap) != 2 {
+		t.Fatal("Expected an NSEC record for the empty non-terminal: ", records)
+	}
+
+	// A wildcard exists, but not with the type asked for
+	records, _ = resolver.Denial("disco.net.", "foo.wild.disco.net.", "", true)
+	if len(records) != 2 || records[1].Header().Name != "*.wild.disco.net." {
+		t.Fatal("Expected an NSEC record for the wildcard: ", records)
+	}
+
+	// Answers from a wildcard prove the name itself doesn't exist
+	records, _ = resolver.Denial("disco.net.", "foo.wild.disco.net.", "*.wild.disco.net.", false)
+	if len(records) != 1 || !covers(records[0].(*dns.NSEC), "foo.wild.disco.net.") {
+		t.Fatal("Expected an NSEC record covering the name: ", records)
+	}
+	if records, _ = resolver.Denial("disco.net.", "www.disco.net.", "", false); len(records) != 0 {
+		t.Fatal("Expected no NSEC records for a positive answer: ", records)
+	}
+}
+
+func TestDenialAlias(t *testing.T) {
+	resolver.etcdPrefix = "TestDenialAlias/"
+	store.Set("TestDenialAlias/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	store.Set("TestDenialAlias/net/disco/.ALIAS", "www.disco.org.")
+	store.Set("TestDenialAlias/net/disco/.ALIAS.ttl", "60")
+	store.Set("TestDenialAlias/net/disco/.TXT", "hello")
+	defer store.Delete(resolver.etcdPrefix)
+
+	// Names with an ALIAS record have A and AAAA records
+	records, _ := resolver.Denial("disco.net.", "disco.net.", "", true)
+	if len(records) != 1 {
+		t.Fatal("Expected a single NSEC record for the name: ", records)
+	}
+	types := records[0].(*dns.NSEC).TypeBitMap
+	expected := []uint16{dns.TypeA, dns.TypeSOA, dns.TypeTXT, dns.TypeAAAA, dns.TypeRRSIG, dns.TypeNSEC}
+	if len(types) != len(expected) {
+		t.Fatal("Expected the NSEC record to list A, SOA, TXT, AAAA, RRSIG and NSEC: ", types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatal("Expected the NSEC record to list A, SOA, TXT, AAAA, RRSIG and NSEC: ", types)
+		}
+	}
+}
+
+func TestLookupSignedDenial(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupSignedDenial/"
+	newTestZone("TestLookupSignedDenial", testDenialRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	key, _, _ := newTestSigningKey(t, "disco.net.", 256)
+	resolver.signer = newTestSigner(key)
+	defer func() { resolver.signer = nil }()
+
+	answer := resolver.Lookup(newTestDNSSECRequest("missing.disco.net.", dns.TypeA))
+	verifySigned(t, answer.Ns, dns.TypeSOA, key)
+	var nsecs []dns.RR
+	for _, rr := range answer.Ns {
+		if rr.Header().Rrtype == dns.TypeNSEC {
+			nsecs = append(nsecs, rr)
+		}
+	}
+	if len(nsecs) != 2 {
+		t.Fatal("Expected two NSEC records: ", answer.Ns)
+	}
+	for _, nsec := range nsecs {
+		records := []dns.RR{nsec}
+		for _, rr := range answer.Ns {
+			if sig, ok := rr.(*dns.RRSIG); ok && sig.Hdr.Name == nsec.Header().Name && sig.TypeCovered == dns.TypeNSEC {
+				records = append(records, sig)
+			}
+		}
+		verifySigned(t, records, dns.TypeNSEC, key)
+	}
+
+	answer = resolver.Lookup(newTestDNSSECRequest("foo.wild.disco.net.", dns.TypeTXT))
+	if len(answer.Answer) != 2 {
+		t.Fatal("Expected a signed wildcard answer: ", answer.Answer)
+	}
+	if len(answer.Ns) != 2 || answer.Ns[0].Header().Rrtype != dns.TypeNSEC {
+		t.Fatal("Expected a signed NSEC record proving the name doesn't exist: ", answer.Ns)
+	}
+}
@@ -4,49 +4,56 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/miekg/dns"
 	"github.com/rcrowley/go-metrics"
 )
 
-// Resolver definen the default TTL and the etcd settings
+// Resolver definen the default TTL and the record store settings
 type Resolver struct {
-	etcd       *etcd.Client
-	etcdPrefix string
-	defaultTTL uint32
+	store         RecordStore
+	etcdPrefix    string
+	defaultTTL    uint32
+	signer        *Signer
+	aliasUpstream string
+	aliasCache    *AliasCache
+	serials       *ZoneSerials
 }
 
-// EtcdRecord is a reference to the node in etcd and the TTL
-type EtcdRecord struct {
-	node *etcd.Node
+// Record is a reference to a node in the record store and the TTL
+type Record struct {
+	node *Node
 	ttl  uint32
 }
 
-// GetFromStorage looks up a key in etcd and returns a slice of nodes. It supports two storage structures;
+// GetFromStorage looks up a key in the record store and returns a slice of nodes. It supports two storage structures;
 //  - File:         /foo/bar/.A -> "value"
 //  - Directory:    /foo/bar/.A/0 -> "value-0"
 //                  /foo/bar/.A/1 -> "value-1"
-func (r *Resolver) GetFromStorage(key string) (nodes []*EtcdRecord, err error) {
+func (r *Resolver) GetFromStorage(key string) (nodes []*Record, err error) {
 	counter := metrics.GetOrRegisterCounter("resolver.etcd.query_count", metrics.DefaultRegistry)
 	errorCounter := metrics.GetOrRegisterCounter("resolver.etcd.query_error_count", metrics.DefaultRegistry)
 	counter.Inc(1)
-	debugMsg("Querying etcd for " + key)
-	response, err := r.etcd.Get(r.etcdPrefix+key, true, true)
+	debugMsg("Querying storage for " + key)
+	root, err := r.store.Get(r.etcdPrefix + key)
 	if err != nil {
 		errorCounter.Inc(1)
 		return
 	}
-	var findKeys func(node *etcd.Node, ttl uint32, tryTtl bool)
-	nodes = make([]*EtcdRecord, 0)
-	findKeys = func(node *etcd.Node, ttl uint32, tryTtl bool) {
+	var findKeys func(node *Node, ttl uint32, tryTtl bool)
+	nodes = make([]*Record, 0)
+	findKeys = func(node *Node, ttl uint32, tryTtl bool) {
 		if node.Dir == true {
-			var lastValNode *etcd.Node
+			var lastValNode *Node
 			for _, node := range node.Nodes {
+				// Records scoped to a client subnet are kept apart
+				if strings.HasPrefix(path.Base(node.Key), "@") {
+					continue
+				}
 				if strings.HasSuffix(node.Key, ".ttl") {
 					ttlValue, err := strconv.ParseUint(node.Value, 10, 32)
 					if err != nil {
@@ -77,21 +84,21 @@ func (r *Resolver) GetFromStorage(key string) (nodes []*EtcdRecord, err error) {
 			// If we don't have a TLL try and find one
 			if tryTtl {
 				ttlKey := node.Key + ".ttl"
-				debugMsg("Querying etcd for " + ttlKey)
-				ttlResponse, err := r.etcd.Get(ttlKey, false, false)
+				debugMsg("Querying storage for " + ttlKey)
+				ttlNode, err := r.store.Get(ttlKey)
 				if err == nil {
-					ttlValue, err := strconv.ParseUint(ttlResponse.Node.Value, 10, 32)
+					ttlValue, err := strconv.ParseUint(ttlNode.Value, 10, 32)
 					if err != nil {
-						debugMsg("Unable to convert ttl value to int: ", ttlResponse.Node.Value)
+						debugMsg("Unable to convert ttl value to int: ", ttlNode.Value)
 					} else {
 						ttl = uint32(ttlValue)
 					}
 				}
 			}
-			nodes = append(nodes, &EtcdRecord{node, ttl})
+			nodes = append(nodes, &Record{node, ttl})
 		}
 	}
-	findKeys(response.Node, r.defaultTTL, true)
+	findKeys(root, r.defaultTTL, true)
 	return
 }
 
@@ -109,7 +116,9 @@ func (r *Resolver) Authority(domain string) (soa *dns.SOA) {
 		}
 		if len(answers) == 1 {
 			soa = answers[0].(*dns.SOA)
-			soa.Serial = uint32(time.Now().Truncate(time.Hour).Unix())
+			if soa.Serial == 0 {
+				soa.Serial = r.ZoneSerial(subdomain)
+			}
 			return
 		}
 	}
@@ -119,71 +128,273 @@ func (r *Resolver) Authority(domain string) (soa *dns.SOA) {
 	return
 }
 
+// Maximum number of CNAME records followed when answering a query, so that a
+// long (or looping) chain can't make a single query do unbounded work
+const maxCNAMEChain = 16
+
 // Lookup responds to DNS messages of type Query, with a dns message containing Answers.
 // In the event that the query's value+type yields no known records, this falls back to
 // querying the given nameservers instead.
-func (r *Resolver) Lookup(req *dns.Msg) (msg *dns.Msg) {
+func (r *Resolver) Lookup(req *dns.Msg) *dns.Msg {
+	return r.LookupWithLimit(req, maxMsgSize(req))
+}
+
+// LookupWithLimit is Lookup for a response that can be no bigger than the
+// given size, which limits the records added to the additional section.
+func (r *Resolver) LookupWithLimit(req *dns.Msg, limit int) (msg *dns.Msg) {
 	q := req.Question[0]
 	msg = new(dns.Msg)
 	msg.SetReply(req)
 	msg.Authoritative = true
 	msg.RecursionAvailable = false // We're a nameserver, no recursion for you!
-	answers := []dns.RR{}
-	errors := []error{}
-	errored := false
-	var aChan chan dns.RR
-	var eChan chan error
+	missCounter := metrics.GetOrRegisterCounter("resolver.answers.miss", metrics.DefaultRegistry)
+	hitCounter := metrics.GetOrRegisterCounter("resolver.answers.hit", metrics.DefaultRegistry)
+	errorCounter := metrics.GetOrRegisterCounter("resolver.answers.error", metrics.DefaultRegistry)
+
+	// Clients that sent their subnet get it back, with the scope of the
+	// answers (the longest of any name in a CNAME chain)
+	var scope uint8
+	subnet := clientSubnet(req)
+	if subnet != nil {
+		defer func() { echoClientSubnet(msg, subnet, scope) }()
+	}
+
+	// Names at or beneath a zone cut are answered with a referral to the
+	// delegated zone's name servers
 	if q.Qclass == dns.ClassINET {
-		aChan, eChan = r.AnswerQuestion(q)
-		answers, errors = gatherFromChannels(aChan, eChan)
-	}
-	errored = errored || len(errors) > 0
-	if len(answers) == 0 {
-		// If we failed to find any answers, let's keep looking up the tree for
-		// any wildcard domain entries.
-		parts := strings.Split(q.Name, ".")
-		for level := 1; level < len(parts); level++ {
-			domain := strings.Join(parts[level:], ".")
-			if len(domain) > 1 {
-				question := dns.Question{
-					Name:   "*." + dns.Fqdn(domain),
-					Qtype:  q.Qtype,
-					Qclass: q.Qclass}
-				aChan, eChan = r.AnswerQuestion(question)
-				answers, errors = gatherFromChannels(aChan, eChan)
-				errored = errored || len(errors) > 0
-				if len(answers) > 0 {
+		cut, ns, err := r.ZoneCut(q.Name, q.Qtype)
+		if err == nil && cut != "" {
+			err = r.Referral(req, msg, cut, ns)
+		}
+		if err != nil {
+			debugMsg("Error finding delegation: ", err)
+			errorCounter.Inc(1)
+			serverFailure(req, msg, err)
+			return
+		} else if cut != "" {
+			return
+		}
+	}
+
+	sign := r.signer != nil && dnssecOK(req)
+	if sign {
+		msg.SetEdns0(dns.DefaultMsgSize, true)
+	}
+
+	// A CNAME record is followed to the records of the type asked for, as long
+	// as its target is in a zone served here, so that clients get the whole
+	// answer at once. Each name in the chain is answered in the same way.
+	name := q.Name
+	seen := map[string]bool{strings.ToLower(name): true}
+	answers, wildcard, scope, err := r.answerName(name, q, subnet)
+	for err == nil && len(answers) > 0 {
+		// Records are signed before being renamed, so the signatures over
+		// answers from a wildcard are made with the wildcard's name
+		if sign {
+			if zone := r.signer.Zone(name); zone != "" && wildcard != "" {
+				var denial []dns.RR
+				if denial, err = r.Denial(zone, name, wildcard, false); err != nil {
+					debugMsg("Error proving denial of existence: ", err)
 					break
 				}
+				msg.Ns = append(msg.Ns, denial...)
 			}
+			answers = append(answers, r.signer.Sign(answers)...)
+		}
+		for _, rr := range answers {
+			rr.Header().Name = name
+		}
+		msg.Answer = append(msg.Answer, answers...)
+
+		target := r.cnameTarget(answers, q.Qtype)
+		if target == "" || seen[target] || len(seen) > maxCNAMEChain {
+			break
+		}
+		seen[target] = true
+		name = target
+		var stepScope uint8
+		answers, wildcard, stepScope, err = r.answerName(name, q, subnet)
+		if stepScope > scope {
+			scope = stepScope
 		}
 	}
-	missCounter := metrics.GetOrRegisterCounter("resolver.answers.miss", metrics.DefaultRegistry)
-	hitCounter := metrics.GetOrRegisterCounter("resolver.answers.hit", metrics.DefaultRegistry)
-	errorCounter := metrics.GetOrRegisterCounter("resolver.answers.error", metrics.DefaultRegistry)
-	if errored {
-		// TODO(tarnfeld): Send special TXT records with a server error response code
+
+	// A name that exists without any records of the type asked for (or without
+	// any records at all, with names beneath it) gets an empty answer rather
+	// than NXDOMAIN, so resolvers don't cache the whole name as missing. The
+	// same goes for names matched by a wildcard without records of the type.
+	exists := wildcard != ""
+	if err == nil && len(answers) == 0 && !exists {
+		if _, exists, err = r.nameTypes(strings.ToLower(name)); err != nil {
+			debugMsg("Error checking whether name exists: ", err)
+		}
+	}
+
+	if err != nil {
 		errorCounter.Inc(1)
-		msg.SetRcode(req, dns.RcodeServerFailure)
+		serverFailure(req, msg, err)
+		return
 	} else if len(answers) == 0 {
-		soa := r.Authority(q.Name)
+		// At the end of a CNAME chain, the response code is for the last name
+		// in the chain
+		soa := r.Authority(name)
 		missCounter.Inc(1)
-		msg.SetRcode(req, dns.RcodeNameError)
+		if !exists {
+			msg.SetRcode(req, dns.RcodeNameError)
+		}
 		if soa != nil {
-			msg.Ns = []dns.RR{soa}
-		} else {
+			msg.Ns = append(msg.Ns, soa)
+		} else if len(msg.Answer) == 0 {
 			msg.Authoritative = false // No SOA? We're not authoritative
 		}
+		if sign {
+			if zone := r.signer.Zone(name); zone != "" {
+				denial, err := r.Denial(zone, name, "", true)
+				if err != nil {
+					debugMsg("Error proving denial of existence: ", err)
+					errorCounter.Inc(1)
+					serverFailure(req, msg, err)
+					return
+				}
+				msg.Ns = append(msg.Ns, denial...)
+			}
+		}
 	} else {
 		hitCounter.Inc(1)
-		for _, rr := range answers {
-			rr.Header().Name = q.Name
-			msg.Answer = append(msg.Answer, rr)
+	}
+	if sign {
+		msg.Ns = append(msg.Ns, r.signer.Sign(msg.Ns)...)
+	}
+
+	// Addresses in the additional section are optional, so failing to find
+	// them doesn't fail the whole query. They have to leave room for the OPT
+	// record that's added to the response later.
+	if msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0 {
+		if soa := r.Authority(q.Name); soa != nil {
+			if err := r.Additional(req, msg, soa.Hdr.Name, limit-optSize(req)); err != nil {
+				debugMsg("Error adding additional records: ", err)
+			}
+		}
+	}
+	return
+}
+
+// answerName finds the answers to the question for the given name, from the
+// records held for the name itself or otherwise from a wildcard above it. The
+// name of the wildcard is returned too, if the name is matched by one (even if
+// the wildcard has no records of the type asked for). If the client's subnet
+// is given, records scoped to it are used in place of the name's others, and
+// the scope prefix length of the answers is returned.
+func (r *Resolver) answerName(name string, q dns.Question, subnet *dns.EDNS0_SUBNET) (answers []dns.RR, wildcard string, scope uint8, err error) {
+	q.Name = name
+	if q.Qclass == dns.ClassINET && isKeyType(q.Qtype) && r.signer != nil {
+		answers = r.signer.KeyRecords(q.Name, q.Qtype)
+	} else if q.Qclass == dns.ClassINET {
+		if answers, err = r.gatherAnswers(q); err == nil {
+			answers, scope, err = r.scopeAnswers(q.Name, q.Qtype, subnet, answers)
+		}
+	}
+	if len(answers) == 0 && err == nil && q.Qclass == dns.ClassINET && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		if answers, err = r.Alias(q.Name, q.Qtype); err != nil {
+			debugMsg("Error resolving ALIAS: ", err)
+		}
+	}
+	if len(answers) == 0 && err == nil && q.Qclass == dns.ClassINET {
+		// If we failed to find any answers, the name might be matched by a
+		// wildcard
+		source, err := r.wildcardSource(q.Name)
+		if err != nil {
+			debugMsg("Error finding wildcard: ", err)
+			return nil, "", 0, err
+		} else if source != "" {
+			question := dns.Question{
+				Name:   source,
+				Qtype:  q.Qtype,
+				Qclass: q.Qclass}
+			wildcard = source
+			if answers, err = r.gatherAnswers(question); err == nil {
+				answers, scope, err = r.scopeAnswers(source, q.Qtype, subnet, answers)
+			}
+			return answers, wildcard, scope, err
 		}
 	}
 	return
 }
 
+// gatherAnswers answers a question with AnswerQuestion, returning the first
+// error encountered if there were any
+func (r *Resolver) gatherAnswers(q dns.Question) ([]dns.RR, error) {
+	answers, errors := gatherFromChannels(r.AnswerQuestion(q))
+	if len(errors) > 0 {
+		return nil, errors[0]
+	}
+	return answers, nil
+}
+
+// scopeAnswers replaces the answers for a name with the records scoped to the
+// client's subnet, if there are any
+func (r *Resolver) scopeAnswers(name string, qtype uint16, subnet *dns.EDNS0_SUBNET, answers []dns.RR) ([]dns.RR, uint8, error) {
+	if subnet == nil || qtype == dns.TypeANY || isKeyType(qtype) {
+		return answers, 0, nil
+	}
+	scoped, scope, err := r.SubnetAnswers(name, qtype, subnet)
+	if err != nil {
+		debugMsg("Error finding subnet scoped records: ", err)
+		return nil, 0, err
+	} else if len(scoped) > 0 {
+		answers = scoped
+	}
+	return answers, scope, nil
+}
+
+// wildcardSource returns the name of the wildcard that matches a name, or an
+// empty string if there isn't one. As described in RFC 4592, wildcards only
+// match names that don't exist (including empty non-terminals, which exist
+// without any records of their own), and only the wildcard immediately beneath
+// the closest existing ancestor of the name can match it. So *.disco.net.
+// matches a.b.disco.net. only if b.disco.net. doesn't exist.
+func (r *Resolver) wildcardSource(name string) (string, error) {
+	name = strings.ToLower(name)
+	if _, exists, err := r.nameTypes(name); err != nil || exists {
+		return "", err
+	}
+
+	zone := "."
+	if soa := r.Authority(name); soa != nil {
+		zone = soa.Hdr.Name
+	}
+	ce, err := r.closestEncloser(name, zone)
+	if err != nil {
+		return "", err
+	}
+	source := "*." + ce
+	if ce == "." {
+		source = "*."
+	}
+	if _, exists, err := r.nameTypes(source); err != nil || !exists {
+		return "", err
+	}
+	return source, nil
+}
+
+// cnameTarget returns the name to carry on answering the question from, when
+// the answers are a CNAME record pointing somewhere within a zone served here.
+// An empty string is returned if there's nowhere to go.
+func (r *Resolver) cnameTarget(answers []dns.RR, qtype uint16) string {
+	cname, ok := answers[0].(*dns.CNAME)
+	if !ok || qtype == dns.TypeCNAME || qtype == dns.TypeANY {
+		return ""
+	}
+	target := strings.ToLower(cname.Target)
+	if soa := r.Authority(target); soa == nil {
+		return ""
+	}
+	if cut, _, err := r.ZoneCut(target, qtype); err != nil || cut != "" {
+		return ""
+	}
+	return target
+}
+
 // Gather up results from answer and error channels into slices. Waits for the
 // channels to be closed before returning.
 func gatherFromChannels(rrsIn chan dns.RR, errsIn chan error) (rrs []dns.RR, errs []error) {
@@ -283,19 +494,23 @@ func (r *Resolver) AnswerQuestion(q dns.Question) (answers chan dns.RR, errors c
 	return answers, errors
 }
 
-// LookupAnswersForType finds the resource records in etcd for the supplied name and type.
+// LookupAnswersForType finds the resource records in the record store for the supplied name and type.
 func (r *Resolver) LookupAnswersForType(name string, rrType uint16) (answers []dns.RR, err error) {
 	name = strings.ToLower(name)
 	typeStr := dns.TypeToString[rrType]
 	nodes, err := r.GetFromStorage(nameToKey(name, "/."+typeStr))
 	if err != nil {
-		if e, ok := err.(*etcd.EtcdError); ok {
-			if e.ErrorCode == 100 {
-				return answers, nil
-			}
+		if _, ok := err.(*KeyNotFoundError); ok {
+			return answers, nil
 		}
 		return
 	}
+	return r.convertRecords(name, rrType, nodes)
+}
+
+// convertRecords turns the nodes holding records of a type for the name into
+// resource records
+func (r *Resolver) convertRecords(name string, rrType uint16, nodes []*Record) (answers []dns.RR, err error) {
 	answers = make([]dns.RR, len(nodes))
 	for i, node := range nodes {
 		header := dns.RR_Header{Name: name, Class: dns.ClassINET, Rrtype: rrType, Ttl: node.ttl}
@@ -309,7 +524,7 @@ func (r *Resolver) LookupAnswersForType(name string, rrType uint16) (answers []d
 	return
 }
 
-// nameToKey returns a string representing the etcd version of a domain, replacing dots with slashes
+// nameToKey returns a string representing the storage key of a domain, replacing dots with slashes
 // and reversing it (foo.net. -> /net/foo)
 func nameToKey(name string, suffix string) string {
 	segments := strings.Split(name, ".")
@@ -324,9 +539,26 @@ func nameToKey(name string, suffix string) string {
 	return keyBuffer.String()
 }
 
-// Map of conversion functions that turn individual etcd nodes into dns.RR answers
-var converters = map[uint16]func(node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error){
-	dns.TypeA: func(node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
+// keyToName returns the domain name for a storage key, the reverse of nameToKey
+// (/net/foo -> foo.net.)
+func keyToName(key string) string {
+	segments := strings.Split(key, "/")
+	var nameBuffer bytes.Buffer
+	for i := len(segments) - 1; i >= 0; i-- {
+		if len(segments[i]) > 0 {
+			nameBuffer.WriteString(segments[i])
+			nameBuffer.WriteString(".")
+		}
+	}
+	if nameBuffer.Len() == 0 {
+		return "."
+	}
+	return nameBuffer.String()
+}
+
+// Map of conversion functions that turn individual storage nodes into dns.RR answers
+var converters = map[uint16]func(node *Node, header dns.RR_Header) (rr dns.RR, err error){
+	dns.TypeA: func(node *Node, header dns.RR_Header) (rr dns.RR, err error) {
 		ip := net.ParseIP(node.Value)
 		if ip == nil {
 			err = &NodeConversionError{
@@ -345,7 +577,7 @@ var converters = map[uint16]func(node *etcd.Node, header dns.RR_Header) (rr dns.
 		}
 		return
 	},
-	dns.TypeAAAA: func(node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
+	dns.TypeAAAA: func(node *Node, header dns.RR_Header) (rr dns.RR, err error) {
 		ip := net.ParseIP(node.Value)
 		if ip == nil {
 			err = &NodeConversionError{
@@ -362,11 +594,11 @@ var converters = map[uint16]func(node *etcd.Node, header dns.RR_Header) (rr dns.
 		}
 		return
 	},
-	dns.TypeTXT: func(node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
+	dns.TypeTXT: func(node *Node, header dns.RR_Header) (rr dns.RR, err error) {
 		rr = &dns.TXT{Hdr: header, Txt: []string{node.Value}}
 		return
 	},
-	dns.TypeMX: func(node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
+	dns.TypeMX: func(node *Node, header dns.RR_Header) (rr dns.RR, err error) {
 		parts := strings.SplitN(node.Value, "\t", 2)
 		preference, err := strconv.ParseUint(parts[0], 10, 16)
 		if err != nil {
@@ -374,17 +606,17 @@ var converters = map[uint16]func(node *etcd.Node, header dns.RR_Header) (rr dns.
 		}
 		rr = &dns.MX{Hdr: header, Preference: uint16(preference), Mx: dns.Fqdn(parts[1])}
 		return
-        },
-	dns.TypeCNAME: func(node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
+	},
+	dns.TypeCNAME: func(node *Node, header dns.RR_Header) (rr dns.RR, err error) {
 		rr = &dns.CNAME{Hdr: header, Target: dns.Fqdn(node.Value)}
 		return
 	},
 
-	dns.TypeNS: func(node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
+	dns.TypeNS: func(node *Node, header dns.RR_Header) (rr dns.RR, err error) {
 		rr = &dns.NS{Hdr: header, Ns: dns.Fqdn(node.Value)}
 		return
 	},
-	dns.TypePTR: func(node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
+	dns.TypePTR: func(node *Node, header dns.RR_Header) (rr dns.RR, err error) {
 		labels, ok := dns.IsDomainName(node.Value)
 		if ok && labels > 0 {
 			rr = &dns.PTR{Hdr: header, Ptr: dns.Fqdn(node.Value)}
@@ -396,7 +628,7 @@ var converters = map[uint16]func(node *etcd.Node, header dns.RR_Header) (rr dns.
 		}
 		return
 	},
-	dns.TypeSRV: func(node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
+	dns.TypeSRV: func(node *Node, header dns.RR_Header) (rr dns.RR, err error) {
 		parts := strings.SplitN(node.Value, "\t", 4)
 		if len(parts) != 4 {
 			err = &NodeConversionError{
@@ -426,9 +658,47 @@ var converters = map[uint16]func(node *etcd.Node, header dns.RR_Header) (rr dns.
 		}
 		return
 	},
-	dns.TypeSOA: func(node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
-		parts := strings.SplitN(node.Value, "\t", 6)
-		if len(parts) < 6 {
+	dns.TypeDS: func(node *Node, header dns.RR_Header) (rr dns.RR, err error) {
+		parts := strings.Split(node.Value, "\t")
+		if len(parts) != 4 {
+			err = &NodeConversionError{
+				Node:          node,
+				Message:       fmt.Sprintf("Value %s isn't valid for DS", node.Value),
+				AttemptedType: dns.TypeDS}
+		} else {
+			keyTag, err := strconv.ParseUint(parts[0], 10, 16)
+			if err != nil {
+				return nil, err
+			}
+			algorithm, err := strconv.ParseUint(parts[1], 10, 8)
+			if err != nil {
+				return nil, err
+			}
+			digestType, err := strconv.ParseUint(parts[2], 10, 8)
+			if err != nil {
+				return nil, err
+			}
+			rr = &dns.DS{
+				Hdr:        header,
+				KeyTag:     uint16(keyTag),
+				Algorithm:  uint8(algorithm),
+				DigestType: uint8(digestType),
+				Digest:     strings.ToUpper(parts[3])}
+		}
+		return
+	},
+	dns.TypeSOA: func(node *Node, header dns.RR_Header) (rr dns.RR, err error) {
+		// The serial is optional, and sits between the mailbox and refresh
+		// interval as it does in a zone file
+		parts := strings.Split(node.Value, "\t")
+		var serial uint64
+		if len(parts) == 7 {
+			if serial, err = strconv.ParseUint(parts[2], 10, 32); err != nil {
+				return nil, err
+			}
+			parts = append(parts[:2], parts[3:]...)
+		}
+		if len(parts) != 6 {
 			err = &NodeConversionError{
 				Node:          node,
 				Message:       fmt.Sprintf("Value %s isn't valid for SOA", node.Value),
@@ -454,6 +724,7 @@ var converters = map[uint16]func(node *etcd.Node, header dns.RR_Header) (rr dns.
 				Hdr:     header,
 				Ns:      dns.Fqdn(parts[0]),
 				Mbox:    dns.Fqdn(parts[1]),
+				Serial:  uint32(serial),
 				Refresh: uint32(refresh),
 				Retry:   uint32(retry),
 				Expire:  uint32(expire),
@@ -462,3 +733,35 @@ var converters = map[uint16]func(node *etcd.Node, header dns.RR_Header) (rr dns.
 		return
 	},
 }
+
+// encodeRecord turns a dns.RR into the value it would be stored as, the
+// inverse of the converters above.
+func encodeRecord(rr dns.RR) (value string, err error) {
+	switch rr := rr.(type) {
+	case *dns.A:
+		value = rr.A.String()
+	case *dns.AAAA:
+		value = rr.AAAA.String()
+	case *dns.TXT:
+		value = strings.Join(rr.Txt, "")
+	case *dns.MX:
+		value = fmt.Sprintf("%d\t%s", rr.Preference, rr.Mx)
+	case *dns.CNAME:
+		value = rr.Target
+	case *dns.NS:
+		value = rr.Ns
+	case *dns.PTR:
+		value = rr.Ptr
+	case *dns.SRV:
+		value = fmt.Sprintf("%d\t%d\t%d\t%s", rr.Priority, rr.Weight, rr.Port, rr.Target)
+	case *dns.DS:
+		value = fmt.Sprintf("%d\t%d\t%d\t%s", rr.KeyTag, rr.Algorithm, rr.DigestType, rr.Digest)
+	case *dns.SOA:
+		value = fmt.Sprintf("%s\t%s\t%d\t%d\t%d\t%d\t%d", rr.Ns, rr.Mbox, rr.Serial, rr.Refresh, rr.Retry, rr.Expire, rr.Minttl)
+	default:
+		err = &RecordValueError{
+			Message:       "Unsupported record type",
+			AttemptedType: rr.Header().Rrtype}
+	}
+	return
+}
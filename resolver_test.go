@@ -1,31 +1,40 @@
 package main
 
 import (
+	"fmt"
+	"sort"
 	"strings"
 	"testing"
 
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/miekg/dns"
 )
 
 var (
-	client   = etcd.NewClient([]string{"http://127.0.0.1:4001"})
-	resolver = &Resolver{etcd: client}
+	store    = NewMemoryStore()
+	resolver = &Resolver{store: store}
 )
 
-func TestEtcd(t *testing.T) {
-	// Enable debug logging
-	logDebug = true
+// newTestZone adds disco.net. to the store under a prefix, with SOA and NS
+// records at its apex and the other records given (keyed by their path within
+// the zone), which are set in order of their keys
+func newTestZone(prefix string, records map[string]string) {
+	store.Set(prefix+"/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	store.Set(prefix+"/net/disco/.NS", "ns1.disco.net.")
 
-	if !client.SyncCluster() {
-		t.Fatal("Failed to sync etcd cluster")
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		store.Set(prefix+"/net/disco/"+key, records[key])
 	}
 }
 
 func TestGetFromStorageSingleKey(t *testing.T) {
 	resolver.etcdPrefix = "TestGetFromStorageSingleKey/"
-	client.Set("TestGetFromStorageSingleKey/net/disco/.A", "1.1.1.1", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestGetFromStorageSingleKey/net/disco/.A", "1.1.1.1")
+	defer store.Delete(resolver.etcdPrefix)
 
 	nodes, err := resolver.GetFromStorage("net/disco/.A")
 	if err != nil {
@@ -44,10 +53,10 @@ func TestGetFromStorageSingleKey(t *testing.T) {
 
 func TestGetFromStorageNestedKeys(t *testing.T) {
 	resolver.etcdPrefix = "TestGetFromStorageNestedKeys/"
-	client.Set("TestGetFromStorageNestedKeys/net/disco/.A/0", "1.1.1.1", 0)
-	client.Set("TestGetFromStorageNestedKeys/net/disco/.A/1", "1.1.1.2", 0)
-	client.Set("TestGetFromStorageNestedKeys/net/disco/.A/2/0", "1.1.1.3", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestGetFromStorageNestedKeys/net/disco/.A/0", "1.1.1.1")
+	store.Set("TestGetFromStorageNestedKeys/net/disco/.A/1", "1.1.1.2")
+	store.Set("TestGetFromStorageNestedKeys/net/disco/.A/2/0", "1.1.1.3")
+	defer store.Delete(resolver.etcdPrefix)
 
 	nodes, err := resolver.GetFromStorage("net/disco/.A")
 	if err != nil {
@@ -58,7 +67,7 @@ func TestGetFromStorageNestedKeys(t *testing.T) {
 		t.Fatal("Number of nodes should be 3: ", len(nodes))
 	}
 
-	var node *EtcdRecord
+	var node *Record
 
 	node = nodes[0]
 	if node.node.Value != "1.1.1.1" {
@@ -93,6 +102,20 @@ func TestNameToKeyConverter(t *testing.T) {
 	}
 }
 
+func TestKeyToNameConverter(t *testing.T) {
+	var name string
+
+	name = keyToName("/net/foo")
+	if name != "foo.net." {
+		t.Error("Expected name foo.net.")
+	}
+
+	name = keyToName("/")
+	if name != "." {
+		t.Error("Expected name .")
+	}
+}
+
 /**
  * Test that the right authority is being returned for different types of DNS
  * queries.
@@ -100,8 +123,8 @@ func TestNameToKeyConverter(t *testing.T) {
 
 func TestAuthorityRoot(t *testing.T) {
 	resolver.etcdPrefix = "TestAuthorityRoot/"
-	client.Set("TestAuthorityRoot/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAuthorityRoot/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	defer store.Delete(resolver.etcdPrefix)
 
 	query := new(dns.Msg)
 	query.SetQuestion("disco.net.", dns.TypeA)
@@ -153,8 +176,8 @@ func TestAuthorityRoot(t *testing.T) {
 
 func TestAuthorityDomain(t *testing.T) {
 	resolver.etcdPrefix = "TestAuthorityDomain/"
-	client.Set("TestAuthorityDomain/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAuthorityDomain/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	defer store.Delete(resolver.etcdPrefix)
 
 	query := new(dns.Msg)
 	query.SetQuestion("bar.disco.net.", dns.TypeA)
@@ -203,9 +226,9 @@ func TestAuthorityDomain(t *testing.T) {
 
 func TestAuthoritySubdomain(t *testing.T) {
 	resolver.etcdPrefix = "TestAuthoritySubdomain/"
-	client.Set("TestAuthoritySubdomain/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
-	client.Set("TestAuthoritySubdomain/net/disco/bar/.SOA", "ns1.bar.disco.net.\tbar.disco.net.\t3600\t600\t86400\t10", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAuthoritySubdomain/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	store.Set("TestAuthoritySubdomain/net/disco/bar/.SOA", "ns1.bar.disco.net.\tbar.disco.net.\t3600\t600\t86400\t10")
+	defer store.Delete(resolver.etcdPrefix)
 
 	query := new(dns.Msg)
 	query.SetQuestion("foo.bar.disco.net.", dns.TypeA)
@@ -258,9 +281,9 @@ func TestAuthoritySubdomain(t *testing.T) {
 
 func TestAnswerQuestionA(t *testing.T) {
 	resolver.etcdPrefix = "TestAnswerQuestionA/"
-	client.Set("TestAnswerQuestionA/net/disco/bar/.A", "1.2.3.4", 0)
-	client.Set("TestAnswerQuestionA/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAnswerQuestionA/net/disco/bar/.A", "1.2.3.4")
+	store.Set("TestAnswerQuestionA/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	defer store.Delete(resolver.etcdPrefix)
 
 	query := new(dns.Msg)
 	query.SetQuestion("bar.disco.net.", dns.TypeA)
@@ -294,9 +317,9 @@ func TestAnswerQuestionA(t *testing.T) {
 
 func TestAnswerQuestionAAAA(t *testing.T) {
 	resolver.etcdPrefix = "TestAnswerQuestionAAAA/"
-	client.Set("TestAnswerQuestionAAAA/net/disco/bar/.AAAA", "::1", 0)
-	client.Set("TestAnswerQuestionAAAA/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAnswerQuestionAAAA/net/disco/bar/.AAAA", "::1")
+	store.Set("TestAnswerQuestionAAAA/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	defer store.Delete(resolver.etcdPrefix)
 
 	query := new(dns.Msg)
 	query.SetQuestion("bar.disco.net.", dns.TypeAAAA)
@@ -330,10 +353,10 @@ func TestAnswerQuestionAAAA(t *testing.T) {
 
 func TestAnswerQuestionANY(t *testing.T) {
 	resolver.etcdPrefix = "TestAnswerQuestionANY/"
-	client.Set("TestAnswerQuestionANY/net/disco/bar/.TXT", "google.com.", 0)
-	client.Set("TestAnswerQuestionANY/net/disco/bar/.A/0", "1.2.3.4", 0)
-	client.Set("TestAnswerQuestionANY/net/disco/bar/.A/1", "2.3.4.5", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAnswerQuestionANY/net/disco/bar/.TXT", "google.com.")
+	store.Set("TestAnswerQuestionANY/net/disco/bar/.A/0", "1.2.3.4")
+	store.Set("TestAnswerQuestionANY/net/disco/bar/.A/1", "2.3.4.5")
+	defer store.Delete(resolver.etcdPrefix)
 
 	query := new(dns.Msg)
 	query.SetQuestion("bar.disco.net.", dns.TypeANY)
@@ -373,9 +396,9 @@ func TestAnswerQuestionUnsupportedType(t *testing.T) {
 
 func TestAnswerQuestionWildcardCNAME(t *testing.T) {
 	resolver.etcdPrefix = "TestAnswerQuestionCNAME/"
-	client.Set("TestAnswerQuestionCNAME/net/disco/*/.CNAME", "baz.disco.net.", 0)
-	client.Set("TestAnswerQuestionCNAME/net/disco/baz/.A", "1.2.3.4", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAnswerQuestionCNAME/net/disco/*/.CNAME", "baz.disco.net.")
+	store.Set("TestAnswerQuestionCNAME/net/disco/baz/.A", "1.2.3.4")
+	defer store.Delete(resolver.etcdPrefix)
 
 	query := new(dns.Msg)
 	query.SetQuestion("test.disco.net.", dns.TypeA)
@@ -409,9 +432,9 @@ func TestAnswerQuestionWildcardCNAME(t *testing.T) {
 
 func TestAnswerQuestionCNAME(t *testing.T) {
 	resolver.etcdPrefix = "TestAnswerQuestionCNAME/"
-	client.Set("TestAnswerQuestionCNAME/net/disco/bar/.CNAME", "baz.disco.net.", 0)
-	client.Set("TestAnswerQuestionCNAME/net/disco/baz/.A", "1.2.3.4", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAnswerQuestionCNAME/net/disco/bar/.CNAME", "baz.disco.net.")
+	store.Set("TestAnswerQuestionCNAME/net/disco/baz/.A", "1.2.3.4")
+	defer store.Delete(resolver.etcdPrefix)
 
 	query := new(dns.Msg)
 	query.SetQuestion("bar.disco.net.", dns.TypeA)
@@ -445,8 +468,8 @@ func TestAnswerQuestionCNAME(t *testing.T) {
 
 func TestAnswerQuestionWildcardAAAANoMatch(t *testing.T) {
 	resolver.etcdPrefix = "TestAnswerQuestionWildcardANoMatch/"
-	client.Set("TestAnswerQuestionWildcardANoMatch/net/disco/bar/*/.AAAA", "::1", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAnswerQuestionWildcardANoMatch/net/disco/bar/*/.AAAA", "::1")
+	defer store.Delete(resolver.etcdPrefix)
 
 	query := new(dns.Msg)
 	query.SetQuestion("bar.disco.net.", dns.TypeAAAA)
@@ -460,8 +483,8 @@ func TestAnswerQuestionWildcardAAAANoMatch(t *testing.T) {
 
 func TestAnswerQuestionWildcardAAAA(t *testing.T) {
 	resolver.etcdPrefix = "TestAnswerQuestionWildcardA/"
-	client.Set("TestAnswerQuestionWildcardA/net/disco/bar/*/.AAAA", "::1", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAnswerQuestionWildcardA/net/disco/bar/*/.AAAA", "::1")
+	defer store.Delete(resolver.etcdPrefix)
 
 	query := new(dns.Msg)
 	query.SetQuestion("baz.bar.disco.net.", dns.TypeAAAA)
@@ -493,11 +516,185 @@ func TestAnswerQuestionWildcardAAAA(t *testing.T) {
 	}
 }
 
+func TestLookupNoData(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupNoData/"
+	store.Set("TestLookupNoData/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	store.Set("TestLookupNoData/net/disco/bar/.A", "1.2.3.4")
+	store.Set("TestLookupNoData/net/disco/deep/er/.A", "1.2.3.4")
+	defer store.Delete(resolver.etcdPrefix)
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+	}{
+		// The name exists, but not with records of the type asked for
+		{"bar.disco.net.", dns.TypeAAAA, dns.RcodeSuccess},
+		{"BAR.disco.net.", dns.TypeMX, dns.RcodeSuccess},
+		// Empty non-terminals exist, because there are names beneath them
+		{"deep.disco.net.", dns.TypeA, dns.RcodeSuccess},
+		{"missing.disco.net.", dns.TypeA, dns.RcodeNameError},
+		{"missing.bar.disco.net.", dns.TypeA, dns.RcodeNameError},
+	}
+	for _, test := range tests {
+		query := new(dns.Msg)
+		query.SetQuestion(test.name, test.qtype)
+		answer := resolver.Lookup(query)
+
+		if answer.Rcode != test.rcode {
+			t.Fatalf("Expected %s for %s, got %s", dns.RcodeToString[test.rcode], test.name, dns.RcodeToString[answer.Rcode])
+		}
+		if len(answer.Answer) > 0 {
+			t.Fatal("Didn't expect any answers, got ", answer.Answer)
+		}
+		if len(answer.Ns) != 1 || answer.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Fatal("Expected the SOA record in the authority section, got ", answer.Ns)
+		}
+	}
+}
+
+func TestLookupCNAMEChain(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupCNAMEChain/"
+	store.Set("TestLookupCNAMEChain/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	store.Set("TestLookupCNAMEChain/net/disco/a/.CNAME", "b.disco.net.")
+	store.Set("TestLookupCNAMEChain/net/disco/b/.CNAME", "C.disco.net.")
+	store.Set("TestLookupCNAMEChain/net/disco/c/.A", "1.2.3.4")
+	store.Set("TestLookupCNAMEChain/net/disco/wild/*/.CNAME", "c.disco.net.")
+	store.Set("TestLookupCNAMEChain/net/disco/loop1/.CNAME", "loop2.disco.net.")
+	store.Set("TestLookupCNAMEChain/net/disco/loop2/.CNAME", "loop1.disco.net.")
+	store.Set("TestLookupCNAMEChain/net/disco/external/.CNAME", "www.disco.org.")
+	store.Set("TestLookupCNAMEChain/net/disco/dangling/.CNAME", "missing.sub.disco.net.")
+	store.Set("TestLookupCNAMEChain/net/disco/sub/.A", "1.2.3.4")
+	store.Set("TestLookupCNAMEChain/net/disco/long0/.CNAME", "long1.disco.net.")
+	for i := 1; i < 20; i++ {
+		store.Set(fmt.Sprintf("TestLookupCNAMEChain/net/disco/long%d/.CNAME", i), fmt.Sprintf("long%d.disco.net.", i+1))
+	}
+	defer store.Delete(resolver.etcdPrefix)
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers []string
+	}{
+		{"a.disco.net.", dns.TypeA, dns.RcodeSuccess, []string{"a.disco.net.", "b.disco.net.", "c.disco.net."}},
+		{"a.disco.net.", dns.TypeCNAME, dns.RcodeSuccess, []string{"a.disco.net."}},
+		{"foo.wild.disco.net.", dns.TypeA, dns.RcodeSuccess, []string{"foo.wild.disco.net.", "c.disco.net."}},
+		{"loop1.disco.net.", dns.TypeA, dns.RcodeSuccess, []string{"loop1.disco.net.", "loop2.disco.net."}},
+		{"external.disco.net.", dns.TypeA, dns.RcodeSuccess, []string{"external.disco.net."}},
+		// The response code is for the end of the chain
+		{"dangling.disco.net.", dns.TypeA, dns.RcodeNameError, []string{"dangling.disco.net."}},
+		{"b.disco.net.", dns.TypeTXT, dns.RcodeSuccess, []string{"b.disco.net."}},
+	}
+	for _, test := range tests {
+		query := new(dns.Msg)
+		query.SetQuestion(test.name, test.qtype)
+		answer := resolver.Lookup(query)
+
+		if answer.Rcode != test.rcode {
+			t.Fatalf("Expected %s for %s, got %s", dns.RcodeToString[test.rcode], test.name, dns.RcodeToString[answer.Rcode])
+		}
+		if len(answer.Answer) != len(test.answers) {
+			t.Fatalf("Expected %d answers for %s, got %v", len(test.answers), test.name, answer.Answer)
+		}
+		for i, name := range test.answers {
+			if answer.Answer[i].Header().Name != name {
+				t.Fatalf("Expected answer %d for %s to be for %s, got %v", i, test.name, name, answer.Answer[i])
+			}
+		}
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion("long0.disco.net.", dns.TypeA)
+	if answer := resolver.Lookup(query); len(answer.Answer) != maxCNAMEChain+1 {
+		t.Fatalf("Expected the chain to be followed %d times, got %d answers", maxCNAMEChain, len(answer.Answer))
+	}
+}
+
+// TestLookupWildcard checks the examples from RFC 4592 section 2.2.1, using the
+// zone given there (along with a wildcard CNAME record)
+func TestLookupWildcard(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupWildcard/"
+	store.Set("TestLookupWildcard/example/.SOA", "ns.example.com.\thostmaster.example.\t3600\t600\t86400\t10")
+	store.Set("TestLookupWildcard/example/.NS/0", "ns.example.com.")
+	store.Set("TestLookupWildcard/example/.NS/1", "ns.example.net.")
+	store.Set("TestLookupWildcard/example/*/.TXT", "this is a wildcard")
+	store.Set("TestLookupWildcard/example/*/.MX", "10\thost1.example.")
+	store.Set("TestLookupWildcard/example/*/sub/.TXT", "this is not a wildcard")
+	store.Set("TestLookupWildcard/example/host1/.A", "192.0.2.1")
+	store.Set("TestLookupWildcard/example/host1/_tcp/_ssh/.SRV", "0\t0\t22\thost1.example.")
+	store.Set("TestLookupWildcard/example/host2/_tcp/_ssh/.SRV", "0\t0\t22\thost2.example.")
+	store.Set("TestLookupWildcard/example/subdel/.NS/0", "ns.example.com.")
+	store.Set("TestLookupWildcard/example/subdel/.NS/1", "ns.example.net.")
+	store.Set("TestLookupWildcard/example/alias/*/.CNAME", "host1.example.")
+	// Deleting every record of a name leaves its directories behind in etcd
+	store.Set("TestLookupWildcard/example/gone/.A/0", "192.0.2.2")
+	store.Set("TestLookupWildcard/example/gone/deeper/.A", "192.0.2.3")
+	store.Delete("TestLookupWildcard/example/gone/.A/0")
+	store.Delete("TestLookupWildcard/example/gone/deeper/.A")
+	defer store.Delete(resolver.etcdPrefix)
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers []uint16
+		ns      uint16
+	}{
+		// Synthesized from the wildcard
+		{"host3.example.", dns.TypeMX, dns.RcodeSuccess, []uint16{dns.TypeMX}, 0},
+		{"foo.bar.example.", dns.TypeTXT, dns.RcodeSuccess, []uint16{dns.TypeTXT}, 0},
+		// The wildcard matches, but has no records of the type
+		{"host3.example.", dns.TypeA, dns.RcodeSuccess, nil, dns.TypeSOA},
+		// The name exists, so the wildcard doesn't apply
+		{"host1.example.", dns.TypeMX, dns.RcodeSuccess, nil, dns.TypeSOA},
+		{"sub.*.example.", dns.TypeMX, dns.RcodeSuccess, nil, dns.TypeSOA},
+		{"_tcp.host1.example.", dns.TypeA, dns.RcodeSuccess, nil, dns.TypeSOA},
+		// The closest encloser has no wildcard of its own
+		{"_telnet._tcp.host1.example.", dns.TypeSRV, dns.RcodeNameError, nil, dns.TypeSOA},
+		{"ghost.*.example.", dns.TypeMX, dns.RcodeNameError, nil, dns.TypeSOA},
+		{"host.subdel.example.", dns.TypeA, dns.RcodeSuccess, nil, dns.TypeNS},
+		// The wildcard itself is an ordinary name
+		{"*.example.", dns.TypeTXT, dns.RcodeSuccess, []uint16{dns.TypeTXT}, 0},
+		{"_ssh._tcp.host2.example.", dns.TypeSRV, dns.RcodeSuccess, []uint16{dns.TypeSRV}, 0},
+		// A wildcard CNAME record is followed like any other
+		{"www.alias.example.", dns.TypeA, dns.RcodeSuccess, []uint16{dns.TypeCNAME, dns.TypeA}, 0},
+		{"www.alias.example.", dns.TypeMX, dns.RcodeSuccess, []uint16{dns.TypeCNAME}, dns.TypeSOA},
+		{"alias.example.", dns.TypeA, dns.RcodeSuccess, nil, dns.TypeSOA},
+		// A name whose records have all been deleted doesn't exist
+		{"gone.example.", dns.TypeTXT, dns.RcodeSuccess, []uint16{dns.TypeTXT}, 0},
+		{"deeper.gone.example.", dns.TypeMX, dns.RcodeSuccess, []uint16{dns.TypeMX}, 0},
+		{"gone.example.", dns.TypeA, dns.RcodeSuccess, nil, dns.TypeSOA},
+	}
+	for _, test := range tests {
+		query := new(dns.Msg)
+		query.SetQuestion(test.name, test.qtype)
+		answer := resolver.Lookup(query)
+
+		if answer.Rcode != test.rcode {
+			t.Fatalf("Expected %s for %s %s, got %s", dns.RcodeToString[test.rcode], test.name, dns.TypeToString[test.qtype], dns.RcodeToString[answer.Rcode])
+		}
+		if len(answer.Answer) != len(test.answers) {
+			t.Fatalf("Expected %d answers for %s %s, got %v", len(test.answers), test.name, dns.TypeToString[test.qtype], answer.Answer)
+		}
+		for i, rrType := range test.answers {
+			if rr := answer.Answer[i]; rr.Header().Rrtype != rrType || (i == 0 && rr.Header().Name != test.name) {
+				t.Fatalf("Expected a %s answer for %s, got %v", dns.TypeToString[rrType], test.name, rr)
+			}
+		}
+		if test.ns == 0 && len(answer.Ns) > 0 {
+			t.Fatalf("Didn't expect any authority records for %s %s, got %v", test.name, dns.TypeToString[test.qtype], answer.Ns)
+		} else if test.ns != 0 && (len(answer.Ns) == 0 || answer.Ns[0].Header().Rrtype != test.ns) {
+			t.Fatalf("Expected %s in the authority section for %s %s, got %v", dns.TypeToString[test.ns], test.name, dns.TypeToString[test.qtype], answer.Ns)
+		}
+	}
+}
+
 func TestAnswerQuestionTTL(t *testing.T) {
 	resolver.etcdPrefix = "TestAnswerQuestionTTL/"
-	client.Set("TestAnswerQuestionTTL/net/disco/bar/.A", "1.2.3.4", 0)
-	client.Set("TestAnswerQuestionTTL/net/disco/bar/.A.ttl", "300", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAnswerQuestionTTL/net/disco/bar/.A", "1.2.3.4")
+	store.Set("TestAnswerQuestionTTL/net/disco/bar/.A.ttl", "300")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, _ := resolver.LookupAnswersForType("bar.disco.net.", dns.TypeA)
 
@@ -524,11 +721,11 @@ func TestAnswerQuestionTTL(t *testing.T) {
 
 func TestAnswerQuestionTTLMultipleRecords(t *testing.T) {
 	resolver.etcdPrefix = "TestAnswerQuestionTTLMultipleRecords/"
-	client.Set("TestAnswerQuestionTTLMultipleRecords/net/disco/bar/.A/0", "1.2.3.4", 0)
-	client.Set("TestAnswerQuestionTTLMultipleRecords/net/disco/bar/.A/0.ttl", "300", 0)
-	client.Set("TestAnswerQuestionTTLMultipleRecords/net/disco/bar/.A/1", "8.8.8.8", 0)
-	client.Set("TestAnswerQuestionTTLMultipleRecords/net/disco/bar/.A/1.ttl", "600", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAnswerQuestionTTLMultipleRecords/net/disco/bar/.A/0", "1.2.3.4")
+	store.Set("TestAnswerQuestionTTLMultipleRecords/net/disco/bar/.A/0.ttl", "300")
+	store.Set("TestAnswerQuestionTTLMultipleRecords/net/disco/bar/.A/1", "8.8.8.8")
+	store.Set("TestAnswerQuestionTTLMultipleRecords/net/disco/bar/.A/1.ttl", "600")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, _ := resolver.LookupAnswersForType("bar.disco.net.", dns.TypeA)
 
@@ -559,9 +756,9 @@ func TestAnswerQuestionTTLMultipleRecords(t *testing.T) {
 
 func TestAnswerQuestionTTLInvalidFormat(t *testing.T) {
 	resolver.etcdPrefix = "TestAnswerQuestionTTL/"
-	client.Set("TestAnswerQuestionTTL/net/disco/bar/.A", "1.2.3.4", 0)
-	client.Set("TestAnswerQuestionTTL/net/disco/bar/.A.ttl", "haha", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAnswerQuestionTTL/net/disco/bar/.A", "1.2.3.4")
+	store.Set("TestAnswerQuestionTTL/net/disco/bar/.A.ttl", "haha")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, _ := resolver.LookupAnswersForType("bar.disco.net.", dns.TypeA)
 
@@ -588,8 +785,8 @@ func TestAnswerQuestionTTLInvalidFormat(t *testing.T) {
 
 func TestAnswerQuestionTTLDanglingNode(t *testing.T) {
 	resolver.etcdPrefix = "TestAnswerQuestionTTLDanglingNode/"
-	client.Set("TestAnswerQuestionTTLDanglingNode/net/disco/bar/.TXT.ttl", "600", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAnswerQuestionTTLDanglingNode/net/disco/bar/.TXT.ttl", "600")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, _ := resolver.LookupAnswersForType("bar.disco.net.", dns.TypeTXT)
 
@@ -600,8 +797,8 @@ func TestAnswerQuestionTTLDanglingNode(t *testing.T) {
 
 func TestAnswerQuestionTTLDanglingDirNode(t *testing.T) {
 	resolver.etcdPrefix = "TestAnswerQuestionTTLDanglingDirNode/"
-	client.Set("TestAnswerQuestionTTLDanglingDirNode/net/disco/bar/.TXT/0.ttl", "600", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAnswerQuestionTTLDanglingDirNode/net/disco/bar/.TXT/0.ttl", "600")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, _ := resolver.LookupAnswersForType("bar.disco.net.", dns.TypeTXT)
 
@@ -612,10 +809,10 @@ func TestAnswerQuestionTTLDanglingDirNode(t *testing.T) {
 
 func TestAnswerQuestionTTLDanglingDirSibling(t *testing.T) {
 	resolver.etcdPrefix = "TestAnswerQuestionTTLDanglingDirSibling/"
-	client.Set("TestAnswerQuestionTTLDanglingDirSibling/net/disco/bar/.TXT/0.ttl", "100", 0)
-	client.Set("TestAnswerQuestionTTLDanglingDirSibling/net/disco/bar/.TXT/1", "foo bar", 0)
-	client.Set("TestAnswerQuestionTTLDanglingDirSibling/net/disco/bar/.TXT/1.ttl", "600", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestAnswerQuestionTTLDanglingDirSibling/net/disco/bar/.TXT/0.ttl", "100")
+	store.Set("TestAnswerQuestionTTLDanglingDirSibling/net/disco/bar/.TXT/1", "foo bar")
+	store.Set("TestAnswerQuestionTTLDanglingDirSibling/net/disco/bar/.TXT/1.ttl", "600")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, _ := resolver.LookupAnswersForType("bar.disco.net.", dns.TypeTXT)
 
@@ -647,8 +844,8 @@ func TestAnswerQuestionTTLDanglingDirSibling(t *testing.T) {
 
 func TestLookupAnswerForA(t *testing.T) {
 	resolver.etcdPrefix = "TestLookupAnswerForA/"
-	client.Set("TestLookupAnswerForA/net/disco/bar/.A", "1.2.3.4", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestLookupAnswerForA/net/disco/bar/.A", "1.2.3.4")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, _ := resolver.LookupAnswersForType("bar.disco.net.", dns.TypeA)
 
@@ -672,8 +869,8 @@ func TestLookupAnswerForA(t *testing.T) {
 
 func TestLookupAnswerForAAAA(t *testing.T) {
 	resolver.etcdPrefix = "TestLookupAnswerForAAAA/"
-	client.Set("TestLookupAnswerForAAAA/net/disco/bar/.AAAA", "::1", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestLookupAnswerForAAAA/net/disco/bar/.AAAA", "::1")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, _ := resolver.LookupAnswersForType("bar.disco.net.", dns.TypeAAAA)
 
@@ -697,8 +894,8 @@ func TestLookupAnswerForAAAA(t *testing.T) {
 
 func TestLookupAnswerForCNAME(t *testing.T) {
 	resolver.etcdPrefix = "TestLookupAnswerForCNAME/"
-	client.Set("TestLookupAnswerForCNAME/net/disco/bar/.CNAME", "cname.google.com.", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestLookupAnswerForCNAME/net/disco/bar/.CNAME", "cname.google.com.")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, _ := resolver.LookupAnswersForType("bar.disco.net.", dns.TypeCNAME)
 
@@ -722,8 +919,8 @@ func TestLookupAnswerForCNAME(t *testing.T) {
 
 func TestLookupAnswerForNS(t *testing.T) {
 	resolver.etcdPrefix = "TestLookupAnswerForNS/"
-	client.Set("TestLookupAnswerForNS/net/disco/bar/.NS", "dns.google.com.", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestLookupAnswerForNS/net/disco/bar/.NS", "dns.google.com.")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, _ := resolver.LookupAnswersForType("bar.disco.net.", dns.TypeNS)
 
@@ -747,8 +944,8 @@ func TestLookupAnswerForNS(t *testing.T) {
 
 func TestLookupAnswerForSOA(t *testing.T) {
 	resolver.etcdPrefix = "TestLookupAnswerForSOA/"
-	client.Set("TestLookupAnswerForSOA/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestLookupAnswerForSOA/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, _ := resolver.LookupAnswersForType("disco.net.", dns.TypeSOA)
 
@@ -787,11 +984,64 @@ func TestLookupAnswerForSOA(t *testing.T) {
 	}
 }
 
+func TestLookupAnswerForSOAWithSerial(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupAnswerForSOAWithSerial/"
+	store.Set("TestLookupAnswerForSOAWithSerial/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t2014091801\t3600\t600\t86400\t10")
+	defer store.Delete(resolver.etcdPrefix)
+
+	records, _ := resolver.LookupAnswersForType("disco.net.", dns.TypeSOA)
+
+	if len(records) != 1 {
+		t.Fatal("Expected one answer, got ", len(records))
+	}
+
+	rr := records[0].(*dns.SOA)
+	if rr.Serial != 2014091801 {
+		t.Fatal("Expected SERIAL to be 2014091801: ", rr.Serial)
+	}
+	if rr.Refresh != 3600 {
+		t.Fatal("Expected REFRESH to be 3600: ", rr.Refresh)
+	}
+	if rr.Minttl != 10 {
+		t.Fatal("Expected MINTTL to be 10: ", rr.Minttl)
+	}
+}
+
+func TestAuthoritySerial(t *testing.T) {
+	resolver.etcdPrefix = "TestAuthoritySerial/"
+	store.Set("TestAuthoritySerial/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	store.Set("TestAuthoritySerial/net/disco/bar/.A", "1.1.1.1")
+	defer store.Delete(resolver.etcdPrefix)
+
+	node, _ := store.Get("TestAuthoritySerial/net/disco/bar/.A")
+	soa := resolver.Authority("bar.disco.net.")
+	if soa == nil || soa.Serial != uint32(node.ModifiedIndex) {
+		t.Fatal("Expected serial to be the latest index in the zone: ", soa, node.ModifiedIndex)
+	}
+
+	// Changes outside of the zone don't affect the serial
+	store.Set("TestAuthoritySerial/net/other/.A", "1.1.1.2")
+	if serial := resolver.Authority("bar.disco.net.").Serial; serial != soa.Serial {
+		t.Fatal("Expected serial to be unchanged: ", serial, soa.Serial)
+	}
+
+	store.Set("TestAuthoritySerial/net/disco/bar/.A", "1.1.1.3")
+	if serial := resolver.Authority("bar.disco.net.").Serial; serial <= soa.Serial {
+		t.Fatal("Expected serial to increase: ", serial, soa.Serial)
+	}
+
+	// An explicit serial in the SOA record is used as is
+	store.Set("TestAuthoritySerial/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t2014091801\t3600\t600\t86400\t10")
+	if serial := resolver.Authority("bar.disco.net.").Serial; serial != 2014091801 {
+		t.Fatal("Expected serial to be 2014091801: ", serial)
+	}
+}
+
 func TestLookupAnswerForPTR(t *testing.T) {
 	resolver.etcdPrefix = "TestLookupAnswerForPTR/"
-	client.Set("TestLookupAnswerForPTR/net/disco/alias/.PTR/target1", "target1.disco.net.", 0)
-	client.Set("TestLookupAnswerForPTR/net/disco/alias/.PTR/target2", "target2.disco.net.", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestLookupAnswerForPTR/net/disco/alias/.PTR/target1", "target1.disco.net.")
+	store.Set("TestLookupAnswerForPTR/net/disco/alias/.PTR/target2", "target2.disco.net.")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, _ := resolver.LookupAnswersForType("alias.disco.net.", dns.TypePTR)
 
@@ -830,8 +1080,8 @@ func TestLookupAnswerForPTR(t *testing.T) {
 
 func TestLookupAnswerForPTRInvalidDomain(t *testing.T) {
 	resolver.etcdPrefix = "TestLookupAnswerForPTRInvalidDomain/"
-	client.Set("TestLookupAnswerForPTRInvalidDomain/net/disco/bad-alias/.PTR", "...", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestLookupAnswerForPTRInvalidDomain/net/disco/bad-alias/.PTR", "...")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, err := resolver.LookupAnswersForType("bad-alias.disco.net.", dns.TypePTR)
 
@@ -846,10 +1096,9 @@ func TestLookupAnswerForPTRInvalidDomain(t *testing.T) {
 
 func TestLookupAnswerForSRV(t *testing.T) {
 	resolver.etcdPrefix = "TestLookupAnswerForSRV/"
-	client.Set("TestLookupAnswerForSRV/net/disco/_tcp/_http/.SRV",
-		"100\t100\t80\tsome-webserver.disco.net",
-		0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestLookupAnswerForSRV/net/disco/_tcp/_http/.SRV",
+		"100\t100\t80\tsome-webserver.disco.net")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, _ := resolver.LookupAnswersForType("_http._tcp.disco.net.", dns.TypeSRV)
 
@@ -878,7 +1127,7 @@ func TestLookupAnswerForSRV(t *testing.T) {
 
 func TestLookupAnswerForSRVInvalidValues(t *testing.T) {
 	resolver.etcdPrefix = "TestLookupAnswerForSRVInvalidValues/"
-	defer client.Delete(resolver.etcdPrefix, true)
+	defer store.Delete(resolver.etcdPrefix)
 
 	var badValsMap = map[string]string{
 		"wrong-delimiter":    "10 10 80 foo.disco.net",
@@ -892,7 +1141,7 @@ func TestLookupAnswerForSRVInvalidValues(t *testing.T) {
 
 	for name, value := range badValsMap {
 
-		client.Set("TestLookupAnswerForSRVInvalidValues/net/disco/"+name+"/.SRV", value, 0)
+		store.Set("TestLookupAnswerForSRVInvalidValues/net/disco/"+name+"/.SRV", value)
 		records, err := resolver.LookupAnswersForType(name+".disco.net.", dns.TypeSRV)
 
 		if len(records) > 0 {
@@ -907,8 +1156,8 @@ func TestLookupAnswerForSRVInvalidValues(t *testing.T) {
 
 func TestLookupAnswerForMX(t *testing.T) {
 	resolver.etcdPrefix = "TestLookupAnswerForCNAME/"
-	client.Set("TestLookupAnswerForCNAME/net/disco/bar/.MX", "37\tmx.google.com.", 0)
-	defer client.Delete(resolver.etcdPrefix, true)
+	store.Set("TestLookupAnswerForCNAME/net/disco/bar/.MX", "37\tmx.google.com.")
+	defer store.Delete(resolver.etcdPrefix)
 
 	records, _ := resolver.LookupAnswersForType("bar.disco.net.", dns.TypeMX)
 
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+// How long it takes for a change to the keys in the store to be picked up by
+// every discodns server, as they reload their keys every minute
+const keyPropagationDelay = time.Minute
+
+// Key sizes to generate for each algorithm
+var keyBits = map[uint8]int{
+	dns.RSASHA256:       2048,
+	dns.RSASHA512:       2048,
+	dns.ECDSAP256SHA256: 256,
+	dns.ECDSAP384SHA384: 384,
+}
+
+// KeyManager generates and rolls over the DNSSEC keys of a set of zones, held
+// in the store beneath the same prefix the Signer reads them from. Every
+// discodns server can run one, as each change to a zone's keys is only made by
+// the server that manages to update the zone's rollover key first.
+//
+// Zone signing keys are rolled by pre-publication (RFC 7583 section 3.2). The
+// new key is published without signing anything until the DNSKEY records have
+// expired from caches, then takes over from the old key, which is kept in the
+// DNSKEY records until the signatures it made have expired too.
+//
+// Key signing keys are rolled with double signatures (RFC 7583 section 3.3.2).
+// The new key is published and signs the DNSKEY records alongside the old one
+// straight away, and the old key is removed once the parent zone has had time
+// to replace its DS record. The DS record for each new key signing key is
+// logged, stored next to the key and answered in the zone's CDS records.
+type KeyManager struct {
+	resolver   *Resolver
+	signer     *Signer
+	zones      []string
+	algorithm  uint8
+	zskLife    time.Duration
+	kskLife    time.Duration
+	dsDelay    time.Duration
+	keysPrefix string
+}
+
+// NewKeyManager creates a KeyManager for the given zones, generating keys with
+// the algorithm and rolling them over once they have been active for their
+// lifetime.
+func NewKeyManager(resolver *Resolver, signer *Signer, zones []string, algorithm uint8, zskLife time.Duration, kskLife time.Duration, dsDelay time.Duration) *KeyManager {
+	fqdnZones := make([]string, len(zones))
+	for i, zone := range zones {
+		fqdnZones[i] = dns.Fqdn(strings.ToLower(zone))
+	}
+	return &KeyManager{
+		resolver:   resolver,
+		signer:     signer,
+		zones:      fqdnZones,
+		algorithm:  algorithm,
+		zskLife:    zskLife,
+		kskLife:    kskLife,
+		dsDelay:    dsDelay,
+		keysPrefix: signer.keysPrefix}
+}
+
+// Run checks whether the keys of each zone need to change every interval,
+// blocking until the stop channel is closed.
+func (m *KeyManager) Run(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.Manage(time.Now())
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Manage makes any changes to the keys of each zone that are due at the given
+// time, reloading the signer's keys if anything changed.
+func (m *KeyManager) Manage(now time.Time) {
+	errorCounter := metrics.GetOrRegisterCounter("dnssec.rollover.error", metrics.DefaultRegistry)
+
+	changed := false
+	for _, zone := range m.zones {
+		zoneChanged, err := m.manageZone(zone, now)
+		if err != nil {
+			errorCounter.Inc(1)
+			logger.Printf("[WARNING] Failed to roll over DNSSEC keys for %s: %s", zone, err)
+		}
+		changed = changed || zoneChanged
+	}
+	if changed {
+		if err := m.signer.Load(); err != nil {
+			logger.Printf("[WARNING] Failed to reload DNSSEC keys: %s", err)
+		}
+	}
+}
+
+// managedKey is a key in the store along with the index of its state, so the
+// state can be updated without overwriting changes made by another server
+type managedKey struct {
+	*SigningKey
+	file       string
+	stateIndex uint64
+}
+
+// manageZone makes the changes that are due to the keys of a single zone,
+// returning true if any were made.
+func (m *KeyManager) manageZone(zone string, now time.Time) (bool, error) {
+	rolloverCounter := metrics.GetOrRegisterCounter("dnssec.rollover.started", metrics.DefaultRegistry)
+	retiredCounter := metrics.GetOrRegisterCounter("dnssec.rollover.retired", metrics.DefaultRegistry)
+
+	zoneKey := cleanKey(m.keysPrefix + nameToKey(zone, ""))
+	store, err := writableStore(m.resolver.store, zoneKey)
+	if err != nil {
+		return false, err
+	}
+	keys, lock, err := m.zoneKeys(zoneKey)
+	if err != nil {
+		return false, err
+	}
+
+	// Work out what needs doing before taking the lock. Keys that were added
+	// without a state are treated as having been activated now, so that they
+	// aren't all rolled over at once.
+	var expired, adopted []*managedKey
+	var ksks, zsks []*managedKey
+	for _, key := range keys {
+		if key.stateIndex == 0 {
+			key.Activate = now
+			adopted = append(adopted, key)
+		}
+		if !key.Delete.IsZero() && !now.Before(key.Delete) {
+			expired = append(expired, key)
+		} else if key.isKSK() {
+			ksks = append(ksks, key)
+		} else {
+			zsks = append(zsks, key)
+		}
+	}
+	rollKSK, oldKSK := needsRollover(ksks, m.kskLife, now)
+	rollZSK, oldZSK := needsRollover(zsks, m.zskLife, now)
+	if len(expired) == 0 && len(adopted) == 0 && !rollKSK && !rollZSK {
+		return false, nil
+	}
+
+	// Only one server can make the changes, the others will see them when
+	// they next check
+	if lock == nil {
+		err = store.Create(zoneKey+"/.rollover", fmt.Sprint(now.Unix()))
+	} else {
+		err = store.CompareAndSwap(zoneKey+"/.rollover", fmt.Sprint(now.Unix()), lock.ModifiedIndex)
+	}
+	if _, ok := err.(*CompareFailedError); ok {
+		debugMsg("Keys for ", zone, " are being changed by another server")
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	for _, key := range adopted {
+		if err := key.saveState(store); err != nil {
+			return true, err
+		}
+	}
+	for _, key := range expired {
+		logger.Printf("Removing DNSSEC key %d for %s", key.DNSKEY.KeyTag(), zone)
+		retiredCounter.Inc(1)
+		base := strings.TrimSuffix(key.file, ".key")
+		for _, suffix := range []string{".key", ".private", ".state", ".ds"} {
+			if err := store.Delete(base + suffix); err != nil {
+				if _, ok := err.(*KeyNotFoundError); !ok {
+					return true, err
+				}
+			}
+		}
+	}
+
+	maxTTL, err := m.zoneMaxTTL(zone)
+	if err != nil {
+		return true, err
+	}
+	publishDelay := time.Duration(dnskeyDefaultTTL)*time.Second + keyPropagationDelay
+
+	if rollZSK {
+		// The new key takes over once it's been published for long enough,
+		// and the old one is removed once its signatures have expired
+		rolloverCounter.Inc(1)
+		activate := now
+		if oldZSK != nil {
+			activate = now.Add(publishDelay)
+			oldZSK.Inactive = activate
+			oldZSK.Delete = activate.Add(maxTTL + keyPropagationDelay)
+			if err := oldZSK.saveState(store); err != nil {
+				return true, err
+			}
+		}
+		if err := m.createKey(store, zone, zoneKey, 256, now, activate); err != nil {
+			return true, err
+		}
+	}
+
+	if rollKSK {
+		// The new key signs straight away, and the old one is removed once the
+		// parent zone has replaced its DS record
+		rolloverCounter.Inc(1)
+		if oldKSK != nil {
+			oldKSK.Inactive = now.Add(publishDelay + m.dsDelay)
+			oldKSK.Delete = oldKSK.Inactive
+			if err := oldKSK.saveState(store); err != nil {
+				return true, err
+			}
+		}
+		if err := m.createKey(store, zone, zoneKey, 257, now, now); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// needsRollover returns true if a new key is needed, because there are no
+// keys still in use or the newest has reached the end of its lifetime. The key
+// being replaced is also returned, if there is one.
+func needsRollover(keys []*managedKey, lifetime time.Duration, now time.Time) (bool, *managedKey) {
+	var newest *managedKey
+	for _, key := range keys {
+		if !key.Inactive.IsZero() {
+			continue
+		}
+		if newest == nil || key.Activate.After(newest.Activate) {
+			newest = key
+		}
+	}
+	return newest == nil || !now.Before(newest.Activate.Add(lifetime)), newest
+}
+
+// zoneKeys reads the keys of a zone from the store, along with the key used to
+// make sure only one server changes them at once
+func (m *KeyManager) zoneKeys(zoneKey string) (keys []*managedKey, lock *Node, err error) {
+	root, err := m.resolver.store.Get(zoneKey)
+	if _, ok := err.(*KeyNotFoundError); ok {
+		return nil, nil, nil
+	} else if err != nil {
+		return
+	}
+
+	nodes := make(map[string]*Node)
+	for _, node := range root.Nodes {
+		nodes[path.Base(node.Key)] = node
+	}
+	lock = nodes[".rollover"]
+	for name, node := range nodes {
+		if path.Ext(name) != ".key" {
+			continue
+		}
+		base := strings.TrimSuffix(name, ".key")
+		private, state := nodes[base+".private"], nodes[base+".state"]
+		if private == nil {
+			continue
+		}
+		key, err := parseSigningKey(node.Value, private.Value, node.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		managed := &managedKey{SigningKey: key, file: node.Key}
+		if state != nil {
+			if err := key.parseKeyState(state.Value); err != nil {
+				return nil, nil, err
+			}
+			managed.stateIndex = state.ModifiedIndex
+		}
+		keys = append(keys, managed)
+	}
+	return
+}
+
+// zoneMaxTTL returns the highest TTL of any record in the zone, including the
+// negative answers (NSEC records) that are cached for the SOA minimum TTL.
+// This is how long resolvers might hold on to a signature after it was made.
+func (m *KeyManager) zoneMaxTTL(zone string) (time.Duration, error) {
+	soa, records, err := m.resolver.ZoneRecords(zone)
+	if err != nil {
+		return 0, err
+	}
+	maxTTL := uint32(dnskeyDefaultTTL)
+	if soa != nil {
+		records = append(records, soa)
+		if soa.Minttl > maxTTL {
+			maxTTL = soa.Minttl
+		}
+	}
+	for _, rr := range records {
+		if rr.Header().Ttl > maxTTL {
+			maxTTL = rr.Header().Ttl
+		}
+	}
+	return time.Duration(maxTTL) * time.Second, nil
+}
+
+// createKey generates a new key for the zone and writes it to the store
+func (m *KeyManager) createKey(store WritableRecordStore, zone string, zoneKey string, flags uint16, publish time.Time, activate time.Time) error {
+	bits, ok := keyBits[m.algorithm]
+	if !ok {
+		return fmt.Errorf("Unsupported key algorithm %s", dns.AlgorithmToString[m.algorithm])
+	}
+	dnskey := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: dnskeyDefaultTTL},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: m.algorithm}
+	private, err := dnskey.Generate(bits)
+	if err != nil {
+		return err
+	}
+	key := &managedKey{
+		SigningKey: &SigningKey{DNSKEY: dnskey, Private: private.(crypto.Signer), Publish: publish, Activate: activate},
+		file:       fmt.Sprintf("%s/%d.key", zoneKey, dnskey.KeyTag())}
+
+	// Writing the key last means it isn't loaded until it's complete
+	if err := store.Create(key.stateFile(), key.keyState()); err != nil {
+		return err
+	}
+	if err := store.Create(strings.TrimSuffix(key.file, ".key")+".private", dnskey.PrivateKeyString(private)); err != nil {
+		return err
+	}
+	if key.isKSK() {
+		ds := dnskey.ToDS(dns.SHA256)
+		logger.Printf("Created DNSSEC key signing key %d for %s, the parent zone needs the DS record: %s", dnskey.KeyTag(), zone, ds)
+		if err := store.Create(strings.TrimSuffix(key.file, ".key")+".ds", ds.String()); err != nil {
+			return err
+		}
+	} else {
+		logger.Printf("Created DNSSEC zone signing key %d for %s", dnskey.KeyTag(), zone)
+	}
+	return store.Create(key.file, dnskey.String())
+}
+
+// stateFile returns the key in the store holding the key's state
+func (k *managedKey) stateFile() string {
+	return strings.TrimSuffix(k.file, ".key") + ".state"
+}
+
+// saveState writes the key's state to the store, as long as it hasn't been
+// changed since it was read
+func (k *managedKey) saveState(store WritableRecordStore) error {
+	if k.stateIndex == 0 {
+		return store.Create(k.stateFile(), k.keyState())
+	}
+	return store.CompareAndSwap(k.stateFile(), k.keyState(), k.stateIndex)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testKeysZone = "/_dnssec/net/disco"
+
+func newTestKeyManager(t *testing.T, keyStore RecordStore) *KeyManager {
+	signer, err := NewSigner(keyStore, "", "/_dnssec", time.Hour, 10)
+	if err != nil {
+		t.Fatal("Unable to create signer: ", err)
+	}
+	resolver := &Resolver{store: keyStore}
+	return NewKeyManager(resolver, signer, []string{"Disco.net"}, dns.ECDSAP256SHA256, 30*24*time.Hour, 365*24*time.Hour, 48*time.Hour)
+}
+
+// newTestKeyStore returns a store holding a zone whose longest TTL is 2 hours
+func newTestKeyStore() *MemoryStore {
+	keyStore := NewMemoryStore()
+	keyStore.Set("/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	keyStore.Set("/net/disco/.SOA.ttl", "7200")
+	keyStore.Set("/net/disco/www/.A", "1.1.1.1")
+	return keyStore
+}
+
+// testManagedKeys returns the key signing and zone signing keys held in the
+// store, with the oldest first
+func testManagedKeys(t *testing.T, manager *KeyManager) (ksks []*managedKey, zsks []*managedKey) {
+	keys, _, err := manager.zoneKeys(testKeysZone)
+	if err != nil {
+		t.Fatal("Unable to read keys: ", err)
+	}
+	for _, key := range keys {
+		if key.isKSK() {
+			ksks = append(ksks, key)
+		} else {
+			zsks = append(zsks, key)
+		}
+	}
+	for _, list := range [][]*managedKey{ksks, zsks} {
+		if len(list) == 2 && list[1].Activate.Before(list[0].Activate) {
+			list[0], list[1] = list[1], list[0]
+		}
+	}
+	return
+}
+
+func TestKeyManagerRollover(t *testing.T) {
+	keyStore := newTestKeyStore()
+	manager := newTestKeyManager(t, keyStore)
+	start := time.Unix(time.Now().Unix(), 0)
+	publishDelay := time.Hour + keyPropagationDelay
+
+	// The first keys are active straight away
+	manager.Manage(start)
+	ksks, zsks := testManagedKeys(t, manager)
+	if len(ksks) != 1 || len(zsks) != 1 {
+		t.Fatal("Expected a key signing key and a zone signing key: ", ksks, zsks)
+	}
+	for _, key := range append(ksks, zsks...) {
+		if !key.Publish.Equal(start) || !key.Activate.Equal(start) || !key.Inactive.IsZero() || !key.Delete.IsZero() {
+			t.Fatal("Expected the key to be published and active from the start: ", key.keyState())
+		}
+	}
+	if ds, err := keyStore.Get(strings.TrimSuffix(ksks[0].file, ".key") + ".ds"); err != nil || !strings.Contains(ds.Value, "IN\tDS\t") {
+		t.Fatal("Expected the DS record of the key signing key to be stored: ", ds, err)
+	}
+	if keys := manager.signer.KeyRecords("disco.net.", dns.TypeDNSKEY); len(keys) != 2 {
+		t.Fatal("Expected the signer to load the new keys: ", keys)
+	}
+	if cds := manager.signer.KeyRecords("disco.net.", dns.TypeCDS); len(cds) != 1 || cds[0].(*dns.CDS).KeyTag != ksks[0].DNSKEY.KeyTag() {
+		t.Fatal("Expected a CDS record for the key signing key: ", cds)
+	}
+
+	lock, _ := keyStore.Get(testKeysZone + "/.rollover")
+	manager.Manage(start.Add(time.Hour))
+	if again, _ := keyStore.Get(testKeysZone + "/.rollover"); again.ModifiedIndex != lock.ModifiedIndex {
+		t.Fatal("Expected nothing to change before the keys reach the end of their lifetime")
+	}
+
+	// A new zone signing key is published before it takes over, and the old
+	// one is kept until its signatures have expired
+	rollover := start.Add(30 * 24 * time.Hour)
+	manager.Manage(rollover)
+	_, zsks = testManagedKeys(t, manager)
+	if len(zsks) != 2 {
+		t.Fatal("Expected a new zone signing key: ", zsks)
+	}
+	old, next := zsks[0], zsks[1]
+	if !next.Publish.Equal(rollover) || !next.Activate.Equal(rollover.Add(publishDelay)) {
+		t.Fatal("Expected the new key to be published before it's activated: ", next.keyState())
+	}
+	if !old.Inactive.Equal(next.Activate) || !old.Delete.Equal(next.Activate.Add(2*time.Hour+keyPropagationDelay)) {
+		t.Fatal("Expected the old key to be retired once the new one is active: ", old.keyState())
+	}
+
+	manager.Manage(old.Delete)
+	if _, zsks = testManagedKeys(t, manager); len(zsks) != 1 || zsks[0].DNSKEY.KeyTag() != next.DNSKEY.KeyTag() {
+		t.Fatal("Expected the old zone signing key to be removed: ", zsks)
+	}
+	if _, err := keyStore.Get(strings.TrimSuffix(old.file, ".key") + ".private"); err == nil {
+		t.Fatal("Expected the old private key to be removed")
+	}
+
+	// A new key signing key signs straight away, alongside the old one until
+	// the parent zone has had time to replace the DS record
+	rollover = start.Add(365 * 24 * time.Hour)
+	manager.Manage(rollover)
+	ksks, _ = testManagedKeys(t, manager)
+	if len(ksks) != 2 {
+		t.Fatal("Expected a new key signing key: ", ksks)
+	}
+	oldKSK, nextKSK := ksks[0], ksks[1]
+	if !nextKSK.Activate.Equal(rollover) || !nextKSK.Inactive.IsZero() {
+		t.Fatal("Expected the new key signing key to be active straight away: ", nextKSK.keyState())
+	}
+	if retire := rollover.Add(publishDelay + 48*time.Hour); !oldKSK.Inactive.Equal(retire) || !oldKSK.Delete.Equal(retire) {
+		t.Fatal("Expected the old key signing key to be removed after the DS delay: ", oldKSK.keyState())
+	}
+
+	manager.Manage(oldKSK.Delete)
+	if ksks, _ = testManagedKeys(t, manager); len(ksks) != 1 || ksks[0].DNSKEY.KeyTag() != nextKSK.DNSKEY.KeyTag() {
+		t.Fatal("Expected the old key signing key to be removed: ", ksks)
+	}
+	if _, err := keyStore.Get(strings.TrimSuffix(oldKSK.file, ".key") + ".ds"); err == nil {
+		t.Fatal("Expected the old DS record to be removed")
+	}
+}
+
+func TestKeyManagerAdoptsKeys(t *testing.T) {
+	keyStore := newTestKeyStore()
+	_, public, private := newTestSigningKey(t, "disco.net.", 256)
+	keyStore.Set(testKeysZone+"/1.key", public)
+	keyStore.Set(testKeysZone+"/1.private", private)
+
+	manager := newTestKeyManager(t, keyStore)
+	now := time.Unix(time.Now().Unix(), 0)
+	manager.Manage(now)
+
+	_, zsks := testManagedKeys(t, manager)
+	if len(zsks) != 1 || zsks[0].stateIndex == 0 || !zsks[0].Activate.Equal(now) {
+		t.Fatal("Expected the existing key to be given a state, rather than replaced: ", zsks)
+	}
+}
+
+// racingStore is a store where another server takes the rollover lock of a
+// zone every time its keys are read
+type racingStore struct {
+	*MemoryStore
+}
+
+func (s racingStore) Get(key string) (*Node, error) {
+	node, err := s.MemoryStore.Get(key)
+	if key == testKeysZone {
+		s.MemoryStore.Set(testKeysZone+"/.rollover", "0")
+	}
+	return node, err
+}
+
+func TestKeyManagerLocked(t *testing.T) {
+	keyStore := newTestKeyStore()
+	manager := newTestKeyManager(t, racingStore{keyStore})
+	manager.Manage(time.Now())
+
+	if keys, _, _ := manager.zoneKeys(testKeysZone); len(keys) != 0 {
+		t.Fatal("Expected no keys to be created without the lock: ", keys)
+	}
+}
+
+func TestSignerKeyTimes(t *testing.T) {
+	now := time.Now()
+	ksk, _, _ := newTestSigningKey(t, "disco.net.", 257)
+	zsk, _, _ := newTestSigningKey(t, "disco.net.", 256)
+	pending, _, _ := newTestSigningKey(t, "disco.net.", 256)
+	retired, _, _ := newTestSigningKey(t, "disco.net.", 256)
+	pending.Activate = now.Add(time.Hour)
+	retired.Inactive = now.Add(-time.Hour)
+	deleted, _, _ := newTestSigningKey(t, "disco.net.", 256)
+	deleted.Delete = now.Add(-time.Hour)
+	signer := newTestSigner(ksk, zsk, pending, retired, deleted)
+
+	if keys := signer.KeyRecords("disco.net.", dns.TypeDNSKEY); len(keys) != 4 {
+		t.Fatal("Expected all but the deleted key to be published: ", keys)
+	}
+	if keys := signer.KeyRecords("disco.net.", dns.TypeCDNSKEY); len(keys) != 1 || keys[0].(*dns.CDNSKEY).Flags != 257 {
+		t.Fatal("Expected a CDNSKEY record for the key signing key only: ", keys)
+	}
+
+	sigs := signer.Sign([]dns.RR{newTestRR(t, "www.disco.net. 300 IN A 1.1.1.1")})
+	if len(sigs) != 1 || sigs[0].(*dns.RRSIG).KeyTag != zsk.DNSKEY.KeyTag() {
+		t.Fatal("Expected only the active zone signing key to sign: ", sigs)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Route describes which backends the records for a zone (and everything
+// beneath it, unless a more specific route exists) are served from.
+//
+// When a route has more than one backend they are overlaid in order of
+// precedence. By default the first backend holding a record set (for example
+// /net/disco/.A) provides the whole set, hiding that record set in any later
+// backends. If Merge is set, the record sets of every backend are combined
+// instead. Either way, names only present in later backends are still served.
+type Route struct {
+	Zone     string
+	Backends []string
+	Merge    bool
+
+	key    string
+	stores []RecordStore
+}
+
+// RoutingStore is a RecordStore that dispatches each key to the backends of
+// the most specific Route covering it.
+type RoutingStore struct {
+	routes []*Route
+}
+
+// NewRoutingStore creates a RoutingStore for the given routes, looking up the
+// backends named by each route in the given map.
+func NewRoutingStore(routes []*Route, backends map[string]RecordStore) (*RoutingStore, error) {
+	for _, route := range routes {
+		route.Zone = dns.Fqdn(strings.ToLower(route.Zone))
+		route.key = cleanKey(nameToKey(route.Zone, ""))
+		route.stores = nil
+		for _, name := range route.Backends {
+			store, ok := backends[name]
+			if !ok {
+				return nil, fmt.Errorf("Unknown backend '%s' for zone %s", name, route.Zone)
+			}
+			route.stores = append(route.stores, store)
+		}
+		if len(route.stores) == 0 {
+			return nil, fmt.Errorf("No backends given for zone %s", route.Zone)
+		}
+	}
+
+	sorted := make([]*Route, len(routes))
+	copy(sorted, routes)
+	sortRoutes(sorted)
+	return &RoutingStore{routes: sorted}, nil
+}
+
+// sortRoutes sorts routes with the most specific (longest) zone first
+func sortRoutes(routes []*Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].key) > len(routes[j].key)
+	})
+}
+
+// Get implements RecordStore
+func (s *RoutingStore) Get(key string) (*Node, error) {
+	key = cleanKey(key)
+	route := s.route(key)
+
+	var node *Node
+	if route != nil {
+		var err error
+		if node, err = route.get(key); err != nil {
+			return nil, err
+		}
+	}
+
+	// Routes for zones beneath the key replace whatever the covering route
+	// has for them. Graft them in from the least to the most specific.
+	root := &Node{Key: "/", Dir: true}
+	if node != nil {
+		if key == "/" {
+			root = node
+		} else {
+			root.insert(node)
+		}
+	}
+	grafted := false
+	for i := len(s.routes) - 1; i >= 0; i-- {
+		child := s.routes[i]
+		if child.key == key || !keyWithin(child.key, key) {
+			continue
+		}
+		childNode, err := child.get(child.key)
+		if err != nil {
+			return nil, err
+		}
+		root.remove(child.key)
+		if childNode != nil {
+			if _, err := root.insert(childNode); err != nil {
+				return nil, err
+			}
+			grafted = true
+		}
+	}
+
+	if node == nil && !grafted {
+		return nil, &KeyNotFoundError{Key: key}
+	}
+	if node = root.find(key); node == nil {
+		return nil, &KeyNotFoundError{Key: key}
+	}
+	return node, nil
+}
+
+// Watch implements RecordStore. A watch is started on every backend, and
+// events are passed on for keys routed to that backend. Backends each have
+// their own independent index, so the waitIndex is only passed on when there's
+// a single backend; otherwise every backend is watched from its current index.
+// If any backend's watch fails, the others are stopped and the error returned.
+func (s *RoutingStore) Watch(key string, waitIndex uint64, events chan *StoreEvent, stop chan bool) error {
+	defer close(events)
+	key = cleanKey(key)
+
+	var stores []RecordStore
+	seen := make(map[RecordStore]bool)
+	for _, route := range s.routes {
+		for _, store := range route.stores {
+			if !seen[store] {
+				seen[store] = true
+				stores = append(stores, store)
+			}
+		}
+	}
+	if len(stores) > 1 {
+		waitIndex = 0
+	}
+
+	// The first watch to end (or the caller stopping) stops all of them
+	var once sync.Once
+	var watchErr error
+	halt := make(chan bool)
+	end := func(err error) {
+		once.Do(func() {
+			watchErr = err
+			close(halt)
+		})
+	}
+	go func() {
+		select {
+		case <-stop:
+			end(nil)
+		case <-halt:
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for _, store := range stores {
+		wg.Add(2)
+		storeEvents := make(chan *StoreEvent)
+		go func(store RecordStore) {
+			defer wg.Done()
+			end(store.Watch(key, waitIndex, storeEvents, halt))
+		}(store)
+		go func(store RecordStore) {
+			defer wg.Done()
+			for event := range storeEvents {
+				route := s.route(cleanKey(event.Node.Key))
+				if route == nil || !route.hasStore(store) {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-halt:
+				}
+			}
+		}(store)
+	}
+	wg.Wait()
+	end(nil)
+	return watchErr
+}
+
+// Create implements WritableRecordStore, writing to the first backend of the
+// route covering the key.
+func (s *RoutingStore) Create(key string, value string) error {
+	store, err := s.writableStore(key)
+	if err != nil {
+		return err
+	}
+	return store.Create(key, value)
+}
+
+// CompareAndSwap implements WritableRecordStore, writing to the first backend
+// of the route covering the key.
+func (s *RoutingStore) CompareAndSwap(key string, value string, prevIndex uint64) error {
+	store, err := s.writableStore(key)
+	if err != nil {
+		return err
+	}
+	return store.CompareAndSwap(key, value, prevIndex)
+}
+
+// CompareAndDelete implements WritableRecordStore, writing to the first backend
+// of the route covering the key.
+func (s *RoutingStore) CompareAndDelete(key string, prevIndex uint64) error {
+	store, err := s.writableStore(key)
+	if err != nil {
+		return err
+	}
+	return store.CompareAndDelete(key, prevIndex)
+}
+
+// Delete implements WritableRecordStore, deleting the key from the first
+// backend of the route covering the key.
+func (s *RoutingStore) Delete(key string) error {
+	store, err := s.writableStore(key)
+	if err != nil {
+		return err
+	}
+	return store.Delete(key)
+}
+
+// writableStore returns the store that writes to the key should go to, the
+// first backend of the route covering it.
+func (s *RoutingStore) writableStore(key string) (WritableRecordStore, error) {
+	route := s.route(cleanKey(key))
+	if route == nil {
+		return nil, &ReadOnlyError{Key: key}
+	}
+	return writableStore(route.stores[0], key)
+}
+
+// uncached returns a copy of the store whose routes read from the backends
+// without going through any caches
+func (s *RoutingStore) uncached() *RoutingStore {
+	routes := make([]*Route, len(s.routes))
+	for i, route := range s.routes {
+		uncached := *route
+		uncached.stores = make([]RecordStore, len(route.stores))
+		for j, store := range route.stores {
+			uncached.stores[j] = uncachedStore(store)
+		}
+		routes[i] = &uncached
+	}
+	return &RoutingStore{routes: routes}
+}
+
+// withPrefix returns a copy of the store that also routes the keys beneath a
+// prefix (such as that of a view) by the zone they're for, as if the prefix
+// wasn't there. Keys outside of the prefix are routed as they were.
+func (s *RoutingStore) withPrefix(prefix string) *RoutingStore {
+	if cleanKey(prefix) == "/" {
+		return s
+	}
+	routes := make([]*Route, 0, 2*len(s.routes))
+	for _, route := range s.routes {
+		prefixed := *route
+		prefixed.key = cleanKey(path.Join(prefix, route.key))
+		routes = append(routes, route, &prefixed)
+	}
+	sortRoutes(routes)
+	return &RoutingStore{routes: routes}
+}
+
+// route returns the most specific route covering the key, or nil
+func (s *RoutingStore) route(key string) *Route {
+	for _, route := range s.routes {
+		if keyWithin(key, route.key) {
+			return route
+		}
+	}
+	return nil
+}
+
+// hasStore returns true if the store is one of the route's backends
+func (r *Route) hasStore(store RecordStore) bool {
+	for _, s := range r.stores {
+		if s == store {
+			return true
+		}
+	}
+	return false
+}
+
+// get reads the key from each of the route's backends and overlays them,
+// returning nil if none of them have it.
+func (r *Route) get(key string) (*Node, error) {
+	nodes := make([]*Node, len(r.stores))
+	ttls := make([]*Node, len(r.stores))
+	for i, store := range r.stores {
+		node, err := store.Get(key)
+		if _, ok := err.(*KeyNotFoundError); ok {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		nodes[i] = node
+
+		// Merging single key record sets turns them into a directory, so
+		// bring along the .ttl key that would otherwise be lost
+		if r.Merge && !node.Dir && isRecordSetKey(key) {
+			ttls[i], _ = store.Get(key + ".ttl")
+		}
+	}
+	return r.overlay(key, nodes, ttls), nil
+}
+
+// overlay combines the nodes each backend holds for the same key, in order of
+// precedence. Missing nodes are nil. The ttls hold the .ttl siblings of any
+// nodes that are single key record sets.
+func (r *Route) overlay(key string, nodes []*Node, ttls []*Node) *Node {
+	var found []int
+	for i, node := range nodes {
+		if node != nil {
+			found = append(found, i)
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	} else if len(found) == 1 {
+		return nodes[found[0]]
+	}
+
+	if isRecordSetKey(key) {
+		if !r.Merge || strings.HasSuffix(key, ".ttl") {
+			return nodes[found[0]]
+		}
+
+		// Give each backend its own directory within the record set, so
+		// that their keys can't collide
+		merged := &Node{Key: key, Dir: true}
+		for _, i := range found {
+			merged.addChild(rekeyNode(nodes[i], key, key+"/"+r.Backends[i]))
+			if ttls[i] != nil {
+				merged.addChild(rekeyNode(ttls[i], key+".ttl", key+"/"+r.Backends[i]+".ttl"))
+			}
+			if nodes[i].ModifiedIndex > merged.ModifiedIndex {
+				merged.ModifiedIndex = nodes[i].ModifiedIndex
+			}
+		}
+		return merged
+	}
+
+	// A value can't be merged with anything, so the first one wins
+	for _, i := range found {
+		if !nodes[i].Dir {
+			return nodes[i]
+		}
+	}
+
+	merged := &Node{Key: key, Dir: true}
+	var names []string
+	children := make(map[string][]*Node)
+	for _, i := range found {
+		if nodes[i].ModifiedIndex > merged.ModifiedIndex {
+			merged.ModifiedIndex = nodes[i].ModifiedIndex
+		}
+		for _, child := range nodes[i].Nodes {
+			name := path.Base(child.Key)
+			if _, ok := children[name]; !ok {
+				names = append(names, name)
+				children[name] = make([]*Node, len(nodes))
+			}
+			children[name][i] = child
+		}
+	}
+	for _, name := range names {
+		childTtls := make([]*Node, len(nodes))
+		if ttlNodes, ok := children[name+".ttl"]; ok {
+			copy(childTtls, ttlNodes)
+		}
+		merged.addChild(r.overlay(path.Join(key, name), children[name], childTtls))
+	}
+	return merged
+}
+
+// isRecordSetKey returns true if the key refers to a record set, such as
+// /net/disco/.A (or its TTL, /net/disco/.A.ttl)
+func isRecordSetKey(key string) bool {
+	return strings.HasPrefix(path.Base(key), ".")
+}
+
+// rekeyNode returns a copy of the node (and its children) moved from one key
+// to another.
+func rekeyNode(node *Node, from string, to string) *Node {
+	moved := node.copy()
+	var rekey func(n *Node)
+	rekey = func(n *Node) {
+		n.Key = path.Join(to, strings.TrimPrefix(n.Key, from))
+		for _, child := range n.Nodes {
+			rekey(child)
+		}
+	}
+	rekey(moved)
+	return moved
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestRoutingStore creates a routing store over two memory stores
+func newTestRoutingStore(t *testing.T, routes ...*Route) (*RoutingStore, *MemoryStore, *MemoryStore) {
+	first := NewMemoryStore()
+	second := NewMemoryStore()
+	routingStore, err := NewRoutingStore(routes, map[string]RecordStore{"first": first, "second": second})
+	if err != nil {
+		t.Fatal("Failed to create routing store", err)
+	}
+	return routingStore, first, second
+}
+
+func TestRoutingStoreUnknownBackend(t *testing.T) {
+	_, err := NewRoutingStore([]*Route{{Zone: ".", Backends: []string{"missing"}}}, map[string]RecordStore{})
+	if err == nil {
+		t.Fatal("Expected an error for an unknown backend")
+	}
+}
+
+func TestRoutingStoreZoneSuffix(t *testing.T) {
+	routingStore, first, second := newTestRoutingStore(t,
+		&Route{Zone: ".", Backends: []string{"first"}},
+		&Route{Zone: "static.disco.net.", Backends: []string{"second"}})
+
+	first.Set("/net/disco/.A", "1.1.1.1")
+	first.Set("/net/disco/static/.A", "1.1.1.2")
+	second.Set("/net/disco/static/.A", "2.2.2.2")
+	second.Set("/net/disco/.A", "2.2.2.1")
+
+	node, err := routingStore.Get("/net/disco/.A")
+	if err != nil || node.Value != "1.1.1.1" {
+		t.Fatal("Expected disco.net. to be served from the first store: ", node, err)
+	}
+	node, err = routingStore.Get("/net/disco/static/.A")
+	if err != nil || node.Value != "2.2.2.2" {
+		t.Fatal("Expected static.disco.net. to be served from the second store: ", node, err)
+	}
+
+	// Walking the tree from above the zone should see the zone's own records
+	node, err = routingStore.Get("/net/disco")
+	if err != nil {
+		t.Fatal("Error returned from store", err)
+	}
+	values := make(map[string]string)
+	for _, leaf := range node.Leaves() {
+		values[leaf.Key] = leaf.Value
+	}
+	if values["/net/disco/.A"] != "1.1.1.1" || values["/net/disco/static/.A"] != "2.2.2.2" {
+		t.Fatal("Expected the subtree to be grafted from each route: ", values)
+	}
+}
+
+func TestRoutingStoreOverlayFirst(t *testing.T) {
+	routingStore, first, second := newTestRoutingStore(t,
+		&Route{Zone: "lab.disco.net.", Backends: []string{"first", "second"}})
+
+	first.Set("/net/disco/lab/.A/0", "1.1.1.1")
+	second.Set("/net/disco/lab/.A/0", "2.2.2.1")
+	second.Set("/net/disco/lab/.A/1", "2.2.2.2")
+	second.Set("/net/disco/lab/www/.A", "2.2.2.3")
+
+	routingResolver := &Resolver{store: routingStore}
+
+	records, _ := routingResolver.LookupAnswersForType("lab.disco.net.", dns.TypeA)
+	if len(records) != 1 || records[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Fatal("Expected only the record set from the first store: ", records)
+	}
+
+	records, _ = routingResolver.LookupAnswersForType("www.lab.disco.net.", dns.TypeA)
+	if len(records) != 1 || records[0].(*dns.A).A.String() != "2.2.2.3" {
+		t.Fatal("Expected names missing from the first store to come from the second: ", records)
+	}
+
+	if _, err := routingStore.Get("/net/disco/other/.A"); err == nil {
+		t.Fatal("Expected keys outside of any route to be missing")
+	}
+}
+
+func TestRoutingStoreOverlayMerge(t *testing.T) {
+	routingStore, first, second := newTestRoutingStore(t,
+		&Route{Zone: "lab.disco.net.", Backends: []string{"first", "second"}, Merge: true})
+
+	first.Set("/net/disco/lab/.A", "1.1.1.1")
+	first.Set("/net/disco/lab/.A.ttl", "60")
+	second.Set("/net/disco/lab/.A/0", "2.2.2.1")
+
+	routingResolver := &Resolver{store: routingStore}
+	records, err := routingResolver.LookupAnswersForType("lab.disco.net.", dns.TypeA)
+	if err != nil {
+		t.Fatal("Error returned from resolver", err)
+	}
+	if len(records) != 2 {
+		t.Fatal("Expected the record sets to be merged: ", records)
+	}
+	if records[0].(*dns.A).A.String() != "1.1.1.1" || records[0].Header().Ttl != 60 {
+		t.Fatal("Expected 1.1.1.1 with a TTL of 60: ", records[0])
+	}
+	if records[1].(*dns.A).A.String() != "2.2.2.1" {
+		t.Fatal("Expected 2.2.2.1: ", records[1])
+	}
+
+	// The same should happen when walking the tree
+	node, err := routingStore.Get("/net/disco/lab")
+	if err != nil {
+		t.Fatal("Error returned from store", err)
+	}
+	if len(node.Leaves()) != 4 {
+		t.Fatal("Expected both record sets within the tree: ", node.Leaves())
+	}
+}
+
+// brokenWatchStore is a store whose watches fail straight away
+type brokenWatchStore struct {
+	*MemoryStore
+	waitIndex uint64
+}
+
+func (s *brokenWatchStore) Watch(key string, waitIndex uint64, events chan *StoreEvent, stop chan bool) error {
+	s.waitIndex = waitIndex
+	close(events)
+	return errors.New("watch failed")
+}
+
+func TestRoutingStoreWatchFails(t *testing.T) {
+	broken := &brokenWatchStore{MemoryStore: NewMemoryStore()}
+	routingStore, err := NewRoutingStore([]*Route{
+		{Zone: ".", Backends: []string{"working"}},
+		{Zone: "static.disco.net.", Backends: []string{"broken"}}},
+		map[string]RecordStore{"working": NewMemoryStore(), "broken": broken})
+	if err != nil {
+		t.Fatal("Failed to create routing store", err)
+	}
+
+	// The watch on the working backend is stopped, even though the caller
+	// never stops the watch itself
+	done := make(chan error)
+	go func() {
+		done <- routingStore.Watch("/", 5, make(chan *StoreEvent), nil)
+	}()
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "watch failed" {
+			t.Fatal("Expected the backend's error, got ", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the watch to fail")
+	}
+
+	// The index of one backend means nothing to another
+	if broken.waitIndex != 0 {
+		t.Fatal("Expected backends to be watched from their current index, got ", broken.waitIndex)
+	}
+}
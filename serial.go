@@ -0,0 +1,413 @@
+package main
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+// The key beneath a zone holding the serial number of its SOA record, when the
+// record doesn't have one of its own
+const serialKey = ".SOA.serial"
+
+// How long to wait before restarting the watch for zone serials after it fails
+const serialRetryInterval = time.Second
+
+// How long a serial read from the store is used for while the watch for zone
+// serials is down
+const serialCacheInterval = time.Second
+
+// ZoneSerials keeps the serial numbers of zones whose SOA records don't have
+// one set. The serial of a zone is the index of the latest change to any key
+// within it (not counting child zones), deletions included, so it goes up
+// whenever the zone changes and every discodns server reading from the same
+// store agrees on it.
+//
+// Deleting a key leaves no trace in the store, so deletions are found by
+// watching it and their index is written beneath the zone (to the .SOA.serial
+// key) so that the serial never goes backwards, even across restarts. Serials
+// are only read from the store once, and kept in memory while the watch is
+// running (and briefly while it isn't). The store is never read or written
+// while holding the lock, so queries don't wait on each other for it.
+//
+// The apex of every zone (each key with an SOA record) is also kept in memory
+// while the watch is running, so the zone a changed key belongs to can be
+// found without reading the store.
+//
+// The zones of a view change along with the default zones they fall back to,
+// so the serial of a zone in a view is never lower than the default serial.
+type ZoneSerials struct {
+	sync.Mutex
+	resolver *Resolver
+	fallback *ZoneSerials
+	serials  map[string]*zoneSerial
+	apexes   map[string]*zoneApex
+	watching bool
+}
+
+// zoneSerial is the serial of a zone, and when it was read from the store
+type zoneSerial struct {
+	serial uint32
+	loaded time.Time
+}
+
+// zoneApex records whether a key is the apex of a zone, as of the index of the
+// latest change to its SOA record
+type zoneApex struct {
+	exists bool
+	index  uint64
+}
+
+// NewZoneSerials creates a ZoneSerials for the zones served by the resolver
+func NewZoneSerials(resolver *Resolver) *ZoneSerials {
+	return &ZoneSerials{
+		resolver: resolver,
+		serials:  make(map[string]*zoneSerial)}
+}
+
+// Run watches the store for changes, blocking until the stop channel is
+// closed. Changes can be missed while the watch is down, so serials are read
+// from the store again whenever it fails.
+func (s *ZoneSerials) Run(stop chan bool) {
+	for {
+		err := s.watch(stop)
+
+		s.Lock()
+		s.serials = make(map[string]*zoneSerial)
+		s.apexes = nil
+		s.watching = false
+		s.Unlock()
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		logger.Printf("[WARNING] Lost watch for zone serials: %s", err)
+
+		select {
+		case <-time.After(serialRetryInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// watch applies changes from a watch on the store until it fails or is stopped
+func (s *ZoneSerials) watch(stop chan bool) error {
+	events := make(chan *StoreEvent)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.resolver.store.Watch(cleanKey(s.resolver.etcdPrefix), 0, events, stop)
+	}()
+
+	// Changes made while the apexes are loaded are applied on top of them
+	apexes := s.resolver.loadApexes()
+	s.Lock()
+	s.serials = make(map[string]*zoneSerial)
+	s.apexes = apexes
+	s.watching = true
+	s.Unlock()
+
+	for event := range events {
+		zone := s.resolver.zoneForEvent(event)
+		if zone == "" {
+			continue
+		}
+		if isSerialKey(event.Node.Key) {
+			// Another server has moved the serial on
+			if serial, err := strconv.ParseUint(event.Node.Value, 10, 32); err == nil {
+				s.raise(zone, uint32(serial), false)
+			}
+			continue
+		}
+		s.Observe(zone, event)
+	}
+	return <-done
+}
+
+// Serial returns the serial number of a zone
+func (s *ZoneSerials) Serial(zone string) uint32 {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	serial := s.serial(zone)
+	if s.fallback != nil {
+		if fallback := s.fallback.Serial(zone); fallback > serial {
+			serial = fallback
+		}
+	}
+	return serial
+}
+
+// serial returns the serial number of a zone, ignoring the fallback
+func (s *ZoneSerials) serial(zone string) uint32 {
+	if serial, ok := s.cached(zone); ok {
+		return serial
+	}
+	return s.remember(zone, s.resolver.loadSerial(zone))
+}
+
+// Observe records a change made to a zone. Only deletions need saving, the
+// index of anything else is in the store already.
+func (s *ZoneSerials) Observe(zone string, event *StoreEvent) {
+	s.raise(dns.Fqdn(strings.ToLower(zone)), uint32(event.Node.ModifiedIndex), event.deleted())
+}
+
+// raise moves the serial of a zone on to the given one, unless it's already
+// there, writing it to the store if asked to.
+func (s *ZoneSerials) raise(zone string, serial uint32, save bool) {
+	current, ok := s.cached(zone)
+	if !ok {
+		current = s.remember(zone, s.resolver.loadSerial(zone))
+	}
+	if serial <= current {
+		return
+	}
+	s.remember(zone, serial)
+	if save {
+		s.resolver.saveSerial(zone, serial)
+	}
+}
+
+// cached returns the serial of a zone held in memory, if it can still be used
+func (s *ZoneSerials) cached(zone string) (uint32, bool) {
+	s.Lock()
+	defer s.Unlock()
+	cached, ok := s.serials[zone]
+	if !ok || (!s.watching && time.Since(cached.loaded) > serialCacheInterval) {
+		return 0, false
+	}
+	return cached.serial, true
+}
+
+// remember keeps the serial of a zone in memory, unless a higher one is held
+// already, returning the serial held
+func (s *ZoneSerials) remember(zone string, serial uint32) uint32 {
+	s.Lock()
+	defer s.Unlock()
+	cached, ok := s.serials[zone]
+	if ok && cached.serial >= serial && (s.watching || time.Since(cached.loaded) <= serialCacheInterval) {
+		return cached.serial
+	}
+	s.serials[zone] = &zoneSerial{serial: serial, loaded: time.Now()}
+	return serial
+}
+
+// trackApex keeps the apexes of zones up to date with a change to the store
+func (s *ZoneSerials) trackApex(event *StoreEvent) {
+	key := cleanKey(event.Node.Key)
+	prefix := cleanKey(s.resolver.etcdPrefix)
+	if !keyWithin(key, prefix) {
+		return
+	}
+	key = cleanKey(strings.TrimPrefix(key, prefix))
+	index := event.Node.ModifiedIndex
+
+	s.Lock()
+	defer s.Unlock()
+	if s.apexes == nil {
+		return
+	}
+	update := func(apex string, exists bool) {
+		// The same change can be seen by several watches, in any order
+		if current, ok := s.apexes[apex]; !ok || current.index < index {
+			s.apexes[apex] = &zoneApex{exists: exists, index: index}
+		}
+	}
+	if path.Base(key) == ".SOA" {
+		update(path.Dir(key), !event.deleted())
+	} else if event.Node.Dir && event.deleted() {
+		for apex := range s.apexes {
+			if keyWithin(apex, key) {
+				update(apex, false)
+			}
+		}
+	}
+}
+
+// apex returns whether the key (without the resolver's prefix) is the apex of
+// a zone, or false for ok if the apexes aren't known.
+func (s *ZoneSerials) apex(key string) (exists bool, ok bool) {
+	s.Lock()
+	if s.apexes == nil {
+		s.Unlock()
+		return false, false
+	}
+	if apex, found := s.apexes[key]; found && apex.exists {
+		s.Unlock()
+		return true, true
+	}
+	s.Unlock()
+
+	// Views fall back to the default zones
+	if s.fallback != nil {
+		return s.fallback.apex(key)
+	}
+	return false, true
+}
+
+// ZoneSerial returns the serial number of a zone without one set in its SOA
+// record. Without a ZoneSerials (which nothing is watching the store for) it's
+// read from the store each time.
+func (r *Resolver) ZoneSerial(zone string) uint32 {
+	if r.serials != nil {
+		return r.serials.Serial(zone)
+	}
+	return r.loadSerial(zone)
+}
+
+// observeSerial records a change made to a zone, if the resolver keeps zone
+// serials
+func (r *Resolver) observeSerial(zone string, event *StoreEvent) {
+	if r.serials != nil {
+		r.serials.Observe(zone, event)
+	}
+}
+
+// loadApexes reads the keys of every zone apex from the store, along with the
+// index of their SOA records. Nil is returned if the store can't be read.
+func (r *Resolver) loadApexes() map[string]*zoneApex {
+	prefix := cleanKey(r.etcdPrefix)
+	node, err := r.store.Get(prefix)
+	if _, ok := err.(*KeyNotFoundError); ok {
+		return make(map[string]*zoneApex)
+	} else if err != nil {
+		return nil
+	}
+
+	apexes := make(map[string]*zoneApex)
+	var walk func(node *Node)
+	walk = func(node *Node) {
+		if soa := node.child(".SOA"); soa != nil {
+			key := cleanKey(strings.TrimPrefix(cleanKey(node.Key), prefix))
+			apexes[key] = &zoneApex{exists: true, index: soa.ModifiedIndex}
+		}
+		for _, child := range node.Nodes {
+			if child.Dir {
+				walk(child)
+			}
+		}
+	}
+	walk(node)
+	return apexes
+}
+
+// loadSerial reads the serial of a zone from the store, the serial saved there
+// or the highest modified index of any key within the zone if that's higher.
+func (r *Resolver) loadSerial(zone string) uint32 {
+	zoneKey := cleanKey(r.etcdPrefix + nameToKey(zone, ""))
+	node, err := r.store.Get(zoneKey)
+	if err != nil {
+		return 0
+	}
+
+	var serial uint64
+	var walk func(node *Node, apex bool)
+	walk = func(node *Node, apex bool) {
+		if !apex && node.child(".SOA") != nil {
+			return
+		}
+		if node.ModifiedIndex > serial {
+			serial = node.ModifiedIndex
+		}
+		for _, child := range node.Nodes {
+			if apex && path.Base(child.Key) == serialKey {
+				if saved, err := strconv.ParseUint(child.Value, 10, 32); err == nil && saved > serial {
+					serial = saved
+				}
+				continue
+			}
+			walk(child, false)
+		}
+	}
+	walk(node, true)
+	return uint32(serial)
+}
+
+// saveSerial writes the serial of a zone to the store, if it can be written to
+// and doesn't already hold a higher serial.
+func (r *Resolver) saveSerial(zone string, serial uint32) {
+	errorCounter := metrics.GetOrRegisterCounter("resolver.serial.save_error", metrics.DefaultRegistry)
+
+	key := r.etcdPrefix + nameToKey(zone, "/"+serialKey)
+	writable, err := writableStore(r.store, key)
+	if err != nil {
+		return
+	}
+	value := strconv.FormatUint(uint64(serial), 10)
+	for attempt := 0; attempt < 3; attempt++ {
+		node, err := r.store.Get(key)
+		if _, ok := err.(*KeyNotFoundError); ok {
+			err = writable.Create(key, value)
+		} else if err == nil {
+			if saved, parseErr := strconv.ParseUint(node.Value, 10, 32); parseErr == nil && uint32(saved) >= serial {
+				return
+			}
+			err = writable.CompareAndSwap(key, value, node.ModifiedIndex)
+		}
+		if _, ok := err.(*CompareFailedError); ok {
+			continue
+		} else if err != nil {
+			break
+		}
+		return
+	}
+	errorCounter.Inc(1)
+	debugMsg("Unable to save serial ", serial, " of zone ", zone)
+}
+
+// isSerialKey returns true if the key holds the serial of a zone
+func isSerialKey(key string) bool {
+	return path.Base(key) == serialKey
+}
+
+// zoneForEvent returns the zone that a change from a watch on the store was
+// made to (see zoneForKey), after noting whether it adds or removes a zone.
+func (r *Resolver) zoneForEvent(event *StoreEvent) string {
+	if r.serials != nil {
+		r.serials.trackApex(event)
+	}
+	return r.zoneForKey(event.Node.Key)
+}
+
+// zoneForKey returns the zone that a key in the store belongs to, the closest
+// name at or above the key with an SOA record, or an empty string if it isn't
+// within any zone. The apexes of zones are taken from memory when the resolver
+// keeps zone serials, and otherwise read from the store.
+func (r *Resolver) zoneForKey(key string) string {
+	key = cleanKey(key)
+	prefix := cleanKey(r.etcdPrefix)
+	if !keyWithin(key, prefix) {
+		return ""
+	}
+	key = cleanKey(strings.TrimPrefix(key, prefix))
+
+	// Strip off the record set, e.g. /.A/0 or /.A.ttl
+	if i := strings.Index(key, "/."); i >= 0 {
+		key = cleanKey(key[:i])
+	}
+	for {
+		if r.isApex(prefix, key) {
+			return keyToName(key)
+		}
+		if key == "/" {
+			return ""
+		}
+		key = path.Dir(key)
+	}
+}
+
+// isApex returns true if the key (beneath the prefix) has an SOA record
+func (r *Resolver) isApex(prefix string, key string) bool {
+	if r.serials != nil {
+		if exists, ok := r.serials.apex(key); ok {
+			return exists
+		}
+	}
+	_, err := r.store.Get(path.Join(prefix, key, ".SOA"))
+	return err == nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForZoneSerial waits for the serial of a zone to reach at least the given
+// one, returning it
+func waitForZoneSerial(t *testing.T, serials *ZoneSerials, zone string, serial uint32) uint32 {
+	for i := 0; i < 100; i++ {
+		if current := serials.Serial(zone); current >= serial {
+			return current
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for serial ", serial, " of ", zone)
+	return 0
+}
+
+func TestZoneSerials(t *testing.T) {
+	serialStore := NewMemoryStore()
+	serialStore.Set("/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	serialStore.Set("/net/disco/www/.A", "1.1.1.1")
+	serialStore.Set("/net/disco/sub/.SOA", "ns1.sub.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+
+	resolver := &Resolver{store: serialStore}
+	resolver.serials = NewZoneSerials(resolver)
+	stop := make(chan bool)
+	defer close(stop)
+	go resolver.serials.Run(stop)
+	time.Sleep(10 * time.Millisecond)
+
+	serial := resolver.Authority("disco.net.").Serial
+	if serial != 2 {
+		t.Fatal("Expected serial 2, got ", serial)
+	}
+
+	// Changes to child zones don't affect the serial
+	serialStore.Set("/net/disco/sub/www/.A", "1.1.1.2")
+	waitForZoneSerial(t, resolver.serials, "sub.disco.net.", 4)
+	if current := resolver.Authority("disco.net.").Serial; current != serial {
+		t.Fatal("Expected serial to be unchanged by a child zone: ", current, serial)
+	}
+
+	// Deleting the latest key in the zone still increases the serial
+	serialStore.Set("/net/disco/api/.A", "1.1.1.3")
+	serial = waitForZoneSerial(t, resolver.serials, "disco.net.", 5)
+	serialStore.Delete("/net/disco/api/.A")
+	serial = waitForZoneSerial(t, resolver.serials, "disco.net.", serial+1)
+	if current := resolver.Authority("disco.net.").Serial; current != serial {
+		t.Fatal("Expected SOA to use the latest serial: ", current, serial)
+	}
+
+	// The serial is kept in the store, so it doesn't go backwards when read
+	// from scratch
+	if loaded := resolver.loadSerial("disco.net."); loaded != serial {
+		t.Fatal("Expected the saved serial to be loaded: ", loaded, serial)
+	}
+}
+
+func TestZoneForKey(t *testing.T) {
+	resolver.etcdPrefix = "TestZoneForKey/"
+	store.Set("TestZoneForKey/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	store.Set("TestZoneForKey/net/disco/sub/.SOA", "ns1.sub.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	defer store.Delete(resolver.etcdPrefix)
+
+	tests := map[string]string{
+		"/TestZoneForKey/net/disco/.SOA":          "disco.net.",
+		"/TestZoneForKey/net/disco/.SOA.serial":   "disco.net.",
+		"/TestZoneForKey/net/disco/www/.A/0":      "disco.net.",
+		"/TestZoneForKey/net/disco/a/b/.TXT.ttl":  "disco.net.",
+		"/TestZoneForKey/net/disco/sub/www/.AAAA": "sub.disco.net.",
+		"/TestZoneForKey/net/other/.A":            "",
+		"/Other/net/disco/www/.A":                 "",
+	}
+	for key, zone := range tests {
+		if found := resolver.zoneForKey(key); found != zone {
+			t.Fatalf("Expected zone '%s' for %s, got '%s'", zone, key, found)
+		}
+	}
+}
+
+// countingStore is a store that counts how many times it's read from
+type countingStore struct {
+	*MemoryStore
+	gets int64
+}
+
+func (s *countingStore) Get(key string) (*Node, error) {
+	atomic.AddInt64(&s.gets, 1)
+	return s.MemoryStore.Get(key)
+}
+
+func TestZoneSerialsApexes(t *testing.T) {
+	apexStore := &countingStore{MemoryStore: NewMemoryStore()}
+	apexStore.Set("/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	apexStore.Set("/net/disco/sub/.SOA", "ns1.sub.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+
+	resolver := &Resolver{store: apexStore}
+	resolver.serials = NewZoneSerials(resolver)
+	stop := make(chan bool)
+	defer close(stop)
+	go resolver.serials.Run(stop)
+	for i := 0; i < 100; i++ {
+		if _, ok := resolver.serials.apex("/"); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Once the watch is running, zones are found without reading the store
+	gets := atomic.LoadInt64(&apexStore.gets)
+	if zone := resolver.zoneForKey("/net/disco/sub/www/.A"); zone != "sub.disco.net." {
+		t.Fatal("Expected sub.disco.net., got ", zone)
+	}
+	if zone := resolver.zoneForKey("/net/disco/www/.A"); zone != "disco.net." {
+		t.Fatal("Expected disco.net., got ", zone)
+	}
+	if read := atomic.LoadInt64(&apexStore.gets) - gets; read != 0 {
+		t.Fatal("Expected zones to be found without reading the store, got ", read, " reads")
+	}
+
+	// New zones are noticed as their SOA records are seen, whichever watch
+	// sees them first, and deleted zones are forgotten
+	apexStore.Set("/net/disco/new/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	created := &StoreEvent{Action: "set", Node: &Node{Key: "/net/disco/new/.SOA", ModifiedIndex: 3}}
+	if zone := resolver.zoneForEvent(created); zone != "new.disco.net." {
+		t.Fatal("Expected new.disco.net., got ", zone)
+	}
+	if zone := resolver.zoneForKey("/net/disco/new/www/.A"); zone != "new.disco.net." {
+		t.Fatal("Expected new.disco.net., got ", zone)
+	}
+	apexStore.Delete("/net/disco/sub")
+	deleted := &StoreEvent{Action: "delete", Node: &Node{Key: "/net/disco/sub", Dir: true, ModifiedIndex: 4}}
+	if zone := resolver.zoneForEvent(deleted); zone != "disco.net." {
+		t.Fatal("Expected disco.net., got ", zone)
+	}
+	// ...and an earlier change seen late doesn't bring them back
+	if zone := resolver.zoneForEvent(&StoreEvent{Action: "set", Node: &Node{Key: "/net/disco/sub/.SOA", ModifiedIndex: 2}}); zone != "disco.net." {
+		t.Fatal("Expected the deleted zone to stay deleted, got ", zone)
+	}
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
+	"net"
 	"strconv"
 	"time"
 
-	"github.com/coreos/go-etcd/etcd"
 	"github.com/miekg/dns"
 	"github.com/rcrowley/go-metrics"
 )
@@ -12,16 +12,36 @@ import (
 type server struct {
 	addr          string
 	port          int
-	etcd          *etcd.Client
+	store         RecordStore
 	rTimeout      time.Duration
 	wTimeout      time.Duration
 	defaultTTL    uint32
 	queryFilterer *QueryFilterer
+	transferAllow []*net.IPNet
+	updateAllow   []*net.IPNet
+	tsigKeys      map[string]*TsigKey
+	allowUnsigned bool
+	notifyKey     *TsigKey
+	journalSize   int
+	notifyTargets []string
+	notifyNS      bool
+	notifyDelay   time.Duration
+	signer        *Signer
+	aliasUpstream string
+	ednsSize      uint16
+	views         []*View
 }
 
 type handler struct {
 	resolver      *Resolver
 	queryFilterer *QueryFilterer
+	transferAllow []*net.IPNet
+	updateAllow   []*net.IPNet
+	tsigKeys      map[string]*TsigKey
+	allowUnsigned bool
+	journal       *Journal
+	ednsSize      uint16
+	views         []*View
 
 	// Metrics
 	requestCounter metrics.Counter
@@ -38,7 +58,11 @@ func (h *handler) Handle(response dns.ResponseWriter, req *dns.Msg) {
 		// Lookup the dns record for the request
 		// This method will add any answers to the message
 		var msg *dns.Msg
-		if h.queryFilterer.ShouldAcceptQuery(req) != true {
+		if req.Opcode == dns.OpcodeUpdate {
+			h.Update(response, req)
+		} else if msg = badVersion(req, h.ednsSize); msg != nil {
+			debugMsg("Unsupported EDNS version")
+		} else if h.queryFilterer.ShouldAcceptQuery(req) != true {
 			debugMsg("Query not accepted")
 
 			h.rejectCounter.Inc(1)
@@ -48,18 +72,18 @@ func (h *handler) Handle(response dns.ResponseWriter, req *dns.Msg) {
 			msg.SetRcode(req, dns.RcodeNameError)
 			msg.Authoritative = true
 			msg.RecursionAvailable = false
-
-			// Add a useful TXT record
-			header := dns.RR_Header{Name: req.Question[0].Name,
-				Class:  dns.ClassINET,
-				Rrtype: dns.TypeTXT}
-			msg.Ns = []dns.RR{&dns.TXT{Hdr: header, Txt: []string{"Rejected query based on matched filters"}}}
+			setExtendedError(req, msg, edeBlocked, "Rejected query based on matched filters")
+		} else if req.Question[0].Qtype == dns.TypeAXFR || req.Question[0].Qtype == dns.TypeIXFR {
+			h.acceptCounter.Inc(1)
+			h.Transfer(response, req)
 		} else {
 			h.acceptCounter.Inc(1)
-			msg = h.resolver.Lookup(req)
+			response = h.signingWriter(response, req)
+			msg = h.viewResolver(response, req).LookupWithLimit(req, responseLimit(response, req, h.ednsSize))
 		}
 
 		if msg != nil {
+			fitResponse(response, req, msg, h.ednsSize)
 			err := response.WriteMsg(msg)
 			if err != nil {
 				debugMsg("Error writing message: ", err)
@@ -74,6 +98,17 @@ func (s *server) Addr() string {
 	return s.addr + ":" + strconv.Itoa(s.port)
 }
 
+// newJournal creates the journal of changes to zones, watching the store until
+// the stop channel is closed if any clients can make zone transfers (from the
+// allowed networks, or by signing them with a TSIG key).
+func (s *server) newJournal(resolver *Resolver, stop chan bool) *Journal {
+	journal := NewJournal(resolver, s.journalSize)
+	if len(s.transferAllow) > 0 || len(s.tsigKeys) > 0 {
+		go journal.Run(stop)
+	}
+	return journal
+}
+
 func (s *server) Run() {
 
 	tcpResponseTimer := metrics.NewTimer()
@@ -94,21 +129,50 @@ func (s *server) Run() {
 	udpRejectCounter := metrics.NewCounter()
 	metrics.Register("request.handler.udp.filter_rejects", udpRejectCounter)
 
-	resolver := Resolver{etcd: s.etcd, defaultTTL: s.defaultTTL}
+	resolver := Resolver{store: s.store, defaultTTL: s.defaultTTL, signer: s.signer, aliasUpstream: s.aliasUpstream}
+	if s.aliasUpstream != "" {
+		resolver.aliasCache = NewAliasCache(aliasCacheSize)
+	}
+	resolver.serials = NewZoneSerials(&resolver)
+	go resolver.serials.Run(nil)
+	for _, view := range s.views {
+		view.resolver = view.newResolver(&resolver)
+		go view.resolver.serials.Run(nil)
+	}
+	journal := s.newJournal(&resolver, nil)
+	if len(s.notifyTargets) > 0 || s.notifyNS {
+		notifier := NewNotifier(&resolver, s.notifyTargets, s.notifyNS, s.notifyDelay, s.notifyKey)
+		go notifier.Run(nil)
+	}
+
 	tcpDNShandler := &handler{
 		resolver:       &resolver,
 		requestCounter: tcpRequestCounter,
 		acceptCounter:  tcpAcceptCounter,
 		rejectCounter:  tcpRejectCounter,
 		responseTimer:  tcpResponseTimer,
-		queryFilterer:  s.queryFilterer}
+		queryFilterer:  s.queryFilterer,
+		transferAllow:  s.transferAllow,
+		updateAllow:    s.updateAllow,
+		tsigKeys:       s.tsigKeys,
+		allowUnsigned:  s.allowUnsigned,
+		journal:        journal,
+		ednsSize:       s.ednsSize,
+		views:          s.views}
 	udpDNShandler := &handler{
 		resolver:       &resolver,
 		requestCounter: udpRequestCounter,
 		acceptCounter:  udpAcceptCounter,
 		rejectCounter:  udpRejectCounter,
 		responseTimer:  udpResponseTimer,
-		queryFilterer:  s.queryFilterer}
+		queryFilterer:  s.queryFilterer,
+		transferAllow:  s.transferAllow,
+		updateAllow:    s.updateAllow,
+		tsigKeys:       s.tsigKeys,
+		allowUnsigned:  s.allowUnsigned,
+		journal:        journal,
+		ednsSize:       s.ednsSize,
+		views:          s.views}
 
 	udpHandler := dns.NewServeMux()
 	tcpHandler := dns.NewServeMux()
@@ -119,12 +183,14 @@ func (s *server) Run() {
 	tcpServer := &dns.Server{Addr: s.Addr(),
 		Net:          "tcp",
 		Handler:      tcpHandler,
+		TsigSecret:   tsigSecrets(s.tsigKeys),
 		ReadTimeout:  s.rTimeout,
 		WriteTimeout: s.wTimeout}
 
 	udpServer := &dns.Server{Addr: s.Addr(),
 		Net:          "udp",
 		Handler:      udpHandler,
+		TsigSecret:   tsigSecrets(s.tsigKeys),
 		UDPSize:      65535,
 		ReadTimeout:  s.rTimeout,
 		WriteTimeout: s.wTimeout}
@@ -139,3 +205,20 @@ func (s *server) start(ds *dns.Server) {
 		logger.Fatalf("Start %s listener on %s failed:%s", ds.Net, s.Addr(), err.Error())
 	}
 }
+
+// addrAllowed returns true if the address is in one of the given networks
+func addrAllowed(addr net.Addr, networks []*net.IPNet) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
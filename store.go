@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Node is a storage backend agnostic representation of a key. Keys are
+// arranged in a tree in the same way as etcd; a node is either a leaf
+// holding a value or a directory holding further nodes.
+type Node struct {
+	Key           string
+	Value         string
+	Dir           bool
+	Nodes         []*Node
+	ModifiedIndex uint64
+}
+
+// StoreEvent describes a single change to a key held in a RecordStore
+type StoreEvent struct {
+	Action   string
+	Node     *Node
+	PrevNode *Node
+}
+
+// deleted returns true if the event removed the node from the store
+func (e *StoreEvent) deleted() bool {
+	switch e.Action {
+	case "delete", "expire", "compareAndDelete":
+		return true
+	}
+	return false
+}
+
+// RecordStore is implemented by anything that can be used as a source of
+// DNS records. Keys use the reverse domain layout described in the README,
+// for example /net/disco/.A or /net/disco/.A/0.
+type RecordStore interface {
+	// Get returns the node for the given key. If the key is a directory the
+	// whole subtree beneath it is returned, with the children of each
+	// directory sorted by key. A *KeyNotFoundError is returned when the key
+	// does not exist.
+	Get(key string) (*Node, error)
+
+	// Watch sends an event on the given channel for every change made to the
+	// key, or any key beneath it, starting from waitIndex (zero meaning the
+	// next change). It blocks until the stop channel is closed or an error
+	// occurs, and closes the events channel before returning.
+	Watch(key string, waitIndex uint64, events chan *StoreEvent, stop chan bool) error
+}
+
+// SnapshotRecordStore is implemented by stores that can report the index at
+// which a Get was served, so that a Watch can carry on from exactly that point
+// without missing (or needing to guess at) any changes.
+type SnapshotRecordStore interface {
+	RecordStore
+
+	// Snapshot behaves like Get, but also returns the index of the store at
+	// the time the read was made.
+	Snapshot(key string) (*Node, uint64, error)
+}
+
+// WritableRecordStore is implemented by stores that records can be written to.
+// Changes to existing keys are conditional on the key not having been modified
+// since it was read, so that concurrent writers can't silently overwrite each
+// other. A CompareFailedError is returned if the condition doesn't hold.
+type WritableRecordStore interface {
+	RecordStore
+
+	// Create sets the value of a key that must not already exist
+	Create(key string, value string) error
+
+	// CompareAndSwap sets the value of a key, as long as its modified index
+	// is still prevIndex
+	CompareAndSwap(key string, value string, prevIndex uint64) error
+
+	// CompareAndDelete removes a key, as long as its modified index is still
+	// prevIndex
+	CompareAndDelete(key string, prevIndex uint64) error
+
+	// Delete removes a key, and everything beneath it if it's a directory
+	Delete(key string) error
+}
+
+// writableStore returns the store as a WritableRecordStore, or an error if it
+// can't be written to.
+func writableStore(store RecordStore, key string) (WritableRecordStore, error) {
+	if writable, ok := store.(WritableRecordStore); ok {
+		return writable, nil
+	}
+	return nil, &ReadOnlyError{Key: key}
+}
+
+// Leaves returns every leaf node in the subtree beneath (and including) the
+// node, in the order they appear in the tree.
+func (n *Node) Leaves() (leaves []*Node) {
+	if !n.Dir {
+		return []*Node{n}
+	}
+	for _, child := range n.Nodes {
+		leaves = append(leaves, child.Leaves()...)
+	}
+	return
+}
+
+// uncachedStore returns a store reading the same keys as the given one, but
+// straight from the underlying stores rather than from any cache in front of
+// them.
+func uncachedStore(store RecordStore) RecordStore {
+	switch store := store.(type) {
+	case *CachedStore:
+		return store.store
+	case *RoutingStore:
+		return store.uncached()
+	}
+	return store
+}
+
+// cleanKey normalizes a key in the same way etcd does, so that "foo//bar/"
+// and "/foo/bar" refer to the same node.
+func cleanKey(key string) string {
+	return path.Clean("/" + key)
+}
+
+// keyWithin returns true if the key is equal to, or is beneath, the parent
+func keyWithin(key string, parent string) bool {
+	return parent == "/" || key == parent || strings.HasPrefix(key, parent+"/")
+}
+
+// find returns the node for the given (clean) key beneath this one, or nil
+func (n *Node) find(key string) *Node {
+	node := n
+	for _, segment := range strings.Split(key, "/")[1:] {
+		if len(segment) == 0 {
+			continue
+		}
+		if node = node.child(segment); node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// insert places the node, along with any children, into the tree beneath this
+// one at the node's key, creating any missing parent directories. Whatever was
+// previously stored at the key is replaced and returned.
+func (n *Node) insert(node *Node) (prevNode *Node, err error) {
+	parent := n
+	segments := strings.Split(node.Key, "/")[1:]
+	for i, segment := range segments[:len(segments)-1] {
+		child := parent.child(segment)
+		if child == nil {
+			child = &Node{Key: "/" + strings.Join(segments[:i+1], "/"), Dir: true, ModifiedIndex: node.ModifiedIndex}
+			parent.addChild(child)
+		} else if !child.Dir {
+			return nil, fmt.Errorf("Not a directory: %s", child.Key)
+		}
+		parent = child
+	}
+
+	if prevNode = parent.child(segments[len(segments)-1]); prevNode != nil {
+		parent.removeChild(prevNode)
+	}
+	parent.addChild(node)
+	return
+}
+
+// remove deletes the node at the given key from the tree beneath this one,
+// returning the removed node or nil if there was nothing to remove.
+func (n *Node) remove(key string) *Node {
+	parent := n.find(path.Dir(key))
+	if parent == nil {
+		return nil
+	}
+	node := parent.child(path.Base(key))
+	if node != nil {
+		parent.removeChild(node)
+	}
+	return node
+}
+
+// child returns the direct child of this node with the given name, or nil
+func (n *Node) child(name string) *Node {
+	for _, child := range n.Nodes {
+		if path.Base(child.Key) == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// addChild inserts a node into this node's children, keeping them sorted
+func (n *Node) addChild(child *Node) {
+	i := sort.Search(len(n.Nodes), func(i int) bool { return n.Nodes[i].Key >= child.Key })
+	n.Nodes = append(n.Nodes, nil)
+	copy(n.Nodes[i+1:], n.Nodes[i:])
+	n.Nodes[i] = child
+}
+
+// removeChild removes the given node from this node's children
+func (n *Node) removeChild(child *Node) {
+	for i, c := range n.Nodes {
+		if c == child {
+			n.Nodes = append(n.Nodes[:i], n.Nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+// copy returns a deep copy of the node and its children
+func (n *Node) copy() *Node {
+	c := *n
+	c.Nodes = nil
+	for _, child := range n.Nodes {
+		c.Nodes = append(c.Nodes, child.copy())
+	}
+	return &c
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+// clientSubnet returns the EDNS Client Subnet option (RFC 7871) of a request,
+// or nil if it doesn't have one
+func clientSubnet(req *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// echoClientSubnet adds the client's subnet to the response, with the scope
+// prefix length telling caches which clients they can give the answer to.
+func echoClientSubnet(msg *dns.Msg, subnet *dns.EDNS0_SUBNET, scope uint8) {
+	opt := ednsOption(msg)
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        subnet.Family,
+		SourceNetmask: subnet.SourceNetmask,
+		SourceScope:   scope,
+		Address:       subnet.Address,
+		DraftOption:   subnet.DraftOption})
+}
+
+// SubnetAnswers returns the records of the given type for a name that are
+// scoped to the client's subnet. These are held in directories beneath the
+// type's key named after the subnet they're for, such as
+//
+//	/net/disco/api/.A/@10.1.0.0-16/0 -> 10.1.2.3
+//
+// and the records of the most specific subnet containing the client's are
+// returned. The scope prefix length is returned too, which is as short as it
+// can be while still leaving out any other subnets with different records.
+func (r *Resolver) SubnetAnswers(name string, rrType uint16, subnet *dns.EDNS0_SUBNET) (answers []dns.RR, scope uint8, err error) {
+	subnetCounter := metrics.GetOrRegisterCounter("resolver.answers.subnet", metrics.DefaultRegistry)
+
+	name = strings.ToLower(name)
+	node, err := r.store.Get(r.etcdPrefix + nameToKey(name, "/."+dns.TypeToString[rrType]))
+	if err != nil {
+		if _, ok := err.(*KeyNotFoundError); ok {
+			return nil, 0, nil
+		}
+		return
+	} else if !node.Dir {
+		return
+	}
+
+	bits := 8 * net.IPv4len
+	client := subnet.Address.To4()
+	if subnet.Family == 2 {
+		bits, client = 8*net.IPv6len, subnet.Address.To16()
+	}
+	if client == nil || int(subnet.SourceNetmask) > bits {
+		return
+	}
+	source := int(subnet.SourceNetmask)
+	client = client.Mask(net.CIDRMask(source, bits))
+
+	var networks []*net.IPNet
+	var match *net.IPNet
+	var matchNode *Node
+	for _, child := range node.Nodes {
+		network := parseSubnetKey(path.Base(child.Key))
+		if network == nil {
+			continue
+		} else if ones, networkBits := network.Mask.Size(); networkBits != bits {
+			continue
+		} else if ones <= source && network.Contains(client) && (match == nil || ones > prefixLength(match)) {
+			match, matchNode = network, child
+		}
+		networks = append(networks, network)
+	}
+
+	// Any more specific subnet within the one matched (or anywhere, if there
+	// wasn't a match) has different records, so the scope has to be long
+	// enough to tell the client's subnet apart from it
+	matchLength := 0
+	if match != nil {
+		matchLength = prefixLength(match)
+	}
+	scope = uint8(matchLength)
+	for _, network := range networks {
+		if prefixLength(network) <= matchLength || (match != nil && !match.Contains(network.IP)) {
+			continue
+		}
+		length := commonPrefixLength(client, network.IP) + 1
+		if length > source {
+			length = source
+		}
+		if uint8(length) > scope {
+			scope = uint8(length)
+		}
+	}
+
+	if matchNode == nil {
+		return nil, scope, nil
+	}
+	subnetCounter.Inc(1)
+	records, err := r.GetFromStorage(strings.TrimPrefix(matchNode.Key, cleanKey(r.etcdPrefix)))
+	if err != nil {
+		return nil, scope, err
+	}
+	answers, err = r.convertRecords(name, rrType, records)
+	return answers, scope, err
+}
+
+// parseSubnetKey returns the subnet a key holding subnet scoped records is
+// for, such as @10.1.0.0-16, or nil if it isn't one
+func parseSubnetKey(key string) *net.IPNet {
+	if !strings.HasPrefix(key, "@") {
+		return nil
+	}
+	parts := strings.SplitN(key[1:], "-", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	ones, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(parts[0])
+	if ip == nil {
+		return nil
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	if ones < 0 || ones > bits {
+		return nil
+	}
+	mask := net.CIDRMask(ones, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// prefixLength returns the length of a network's prefix
+func prefixLength(network *net.IPNet) int {
+	ones, _ := network.Mask.Size()
+	return ones
+}
+
+// commonPrefixLength returns the number of leading bits two addresses of the
+// same family have in common
+func commonPrefixLength(a net.IP, b net.IP) int {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil && b4 != nil {
+		a, b = a4, b4
+	}
+	length := 0
+	for i := 0; i < len(a) && i < len(b); i++ {
+		for bit := uint(7); ; bit-- {
+			if (a[i]>>bit)&1 != (b[i]>>bit)&1 {
+				return length
+			}
+			length++
+			if bit == 0 {
+				break
+			}
+		}
+	}
+	return length
+}
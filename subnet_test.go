@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newTestSubnetQuery(name string, address string, source uint8) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion(name, dns.TypeA)
+	query.SetEdns0(4096, false)
+	opt := query.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: source,
+		Address:       net.ParseIP(address).To4()})
+	return query
+}
+
+func TestParseSubnetKey(t *testing.T) {
+	tests := []struct {
+		key     string
+		network string
+	}{
+		{"@10.1.0.0-16", "10.1.0.0/16"},
+		{"@10.1.2.3-16", "10.1.0.0/16"},
+		{"@2001:db8::-32", "2001:db8::/32"},
+		{"@10.1.0.0-33", ""},
+		{"@10.1.0.0", ""},
+		{"@disco-16", ""},
+		{"10.1.0.0-16", ""},
+	}
+	for _, test := range tests {
+		network := parseSubnetKey(test.key)
+		if test.network == "" && network != nil {
+			t.Fatalf("Expected %s not to be a subnet, got %s", test.key, network)
+		} else if test.network != "" && (network == nil || network.String() != test.network) {
+			t.Fatalf("Expected %s to be %s, got %s", test.key, test.network, network)
+		}
+	}
+}
+
+func TestCommonPrefixLength(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		length int
+	}{
+		{"10.1.2.0", "10.1.2.0", 32},
+		{"10.1.2.0", "10.1.3.0", 23},
+		{"10.1.2.0", "138.1.2.0", 0},
+		{"2001:db8::", "2001:db9::", 31},
+	}
+	for _, test := range tests {
+		if length := commonPrefixLength(net.ParseIP(test.a), net.ParseIP(test.b)); length != test.length {
+			t.Fatalf("Expected %s and %s to share %d bits, got %d", test.a, test.b, test.length, length)
+		}
+	}
+}
+
+func TestLookupSubnet(t *testing.T) {
+	resolver.etcdPrefix = "TestLookupSubnet/"
+	store.Set("TestLookupSubnet/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	store.Set("TestLookupSubnet/net/disco/api/.A/0", "1.1.1.1")
+	store.Set("TestLookupSubnet/net/disco/api/.A/@10.1.0.0-16/0", "2.2.2.2")
+	store.Set("TestLookupSubnet/net/disco/api/.A/@10.1.0.0-16/0.ttl", "60")
+	store.Set("TestLookupSubnet/net/disco/api/.A/@10.1.3.0-24/0", "3.3.3.3")
+	store.Set("TestLookupSubnet/net/disco/www/.CNAME", "api.disco.net.")
+	defer store.Delete(resolver.etcdPrefix)
+
+	tests := []struct {
+		name    string
+		address string
+		source  uint8
+		answer  string
+		scope   uint8
+	}{
+		// Beside 10.1.3.0/24 the /16 is split where they differ
+		{"api.disco.net.", "10.1.2.0", 24, "2.2.2.2", 24},
+		{"api.disco.net.", "10.1.128.0", 24, "2.2.2.2", 17},
+		{"api.disco.net.", "10.1.3.0", 24, "3.3.3.3", 24},
+		// The scope is never longer than the client's own prefix
+		{"api.disco.net.", "10.1.0.0", 16, "2.2.2.2", 16},
+		{"api.disco.net.", "10.2.0.0", 24, "1.1.1.1", 15},
+		{"api.disco.net.", "192.168.0.0", 24, "1.1.1.1", 1},
+		{"www.disco.net.", "10.1.3.0", 24, "3.3.3.3", 24},
+	}
+	for _, test := range tests {
+		answer := resolver.Lookup(newTestSubnetQuery(test.name, test.address, test.source))
+		last := answer.Answer[len(answer.Answer)-1]
+		if a, ok := last.(*dns.A); !ok || a.A.String() != test.answer || a.Hdr.Name != "api.disco.net." {
+			t.Fatalf("Expected %s for %s/%d, got %v", test.answer, test.address, test.source, answer.Answer)
+		}
+		subnet := clientSubnet(answer)
+		if subnet == nil || subnet.SourceScope != test.scope || subnet.SourceNetmask != test.source || !subnet.Address.Equal(net.ParseIP(test.address)) {
+			t.Fatalf("Expected the subnet %s/%d echoed with scope %d, got %v", test.address, test.source, test.scope, subnet)
+		}
+	}
+
+	// The scoped records keep their own TTLs
+	answer := resolver.Lookup(newTestSubnetQuery("api.disco.net.", "10.1.2.0", 24))
+	if answer.Answer[0].Header().Ttl != 60 {
+		t.Fatal("Expected the TTL of the scoped record, got ", answer.Answer[0])
+	}
+
+	// Without a subnet only the records that aren't scoped are used, and none
+	// is echoed back
+	query := new(dns.Msg)
+	query.SetQuestion("api.disco.net.", dns.TypeA)
+	answer = resolver.Lookup(query)
+	if len(answer.Answer) != 1 || answer.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Fatal("Expected only the records that aren't scoped, got ", answer.Answer)
+	}
+	if answer.IsEdns0() != nil {
+		t.Fatal("Expected no OPT record, got ", answer.Extra)
+	}
+}
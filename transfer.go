@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net"
+	"path"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Rough limit on the size of each message of a zone transfer, well within the
+// 64KB limit of a DNS message over TCP
+const transferMessageSize = 16384
+
+// ZoneRecords returns the SOA record of the zone, along with every other record
+// in the zone. The zone must have its own SOA record, otherwise nil is
+// returned. Any child zones (names beneath the zone with their own SOA) are
+// left out, apart from the NS records delegating to them.
+func (r *Resolver) ZoneRecords(zone string) (soa *dns.SOA, records []dns.RR, err error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	if soa = r.Authority(zone); soa == nil || soa.Hdr.Name != zone {
+		return nil, nil, nil
+	}
+
+	root, err := r.store.Get(r.etcdPrefix + nameToKey(zone, ""))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prefix := cleanKey(r.etcdPrefix)
+	var walk func(node *Node, apex bool) error
+	walk = func(node *Node, apex bool) error {
+		name := keyToName(strings.TrimPrefix(node.Key, prefix))
+		if !apex && node.child(".SOA") != nil {
+			delegation, err := r.LookupAnswersForType(name, dns.TypeNS)
+			records = append(records, delegation...)
+			return err
+		}
+
+		for _, child := range node.Nodes {
+			base := path.Base(child.Key)
+			if !strings.HasPrefix(base, ".") {
+				if child.Dir {
+					if err := walk(child, false); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			rrType, ok := dns.StringToType[base[1:]]
+			if _, supported := converters[rrType]; !ok || !supported || (apex && rrType == dns.TypeSOA) {
+				continue
+			}
+			answers, err := r.LookupAnswersForType(name, rrType)
+			if err != nil {
+				return err
+			}
+			records = append(records, answers...)
+		}
+		return nil
+	}
+
+	if err = walk(root, true); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// Transfer answers an AXFR or IXFR request. Transfers are only allowed from
+// authorized clients (see authorize), and the response is signed if the
+// request was signed with a TSIG key. Full transfers must be made over TCP,
+// while an IXFR over UDP is answered with the latest SOA of the zone, telling
+// the client to try again over TCP if it is out of date.
+//
+// An IXFR is answered with the changes made since the client's serial, taken
+// from the journal. If the journal doesn't go back that far the whole zone is
+// sent instead, as it would be for an AXFR.
+func (h *handler) Transfer(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	requestCounter := metrics.GetOrRegisterCounter("request.handler.transfer.requests", metrics.DefaultRegistry)
+	refusedCounter := metrics.GetOrRegisterCounter("request.handler.transfer.refused", metrics.DefaultRegistry)
+	incrementalCounter := metrics.GetOrRegisterCounter("request.handler.transfer.incremental", metrics.DefaultRegistry)
+	requestCounter.Inc(1)
+
+	w = h.signingWriter(w, req)
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+
+	_, tcp := w.RemoteAddr().(*net.TCPAddr)
+	rcode := h.authorize(w, req, h.transferAllow, q.Name)
+	if !tcp && q.Qtype != dns.TypeIXFR {
+		rcode = dns.RcodeRefused
+	}
+	if rcode != dns.RcodeSuccess {
+		debugMsg("Refusing zone transfer of ", q.Name, " to ", w.RemoteAddr())
+		refusedCounter.Inc(1)
+		msg.SetRcode(req, rcode)
+		w.WriteMsg(msg)
+		return
+	}
+
+	soa, records, err := h.journal.Zone(q.Name)
+	if err != nil {
+		debugMsg("Error reading zone ", q.Name, ": ", err)
+		msg.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(msg)
+		return
+	} else if soa == nil {
+		msg.SetRcode(req, dns.RcodeNotAuth)
+		w.WriteMsg(msg)
+		return
+	}
+
+	var rrs []dns.RR
+	if q.Qtype == dns.TypeIXFR {
+		var serial uint32
+		if len(req.Ns) > 0 {
+			if clientSOA, ok := req.Ns[0].(*dns.SOA); ok {
+				serial = clientSOA.Serial
+			}
+		}
+		if latest, entries, ok := h.journal.Changes(q.Name, serial); ok {
+			incrementalCounter.Inc(1)
+			rrs = incrementalTransfer(latest, entries)
+		}
+		if !tcp || len(rrs) == 1 {
+			msg.Answer = []dns.RR{soa}
+			w.WriteMsg(msg)
+			return
+		}
+	}
+	if rrs == nil {
+		rrs = append(append([]dns.RR{soa}, records...), soa)
+	}
+
+	debugMsg("Transferring ", len(rrs), " records in zone ", q.Name, " to ", w.RemoteAddr())
+	envelopes := make(chan *dns.Envelope)
+	go func() {
+		defer close(envelopes)
+		var chunk []dns.RR
+		size := 0
+		for _, rr := range rrs {
+			if len(chunk) > 0 && size+dns.Len(rr) > transferMessageSize {
+				envelopes <- &dns.Envelope{RR: chunk}
+				chunk, size = nil, 0
+			}
+			chunk = append(chunk, rr)
+			size += dns.Len(rr)
+		}
+		envelopes <- &dns.Envelope{RR: chunk}
+	}()
+
+	transfer := new(dns.Transfer)
+	if err := transfer.Out(w, req, envelopes); err != nil {
+		debugMsg("Error transferring zone ", q.Name, ": ", err)
+		for range envelopes {
+		}
+	}
+}
+
+// incrementalTransfer returns the records making up an IXFR response for the
+// given changes (RFC 1995). The response starts and ends with the latest SOA,
+// and each change is sent as the SOA of the old version followed by the
+// records deleted, then the SOA of the new version followed by the records
+// added. If there are no changes only the latest SOA is returned.
+func incrementalTransfer(soa *dns.SOA, entries []*JournalEntry) []dns.RR {
+	rrs := []dns.RR{soa}
+	if len(entries) == 0 {
+		return rrs
+	}
+	for _, entry := range entries {
+		from := dns.Copy(soa).(*dns.SOA)
+		from.Serial = entry.From
+		to := dns.Copy(soa).(*dns.SOA)
+		to.Serial = entry.To
+		rrs = append(rrs, from)
+		rrs = append(rrs, entry.Deleted...)
+		rrs = append(rrs, to)
+		rrs = append(rrs, entry.Added...)
+	}
+	return append(rrs, soa)
+}
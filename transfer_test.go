@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testResponseWriter is a dns.ResponseWriter that keeps every message written
+// to it
+type testResponseWriter struct {
+	remoteAddr net.Addr
+	tsigStatus error
+	msgs       []*dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+func (w *testResponseWriter) RemoteAddr() net.Addr        { return w.remoteAddr }
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error   { w.msgs = append(w.msgs, m); return nil }
+func (w *testResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testResponseWriter) Close() error                { return nil }
+func (w *testResponseWriter) TsigStatus() error           { return w.tsigStatus }
+func (w *testResponseWriter) TsigTimersOnly(bool)         {}
+func (w *testResponseWriter) Hijack()                     {}
+
+var testTransferRecords = map[string]string{
+	"ns1/.A":       "1.1.1.1",
+	"www/.A/0":     "1.1.1.2",
+	"www/.A/1":     "1.1.1.3",
+	"www/.UNKNOWN": "ignored",
+	"sub/.SOA":     "ns1.sub.disco.net.\tadmin.sub.disco.net.\t3600\t600\t86400\t10",
+	"sub/.NS":      "ns1.sub.disco.net.",
+	"sub/foo/.A":   "1.1.1.4",
+}
+
+func TestZoneRecords(t *testing.T) {
+	resolver.etcdPrefix = "TestZoneRecords/"
+	newTestZone("TestZoneRecords", testTransferRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	soa, records, err := resolver.ZoneRecords("disco.net.")
+	if err != nil {
+		t.Fatal("Error returned reading zone: ", err)
+	}
+	if soa == nil || soa.Hdr.Name != "disco.net." {
+		t.Fatal("Expected SOA for disco.net.: ", soa)
+	}
+
+	counts := make(map[string]int)
+	for _, rr := range records {
+		counts[rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype]]++
+	}
+	expected := map[string]int{
+		"disco.net. NS":     1,
+		"ns1.disco.net. A":  1,
+		"www.disco.net. A":  2,
+		"sub.disco.net. NS": 1,
+	}
+	if len(counts) != len(expected) {
+		t.Fatal("Unexpected records in zone: ", records)
+	}
+	for name, count := range expected {
+		if counts[name] != count {
+			t.Fatalf("Expected %d %s records, got %d", count, name, counts[name])
+		}
+	}
+}
+
+func TestZoneRecordsNotAuthoritative(t *testing.T) {
+	resolver.etcdPrefix = "TestZoneRecordsNotAuthoritative/"
+	newTestZone("TestZoneRecordsNotAuthoritative", testTransferRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	soa, records, err := resolver.ZoneRecords("www.disco.net.")
+	if err != nil {
+		t.Fatal("Error returned reading zone: ", err)
+	}
+	if soa != nil || len(records) != 0 {
+		t.Fatal("Expected no SOA or records for www.disco.net.: ", soa, records)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	resolver.etcdPrefix = "TestTransfer/"
+	newTestZone("TestTransfer", testTransferRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	h := &handler{resolver: resolver, transferAllow: parseNetworks([]string{"10.0.0.0/8"}), journal: NewJournal(resolver, 10)}
+	req := new(dns.Msg)
+	req.SetAxfr("disco.net.")
+
+	w := &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}}
+	h.Transfer(w, req)
+
+	var rrs []dns.RR
+	for _, msg := range w.msgs {
+		if msg.Rcode != dns.RcodeSuccess {
+			t.Fatal("Expected successful transfer: ", msg)
+		}
+		rrs = append(rrs, msg.Answer...)
+	}
+	if len(rrs) != 7 {
+		t.Fatal("Expected 7 records in transfer: ", rrs)
+	}
+	if rrs[0].Header().Rrtype != dns.TypeSOA || rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA {
+		t.Fatal("Expected transfer to begin and end with the SOA: ", rrs)
+	}
+}
+
+func TestTransferRefused(t *testing.T) {
+	resolver.etcdPrefix = "TestTransferRefused/"
+	newTestZone("TestTransferRefused", testTransferRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	h := &handler{resolver: resolver, transferAllow: parseNetworks([]string{"10.0.0.0/8"}), journal: NewJournal(resolver, 10)}
+	req := new(dns.Msg)
+	req.SetAxfr("disco.net.")
+
+	addrs := []net.Addr{
+		&net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234},
+		&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234},
+	}
+	for _, addr := range addrs {
+		w := &testResponseWriter{remoteAddr: addr}
+		h.Transfer(w, req)
+		if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeRefused {
+			t.Fatal("Expected transfer to be refused for ", addr, ": ", w.msgs)
+		}
+	}
+}
+
+func TestTransferNotAuthoritative(t *testing.T) {
+	resolver.etcdPrefix = "TestTransferNotAuthoritative/"
+	newTestZone("TestTransferNotAuthoritative", testTransferRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	h := &handler{resolver: resolver, transferAllow: parseNetworks([]string{"10.1.2.3"}), journal: NewJournal(resolver, 10)}
+	req := new(dns.Msg)
+	req.SetAxfr("www.disco.net.")
+
+	w := &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}}
+	h.Transfer(w, req)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeNotAuth {
+		t.Fatal("Expected NOTAUTH response: ", w.msgs)
+	}
+}
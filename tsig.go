@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Allowed difference in seconds between the time a TSIG signed message claims
+// to have been signed and the time it's received
+const tsigFudge = 300
+
+// Names of the TSIG algorithms that can be used for keys
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// Sizes in bytes of the MACs made by each of the TSIG algorithms
+var tsigMACSizes = map[string]int{
+	dns.HmacMD5:    16,
+	dns.HmacSHA1:   20,
+	dns.HmacSHA256: 32,
+	dns.HmacSHA512: 64,
+}
+
+// TsigKey is a shared secret used to authenticate zone transfers, dynamic
+// updates and notifications (RFC 2845). A key can be limited to a set of
+// zones (and any zones beneath them), otherwise it can be used for any zone.
+type TsigKey struct {
+	Name      string
+	Algorithm string
+	Secret    string
+	Zones     []string
+}
+
+// allows returns true if the key can be used for the given zone
+func (k *TsigKey) allows(zone string) bool {
+	if len(k.Zones) == 0 {
+		return true
+	}
+	for _, allowed := range k.Zones {
+		if dns.IsSubDomain(dns.Fqdn(strings.ToLower(allowed)), dns.Fqdn(strings.ToLower(zone))) {
+			return true
+		}
+	}
+	return false
+}
+
+// sign adds a TSIG record to the message, to be signed with the key when the
+// message is written
+func (k *TsigKey) sign(msg *dns.Msg) {
+	msg.SetTsig(k.Name, k.Algorithm, tsigFudge, time.Now().Unix())
+}
+
+// size returns the number of bytes the TSIG record added to a message signed
+// with the key takes up: the owner name, type, class, TTL and data length
+// followed by the algorithm, time signed, fudge, MAC size, MAC, original ID,
+// error and other data length.
+func (k *TsigKey) size() int {
+	return len(dns.Fqdn(k.Name)) + 1 + 10 + len(dns.Fqdn(k.Algorithm)) + 1 + 6 + 2 + 2 + tsigMACSizes[k.Algorithm] + 2 + 2 + 2
+}
+
+// tsigSecrets returns the secrets of the keys, as used by the dns package to
+// sign and verify messages
+func tsigSecrets(keys map[string]*TsigKey) map[string]string {
+	secrets := make(map[string]string)
+	for name, key := range keys {
+		secrets[name] = key.Secret
+	}
+	return secrets
+}
+
+// authorize checks whether a transfer or update of the zone is allowed,
+// returning the rcode to refuse it with if not.
+//
+// Signed requests must use a key that can be used for the zone, and also come
+// from one of the given networks unless there are none. Once there are TSIG
+// keys every request must be signed, unless unsigned requests are explicitly
+// allowed, in which case (as without keys) they're allowed from the networks.
+func (h *handler) authorize(w dns.ResponseWriter, req *dns.Msg, networks []*net.IPNet, zone string) int {
+	if tsig := req.IsTsig(); tsig != nil {
+		key, ok := h.tsigKeys[strings.ToLower(tsig.Hdr.Name)]
+		if !ok || w.TsigStatus() != nil {
+			debugMsg("Invalid TSIG signature from ", w.RemoteAddr(), ": ", w.TsigStatus())
+			return dns.RcodeNotAuth
+		}
+		if !key.allows(zone) || (len(networks) > 0 && !addrAllowed(w.RemoteAddr(), networks)) {
+			return dns.RcodeRefused
+		}
+		return dns.RcodeSuccess
+	}
+
+	if (len(h.tsigKeys) > 0 && !h.allowUnsigned) || !addrAllowed(w.RemoteAddr(), networks) {
+		return dns.RcodeRefused
+	}
+	return dns.RcodeSuccess
+}
+
+// signingWriter returns a ResponseWriter that signs every message written to it
+// with the key the request was signed with. If the request wasn't signed (or
+// the signature isn't valid) the writer is returned untouched.
+func (h *handler) signingWriter(w dns.ResponseWriter, req *dns.Msg) dns.ResponseWriter {
+	tsig := req.IsTsig()
+	if tsig == nil || w.TsigStatus() != nil {
+		return w
+	}
+	key, ok := h.tsigKeys[strings.ToLower(tsig.Hdr.Name)]
+	if !ok {
+		return w
+	}
+	return &tsigResponseWriter{ResponseWriter: w, key: key}
+}
+
+// tsigResponseWriter signs each message written to it. Only the first message
+// of a response is signed in full, subsequent messages (in a zone transfer)
+// only cover the timers, as described in RFC 2845 section 4.4.
+type tsigResponseWriter struct {
+	dns.ResponseWriter
+	key     *TsigKey
+	written bool
+}
+
+// WriteMsg implements dns.ResponseWriter
+func (w *tsigResponseWriter) WriteMsg(msg *dns.Msg) error {
+	if w.written {
+		w.ResponseWriter.TsigTimersOnly(true)
+	}
+	w.written = true
+	w.key.sign(msg)
+	return w.ResponseWriter.WriteMsg(msg)
+}
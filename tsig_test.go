@@ -0,0 +1,223 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var testTsigKeys = map[string]*TsigKey{
+	"transfer.": {Name: "transfer.", Algorithm: dns.HmacSHA256, Secret: "c2VjcmV0"},
+	"sub.":      {Name: "sub.", Algorithm: dns.HmacSHA256, Secret: "c2VjcmV0", Zones: []string{"sub.disco.net."}},
+}
+
+func TestTsigKeyAllows(t *testing.T) {
+	key := &TsigKey{Name: "key.", Zones: []string{"disco.net.", "Disco.ORG"}}
+
+	for _, zone := range []string{"disco.net.", "sub.disco.net.", "disco.org."} {
+		if !key.allows(zone) {
+			t.Fatal("Expected key to be allowed for ", zone)
+		}
+	}
+	for _, zone := range []string{"net.", "notdisco.net.", "."} {
+		if key.allows(zone) {
+			t.Fatal("Expected key not to be allowed for ", zone)
+		}
+	}
+	if key := (&TsigKey{Name: "key."}); !key.allows("anything.") {
+		t.Fatal("Expected key without zones to be allowed for any zone")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	internal := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}
+	external := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}
+	networks := parseNetworks([]string{"10.0.0.0/8"})
+
+	signed := func(key string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetAxfr("sub.disco.net.")
+		if key != "" {
+			req.SetTsig(key, dns.HmacSHA256, tsigFudge, 0)
+		}
+		return req
+	}
+
+	tests := []struct {
+		keys       map[string]*TsigKey
+		unsigned   bool
+		networks   []*net.IPNet
+		addr       net.Addr
+		req        *dns.Msg
+		tsigStatus error
+		zone       string
+		rcode      int
+	}{
+		// Without keys, only the networks are checked
+		{nil, false, networks, internal, signed(""), nil, "disco.net.", dns.RcodeSuccess},
+		{nil, false, networks, external, signed(""), nil, "disco.net.", dns.RcodeRefused},
+		{nil, false, nil, internal, signed(""), nil, "disco.net.", dns.RcodeRefused},
+		// Signed requests are accepted from anywhere
+		{testTsigKeys, false, nil, internal, signed(""), nil, "disco.net.", dns.RcodeRefused},
+		{testTsigKeys, false, nil, external, signed("transfer."), nil, "disco.net.", dns.RcodeSuccess},
+		{testTsigKeys, false, nil, external, signed("unknown."), nil, "disco.net.", dns.RcodeNotAuth},
+		{testTsigKeys, false, nil, external, signed("transfer."), dns.ErrSig, "disco.net.", dns.RcodeNotAuth},
+		// Keys can be limited to zones
+		{testTsigKeys, false, nil, external, signed("sub."), nil, "sub.disco.net.", dns.RcodeSuccess},
+		{testTsigKeys, false, nil, external, signed("sub."), nil, "disco.net.", dns.RcodeRefused},
+		// And networks still apply if given
+		{testTsigKeys, false, networks, internal, signed("transfer."), nil, "disco.net.", dns.RcodeSuccess},
+		{testTsigKeys, false, networks, external, signed("transfer."), nil, "disco.net.", dns.RcodeRefused},
+		// With keys, unsigned requests are refused even from the networks...
+		{testTsigKeys, false, networks, internal, signed(""), nil, "disco.net.", dns.RcodeRefused},
+		// ...unless they're explicitly allowed
+		{testTsigKeys, true, networks, internal, signed(""), nil, "disco.net.", dns.RcodeSuccess},
+		{testTsigKeys, true, networks, external, signed(""), nil, "disco.net.", dns.RcodeRefused},
+		{testTsigKeys, true, networks, internal, signed("transfer."), nil, "disco.net.", dns.RcodeSuccess},
+	}
+	for i, test := range tests {
+		h := &handler{tsigKeys: test.keys, allowUnsigned: test.unsigned}
+		w := &testResponseWriter{remoteAddr: test.addr, tsigStatus: test.tsigStatus}
+		if rcode := h.authorize(w, test.req, test.networks, test.zone); rcode != test.rcode {
+			t.Fatalf("Test %d: expected %s, got %s", i, dns.RcodeToString[test.rcode], dns.RcodeToString[rcode])
+		}
+	}
+}
+
+func TestUpdateSigned(t *testing.T) {
+	resolver.etcdPrefix = "TestUpdateSigned/"
+	newTestZone("TestUpdateSigned", testUpdateRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	h := &handler{resolver: resolver, tsigKeys: testTsigKeys}
+	update := new(dns.Msg)
+	update.SetUpdate("disco.net.")
+	update.Insert([]dns.RR{newTestRR(t, "www.disco.net. 300 IN A 1.1.1.2")})
+	update.SetTsig("transfer.", dns.HmacSHA256, tsigFudge, 0)
+
+	w := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}}
+	h.Update(w, update)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeSuccess {
+		t.Fatal("Expected update to succeed: ", w.msgs)
+	}
+	if tsig := w.msgs[0].IsTsig(); tsig == nil || tsig.Hdr.Name != "transfer." {
+		t.Fatal("Expected response to be signed: ", w.msgs[0])
+	}
+}
+
+func TestTransferSigned(t *testing.T) {
+	resolver.etcdPrefix = "TestTransferSigned/"
+	newTestZone("TestTransferSigned", testTransferRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Unable to listen: ", err)
+	}
+	h := &handler{resolver: resolver, tsigKeys: testTsigKeys, journal: NewJournal(resolver, 10)}
+	started := make(chan bool)
+	server := &dns.Server{
+		Listener:          listener,
+		Handler:           dns.HandlerFunc(h.Transfer),
+		TsigSecret:        tsigSecrets(testTsigKeys),
+		NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+
+	transfer := &dns.Transfer{TsigSecret: tsigSecrets(testTsigKeys)}
+	req := new(dns.Msg)
+	req.SetAxfr("disco.net.")
+	req.SetTsig("transfer.", dns.HmacSHA256, tsigFudge, time.Now().Unix())
+	envelopes, err := transfer.In(req, listener.Addr().String())
+	if err != nil {
+		t.Fatal("Unable to start transfer: ", err)
+	}
+
+	var rrs []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			t.Fatal("Error in transfer: ", envelope.Error)
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+	if len(rrs) != 7 {
+		t.Fatal("Expected 7 records in transfer: ", rrs)
+	}
+}
+
+func TestTransferSignedIncremental(t *testing.T) {
+	journalStore := NewMemoryStore()
+	journalStore.Set("/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	journalStore.Set("/net/disco/www/.A/0", "1.1.1.1")
+	resolver := &Resolver{store: journalStore}
+	resolver.serials = NewZoneSerials(resolver)
+
+	// Transfers can only be made with a TSIG key, but changes are still tracked
+	s := &server{tsigKeys: testTsigKeys, journalSize: 10}
+	stop := make(chan bool)
+	defer close(stop)
+	journal := s.newJournal(resolver, stop)
+	if soa, _, err := journal.Zone("disco.net."); err != nil || soa == nil || soa.Serial != 2 {
+		t.Fatal("Expected zone disco.net. to be tracked with serial 2: ", soa, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	journalStore.Set("/net/disco/www/.A/1", "1.1.1.2")
+	waitForSerial(t, journal, "disco.net.", 3)
+
+	h := &handler{resolver: resolver, tsigKeys: testTsigKeys, journal: journal}
+	req := new(dns.Msg)
+	req.SetIxfr("disco.net.", 2, "ns1.disco.net.", "admin.disco.net.")
+	req.SetTsig("transfer.", dns.HmacSHA256, tsigFudge, 0)
+	w := &testResponseWriter{remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}}
+	h.Transfer(w, req)
+
+	var rrs []dns.RR
+	for _, msg := range w.msgs {
+		rrs = append(rrs, msg.Answer...)
+	}
+	// SOA 3, SOA 2, SOA 3, added A, SOA 3
+	if len(rrs) != 5 {
+		t.Fatal("Expected 5 records in incremental transfer: ", rrs)
+	}
+}
+
+func TestHandleSignedSize(t *testing.T) {
+	resolver.etcdPrefix = "TestHandleSignedSize/"
+	newTestZone("TestHandleSignedSize", testLargeRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	query := func(key string, size uint16) *dns.Msg {
+		h := newTestHandler()
+		h.tsigKeys = testTsigKeys
+		h.ednsSize = size
+		req := new(dns.Msg)
+		req.SetQuestion("big.disco.net.", dns.TypeTXT)
+		req.SetEdns0(4096, false)
+		if key != "" {
+			req.SetTsig(key, dns.HmacSHA256, tsigFudge, 0)
+		}
+		w := &testResponseWriter{remoteAddr: testUDPAddr}
+		h.Handle(w, req)
+		return w.msgs[0]
+	}
+
+	// A limit the unsigned response only just fits in
+	unsigned := query("", 4096)
+	size := uint16(unsigned.Len())
+	if msg := query("", size); msg.Truncated {
+		t.Fatal("Expected the unsigned response to fit in ", size, " bytes")
+	}
+
+	// The signed response doesn't fit once the TSIG record is added
+	msg := query("transfer.", size)
+	if !msg.Truncated || msg.IsTsig() == nil {
+		t.Fatal("Expected a truncated signed response, got ", msg)
+	}
+	if signed := msg.Len() + tsigMACSizes[dns.HmacSHA256]; signed > int(size) {
+		t.Fatalf("Expected the signed response to fit in %d bytes, got %d", size, signed)
+	}
+}
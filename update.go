@@ -0,0 +1,560 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Updates are applied one at a time, so that the prerequisites of one update
+// can't be invalidated by another update made through the same server.
+// Updates made elsewhere are caught by the conditional writes to the store.
+var updateLock sync.Mutex
+
+// zoneUpdate is a single dynamic update being applied to a zone. Each record
+// set is read from the store once, the first time it's needed, and the
+// prerequisites are checked against those reads. The conditional writes that
+// follow are based on the same reads, so a record set that is changed
+// elsewhere after its prerequisites were checked fails the update. Record sets
+// are read again once they've been written to.
+type zoneUpdate struct {
+	*Resolver
+	zone string
+	sets map[string][]*storedRecord
+}
+
+// storedRecord is a single record held in the store, along with the key
+// holding its TTL (if any)
+type storedRecord struct {
+	node  *Node
+	ttl   *Node
+	value string
+}
+
+// Update applies an RFC 2136 dynamic update to the zone, returning the rcode
+// to answer with. The prerequisites are checked against the records currently
+// in the store, then each update is written to it in turn. Records are read
+// straight from the store rather than from any cache in front of it, so that
+// each step of the update sees the ones before it.
+//
+// Records are added in the usual layout, as /net/disco/.A/<id> with the TTL
+// in /net/disco/.A/<id>.ttl, where the id is derived from the value of the
+// record. A record set held in a single key (/net/disco/.A) is moved into a
+// directory before anything is added to it. Existing keys are only changed or
+// removed if they haven't been modified since they were read, and the update
+// fails with SERVFAIL if they have. Note that etcd can't apply several writes
+// atomically, so a failed update may have been partially applied.
+func (r *Resolver) Update(zone string, prereqs []dns.RR, updates []dns.RR) int {
+	updateLock.Lock()
+	defer updateLock.Unlock()
+
+	uncached := *r
+	uncached.store = uncachedStore(r.store)
+	zone = dns.Fqdn(strings.ToLower(zone))
+	u := &zoneUpdate{Resolver: &uncached, zone: zone, sets: make(map[string][]*storedRecord)}
+	if soa := u.Authority(zone); soa == nil || soa.Hdr.Name != zone {
+		return dns.RcodeNotAuth
+	}
+
+	if rcode := u.checkPrerequisites(zone, prereqs); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	if rcode := prescanUpdates(zone, updates); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+
+	for _, rr := range updates {
+		if err := u.applyUpdate(zone, rr); err != nil {
+			debugMsg("Error applying update ", rr, ": ", err)
+			if _, ok := err.(*ReadOnlyError); ok {
+				return dns.RcodeRefused
+			}
+			return dns.RcodeServerFailure
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// checkPrerequisites checks the prerequisite section of an update (RFC 2136
+// section 3.2), returning the rcode to fail the update with if any of them
+// don't hold.
+func (u *zoneUpdate) checkPrerequisites(zone string, prereqs []dns.RR) int {
+	expected := make(map[string][]string)
+	for _, rr := range prereqs {
+		header := rr.Header()
+		name := strings.ToLower(header.Name)
+		if header.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+		if !dns.IsSubDomain(zone, name) {
+			return dns.RcodeNotZone
+		}
+
+		switch header.Class {
+		case dns.ClassANY:
+			if header.Rrtype == dns.TypeANY {
+				if inUse, err := u.nameInUse(name); err != nil {
+					return dns.RcodeServerFailure
+				} else if !inUse {
+					return dns.RcodeNameError
+				}
+			} else if records, err := u.storedRecords(name, header.Rrtype); err != nil {
+				return dns.RcodeServerFailure
+			} else if len(records) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if header.Rrtype == dns.TypeANY {
+				if inUse, err := u.nameInUse(name); err != nil {
+					return dns.RcodeServerFailure
+				} else if inUse {
+					return dns.RcodeYXDomain
+				}
+			} else if records, err := u.storedRecords(name, header.Rrtype); err != nil {
+				return dns.RcodeServerFailure
+			} else if len(records) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			value, err := encodeRecord(rr)
+			if err != nil {
+				return dns.RcodeFormatError
+			}
+			set := name + " " + strconv.Itoa(int(header.Rrtype))
+			expected[set] = append(expected[set], value)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// Value dependent prerequisites must match the whole record set
+	for set, values := range expected {
+		parts := strings.SplitN(set, " ", 2)
+		rrType, _ := strconv.Atoi(parts[1])
+		records, err := u.storedRecords(parts[0], uint16(rrType))
+		if err != nil {
+			return dns.RcodeServerFailure
+		}
+		if !sameValues(records, values) {
+			return dns.RcodeNXRrset
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// prescanUpdates checks the update section of an update (RFC 2136 section
+// 3.4.1), before anything is written.
+func prescanUpdates(zone string, updates []dns.RR) int {
+	for _, rr := range updates {
+		header := rr.Header()
+		if !dns.IsSubDomain(zone, strings.ToLower(header.Name)) {
+			return dns.RcodeNotZone
+		}
+
+		switch header.Class {
+		case dns.ClassINET:
+			if _, ok := converters[header.Rrtype]; !ok {
+				return dns.RcodeRefused
+			}
+		case dns.ClassANY:
+			if header.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+			if _, ok := converters[header.Rrtype]; !ok && header.Rrtype != dns.TypeANY {
+				return dns.RcodeRefused
+			}
+		case dns.ClassNONE:
+			if header.Ttl != 0 {
+				return dns.RcodeFormatError
+			}
+			if _, ok := converters[header.Rrtype]; !ok {
+				return dns.RcodeRefused
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	return dns.RcodeSuccess
+}
+
+// applyUpdate writes a single update (RFC 2136 section 3.4.2) to the store
+func (u *zoneUpdate) applyUpdate(zone string, rr dns.RR) error {
+	header := rr.Header()
+	name := strings.ToLower(header.Name)
+	apex := name == zone
+
+	switch header.Class {
+	case dns.ClassINET:
+		if header.Rrtype == dns.TypeSOA && !apex {
+			return nil
+		}
+		// CNAMEs can't live alongside any other records
+		cnames, err := u.storedRecords(name, dns.TypeCNAME)
+		if err != nil {
+			return err
+		}
+		if header.Rrtype != dns.TypeCNAME && len(cnames) > 0 {
+			return nil
+		} else if header.Rrtype == dns.TypeCNAME {
+			if inUse, err := u.nameInUse(name); err != nil {
+				return err
+			} else if inUse && len(cnames) == 0 {
+				return nil
+			}
+		}
+		return u.addRecord(name, rr)
+
+	case dns.ClassANY:
+		if header.Rrtype == dns.TypeANY {
+			node, err := u.store.Get(u.etcdPrefix + nameToKey(name, ""))
+			if _, ok := err.(*KeyNotFoundError); ok {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			for _, child := range node.Nodes {
+				base := path.Base(child.Key)
+				rrType, ok := dns.StringToType[strings.TrimPrefix(base, ".")]
+				if !strings.HasPrefix(base, ".") || !ok || (apex && (rrType == dns.TypeSOA || rrType == dns.TypeNS)) {
+					continue
+				}
+				if err := u.deleteRecordSet(name, rrType); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if apex && (header.Rrtype == dns.TypeSOA || header.Rrtype == dns.TypeNS) {
+			return nil
+		}
+		return u.deleteRecordSet(name, header.Rrtype)
+
+	case dns.ClassNONE:
+		if header.Rrtype == dns.TypeSOA {
+			return nil
+		}
+		if apex && header.Rrtype == dns.TypeNS {
+			nameservers, err := u.storedRecords(name, dns.TypeNS)
+			if err != nil {
+				return err
+			}
+			if len(nameservers) <= 1 {
+				return nil
+			}
+		}
+		return u.deleteRecord(name, rr)
+	}
+	return nil
+}
+
+// addRecord adds a record to its record set. If the record is already there
+// its TTL is replaced, and an SOA record replaces the existing one.
+func (u *zoneUpdate) addRecord(name string, rr dns.RR) error {
+	header := rr.Header()
+	setKey := u.etcdPrefix + nameToKey(name, "/."+dns.TypeToString[header.Rrtype])
+	store, err := writableStore(u.store, setKey)
+	if err != nil {
+		return err
+	}
+	defer u.forget(setKey)
+	value, err := encodeRecord(rr)
+	if err != nil {
+		return err
+	}
+
+	records, err := u.storedRecords(name, header.Rrtype)
+	if err != nil {
+		return err
+	}
+	if header.Rrtype == dns.TypeSOA && len(records) > 0 {
+		// Leave the serial to discodns, unless it was given explicitly
+		existing := records[0]
+		if len(strings.Split(existing.node.Value, "\t")) == 6 {
+			parts := strings.Split(value, "\t")
+			value = strings.Join(append(parts[:2], parts[3:]...), "\t")
+		}
+		return store.CompareAndSwap(existing.node.Key, value, existing.node.ModifiedIndex)
+	}
+	ttl := strconv.FormatUint(uint64(header.Ttl), 10)
+	for _, record := range records {
+		if record.value != value {
+			continue
+		} else if record.ttl == nil {
+			return store.Create(record.node.Key+".ttl", ttl)
+		} else if record.ttl.Value != ttl {
+			return store.CompareAndSwap(record.ttl.Key, ttl, record.ttl.ModifiedIndex)
+		}
+		return nil
+	}
+
+	// Move a record set held in a single key into a directory
+	if len(records) == 1 && cleanKey(records[0].node.Key) == cleanKey(setKey) {
+		existing := records[0]
+		if err := store.CompareAndDelete(existing.node.Key, existing.node.ModifiedIndex); err != nil {
+			return err
+		}
+		id := recordID(existing.value)
+		if err := store.Create(setKey+"/"+id, existing.node.Value); err != nil {
+			return err
+		}
+		if existing.ttl != nil {
+			if err := store.Create(setKey+"/"+id+".ttl", existing.ttl.Value); err != nil {
+				return err
+			}
+			if err := store.CompareAndDelete(existing.ttl.Key, existing.ttl.ModifiedIndex); err != nil {
+				return err
+			}
+		}
+	}
+
+	key := setKey + "/" + recordID(value)
+	if err := store.Create(key, value); err != nil {
+		return err
+	}
+	return store.Create(key+".ttl", ttl)
+}
+
+// deleteRecord removes a single record from its record set
+func (u *zoneUpdate) deleteRecord(name string, rr dns.RR) error {
+	setKey := u.etcdPrefix + nameToKey(name, "/."+dns.TypeToString[rr.Header().Rrtype])
+	store, err := writableStore(u.store, setKey)
+	if err != nil {
+		return err
+	}
+	defer u.forget(setKey)
+	value, err := encodeRecord(rr)
+	if err != nil {
+		return err
+	}
+
+	records, err := u.storedRecords(name, rr.Header().Rrtype)
+	if err != nil {
+		return err
+	}
+	deleted := false
+	for _, record := range records {
+		if record.value != value {
+			continue
+		}
+		if err := deleteStoredRecord(store, record); err != nil {
+			return err
+		}
+		deleted = true
+	}
+	if !deleted {
+		return nil
+	}
+	return u.tidyRecordSet(store, setKey)
+}
+
+// deleteRecordSet removes every record of the type from the name
+func (u *zoneUpdate) deleteRecordSet(name string, rrType uint16) error {
+	setKey := u.etcdPrefix + nameToKey(name, "/."+dns.TypeToString[rrType])
+	store, err := writableStore(u.store, setKey)
+	if err != nil {
+		return err
+	}
+	defer u.forget(setKey)
+
+	records, err := u.storedRecords(name, rrType)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := deleteStoredRecord(store, record); err != nil {
+			return err
+		}
+	}
+	if err := store.Delete(setKey + ".ttl"); err != nil {
+		if _, ok := err.(*KeyNotFoundError); !ok {
+			return err
+		}
+	}
+	return u.tidyRecordSet(store, setKey)
+}
+
+// deleteStoredRecord removes a record and its TTL from the store, as long as
+// neither has changed since they were read
+func deleteStoredRecord(store WritableRecordStore, record *storedRecord) error {
+	if err := store.CompareAndDelete(record.node.Key, record.node.ModifiedIndex); err != nil {
+		return err
+	}
+	if record.ttl != nil {
+		return store.CompareAndDelete(record.ttl.Key, record.ttl.ModifiedIndex)
+	}
+	return nil
+}
+
+// tidyRecordSet removes the directory of a record set once the last record
+// in it has gone, along with any parent directories left empty up to the apex
+// of the zone. etcd keeps empty directories, which would otherwise leave the
+// name existing without any records.
+func (u *zoneUpdate) tidyRecordSet(store WritableRecordStore, setKey string) error {
+	apex := cleanKey(u.etcdPrefix + nameToKey(u.zone, ""))
+	for key := cleanKey(setKey); key != apex && keyWithin(key, apex); key = path.Dir(key) {
+		node, err := u.store.Get(key)
+		if _, ok := err.(*KeyNotFoundError); ok {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !node.Dir || len(node.Nodes) > 0 {
+			return nil
+		}
+		if err := store.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedRecords returns the records of a record set as they're held in the
+// store, reading them the first time the record set is needed (or after it
+// has been written to).
+func (u *zoneUpdate) storedRecords(name string, rrType uint16) ([]*storedRecord, error) {
+	setKey := cleanKey(u.etcdPrefix + nameToKey(name, "/."+dns.TypeToString[rrType]))
+	if records, ok := u.sets[setKey]; ok {
+		return records, nil
+	}
+	records, err := u.readRecords(name, rrType)
+	if err != nil {
+		return nil, err
+	}
+	u.sets[setKey] = records
+	return records, nil
+}
+
+// forget drops what was read of a record set, once it has been written to
+func (u *zoneUpdate) forget(setKey string) {
+	delete(u.sets, cleanKey(setKey))
+}
+
+// readRecords reads the records of a record set from the store. The value of
+// each is normalised by converting it to a dns.RR and back, so that it can be
+// compared with the records in an update.
+func (u *zoneUpdate) readRecords(name string, rrType uint16) (records []*storedRecord, err error) {
+	setKey := u.etcdPrefix + nameToKey(name, "/."+dns.TypeToString[rrType])
+	node, err := u.store.Get(setKey)
+	if _, ok := err.(*KeyNotFoundError); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ttls := make(map[string]*Node)
+	var leaves []*Node
+	if node.Dir {
+		for _, child := range node.Nodes {
+			// Records scoped to a client subnet aren't part of the record set
+			// that updates see
+			if strings.HasPrefix(path.Base(child.Key), "@") {
+				continue
+			}
+			for _, leaf := range child.Leaves() {
+				if strings.HasSuffix(leaf.Key, ".ttl") {
+					ttls[strings.TrimSuffix(leaf.Key, ".ttl")] = leaf
+				} else {
+					leaves = append(leaves, leaf)
+				}
+			}
+		}
+	} else {
+		leaves = []*Node{node}
+		if ttl, err := u.store.Get(setKey + ".ttl"); err == nil {
+			ttls[node.Key] = ttl
+		}
+	}
+
+	converter := converters[rrType]
+	for _, leaf := range leaves {
+		record := &storedRecord{node: leaf, ttl: ttls[leaf.Key], value: leaf.Value}
+		if converter != nil {
+			if rr, err := converter(leaf, dns.RR_Header{Name: name, Rrtype: rrType, Class: dns.ClassINET}); err == nil {
+				if value, err := encodeRecord(rr); err == nil {
+					record.value = value
+				}
+			}
+		}
+		records = append(records, record)
+	}
+	return
+}
+
+// nameInUse returns true if the name has any records
+func (u *zoneUpdate) nameInUse(name string) (bool, error) {
+	node, err := u.store.Get(u.etcdPrefix + nameToKey(name, ""))
+	if _, ok := err.(*KeyNotFoundError); ok {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for _, child := range node.Nodes {
+		base := path.Base(child.Key)
+		if strings.HasPrefix(base, ".") && !strings.HasSuffix(base, ".ttl") && len(child.Leaves()) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// sameValues returns true if the records hold exactly the given values
+func sameValues(records []*storedRecord, values []string) bool {
+	found := make(map[string]bool)
+	for _, record := range records {
+		found[record.value] = true
+	}
+	wanted := make(map[string]bool)
+	for _, value := range values {
+		wanted[value] = true
+	}
+	if len(found) != len(wanted) {
+		return false
+	}
+	for value := range wanted {
+		if !found[value] {
+			return false
+		}
+	}
+	return true
+}
+
+// recordID returns the id of the key to store a record value under
+func recordID(value string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(value)))[:12]
+}
+
+// Update answers a DNS UPDATE message, applying it to the store if the client
+// is authorized to update the zone (see authorize). The response is signed if
+// the request was signed with a TSIG key.
+func (h *handler) Update(w dns.ResponseWriter, req *dns.Msg) {
+	requestCounter := metrics.GetOrRegisterCounter("request.handler.update.requests", metrics.DefaultRegistry)
+	refusedCounter := metrics.GetOrRegisterCounter("request.handler.update.refused", metrics.DefaultRegistry)
+	failedCounter := metrics.GetOrRegisterCounter("request.handler.update.failed", metrics.DefaultRegistry)
+	requestCounter.Inc(1)
+
+	w = h.signingWriter(w, req)
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+		msg.SetRcode(req, dns.RcodeFormatError)
+	} else if rcode := h.authorize(w, req, h.updateAllow, req.Question[0].Name); rcode != dns.RcodeSuccess {
+		debugMsg("Refusing update from ", w.RemoteAddr())
+		refusedCounter.Inc(1)
+		msg.SetRcode(req, rcode)
+	} else {
+		rcode := h.resolver.Update(req.Question[0].Name, req.Answer, req.Ns)
+		if rcode != dns.RcodeSuccess {
+			failedCounter.Inc(1)
+		}
+		debugMsg("Update of zone ", req.Question[0].Name, " from ", w.RemoteAddr(), ": ", dns.RcodeToString[rcode])
+		msg.SetRcode(req, rcode)
+	}
+	w.WriteMsg(msg)
+}
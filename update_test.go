@@ -0,0 +1,371 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var testUpdateRecords = map[string]string{
+	"ns1/.A": "1.1.1.1",
+}
+
+func newTestRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal("Unable to parse record: ", err)
+	}
+	return rr
+}
+
+func TestUpdateAddAndRemove(t *testing.T) {
+	resolver.etcdPrefix = "TestUpdateAddAndRemove/"
+	newTestZone("TestUpdateAddAndRemove", testUpdateRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	update := new(dns.Msg)
+	update.SetUpdate("disco.net.")
+	update.Insert([]dns.RR{
+		newTestRR(t, "www.disco.net. 300 IN A 1.1.1.2"),
+		newTestRR(t, "www.disco.net. 300 IN A 1.1.1.3"),
+		newTestRR(t, "_acme-challenge.disco.net. 60 IN TXT \"token\"")})
+	if rcode := resolver.Update("disco.net.", update.Answer, update.Ns); rcode != dns.RcodeSuccess {
+		t.Fatal("Expected update to succeed: ", dns.RcodeToString[rcode])
+	}
+
+	records, _ := resolver.LookupAnswersForType("www.disco.net.", dns.TypeA)
+	if len(records) != 2 {
+		t.Fatal("Expected two A records: ", records)
+	}
+	if records[0].Header().Ttl != 300 {
+		t.Fatal("Expected TTL to be 300: ", records[0].Header().Ttl)
+	}
+	records, _ = resolver.LookupAnswersForType("_acme-challenge.disco.net.", dns.TypeTXT)
+	if len(records) != 1 || records[0].(*dns.TXT).Txt[0] != "token" {
+		t.Fatal("Expected TXT record with value token: ", records)
+	}
+
+	update = new(dns.Msg)
+	update.SetUpdate("disco.net.")
+	update.Remove([]dns.RR{newTestRR(t, "www.disco.net. 300 IN A 1.1.1.2")})
+	update.RemoveRRset([]dns.RR{newTestRR(t, "_acme-challenge.disco.net. 60 IN TXT \"token\"")})
+	if rcode := resolver.Update("disco.net.", update.Answer, update.Ns); rcode != dns.RcodeSuccess {
+		t.Fatal("Expected update to succeed: ", dns.RcodeToString[rcode])
+	}
+
+	records, _ = resolver.LookupAnswersForType("www.disco.net.", dns.TypeA)
+	if len(records) != 1 || records[0].(*dns.A).A.String() != "1.1.1.3" {
+		t.Fatal("Expected only 1.1.1.3 to remain: ", records)
+	}
+	if _, err := store.Get("TestUpdateAddAndRemove/net/disco/_acme-challenge/.TXT"); err == nil {
+		t.Fatal("Expected TXT record set to be deleted")
+	}
+
+	// Removing the last record tidies up the record set
+	update = new(dns.Msg)
+	update.SetUpdate("disco.net.")
+	update.Remove([]dns.RR{newTestRR(t, "www.disco.net. 300 IN A 1.1.1.3")})
+	if rcode := resolver.Update("disco.net.", update.Answer, update.Ns); rcode != dns.RcodeSuccess {
+		t.Fatal("Expected update to succeed: ", dns.RcodeToString[rcode])
+	}
+	if _, err := store.Get("TestUpdateAddAndRemove/net/disco/www/.A"); err == nil {
+		t.Fatal("Expected A record set to be deleted")
+	}
+}
+
+func TestUpdateDeleteName(t *testing.T) {
+	resolver.etcdPrefix = "TestUpdateDeleteName/"
+	newTestZone("TestUpdateDeleteName", map[string]string{
+		"foo/.A":        "1.1.1.2",
+		"foo/.TXT/0":    "hello",
+		"deep/er/.A/0":  "1.1.1.3",
+		"deep/er2/.A/0": "1.1.1.4",
+	})
+	defer store.Delete(resolver.etcdPrefix)
+
+	update := new(dns.Msg)
+	update.SetUpdate("disco.net.")
+	update.RemoveName([]dns.RR{
+		newTestRR(t, "foo.disco.net. 0 IN A 1.1.1.2"),
+		newTestRR(t, "er.deep.disco.net. 0 IN A 1.1.1.3")})
+	if rcode := resolver.Update("disco.net.", update.Answer, update.Ns); rcode != dns.RcodeSuccess {
+		t.Fatal("Expected update to succeed: ", dns.RcodeToString[rcode])
+	}
+
+	// The names are gone altogether, rather than left without any records
+	query := new(dns.Msg)
+	query.SetQuestion("foo.disco.net.", dns.TypeA)
+	if answer := resolver.Lookup(query); answer.Rcode != dns.RcodeNameError {
+		t.Fatal("Expected NXDOMAIN for the deleted name, got ", dns.RcodeToString[answer.Rcode])
+	}
+	for _, key := range []string{"foo", "deep/er"} {
+		if _, err := store.Get("TestUpdateDeleteName/net/disco/" + key); err == nil {
+			t.Fatal("Expected the directory of the deleted name to be removed: ", key)
+		}
+	}
+	if _, err := store.Get("TestUpdateDeleteName/net/disco/deep/er2/.A"); err != nil {
+		t.Fatal("Expected the other records beneath deep.disco.net. to be kept: ", err)
+	}
+}
+
+func TestUpdateSubnetRecords(t *testing.T) {
+	resolver.etcdPrefix = "TestUpdateSubnetRecords/"
+	newTestZone("TestUpdateSubnetRecords", map[string]string{
+		"www/.A/0":                    "1.1.1.2",
+		"www/.A/@10.1.0.0-16/0":       "2.2.2.2",
+		"www/.A/@10.1.0.0-16/0.ttl":   "60",
+		"www/.A/@10.1.3.0-24/0":       "3.3.3.3",
+		"www/.TXT/@10.1.0.0-16/0":     "scoped",
+		"www/.TXT/@10.1.0.0-16/0.ttl": "60",
+	})
+	defer store.Delete(resolver.etcdPrefix)
+	scoped := []string{"www/.A/@10.1.0.0-16/0", "www/.A/@10.1.3.0-24/0", "www/.TXT/@10.1.0.0-16/0"}
+
+	// The records scoped to a subnet don't satisfy prerequisites
+	update := new(dns.Msg)
+	update.SetUpdate("disco.net.")
+	update.Used([]dns.RR{newTestRR(t, "www.disco.net. 0 IN A 2.2.2.2")})
+	if rcode := resolver.Update("disco.net.", update.Answer, update.Ns); rcode != dns.RcodeNXRrset {
+		t.Fatal("Expected the prerequisite to fail, got ", dns.RcodeToString[rcode])
+	}
+	update = new(dns.Msg)
+	update.SetUpdate("disco.net.")
+	update.RRsetNotUsed([]dns.RR{newTestRR(t, "www.disco.net. 0 IN TXT \"scoped\"")})
+	if rcode := resolver.Update("disco.net.", update.Answer, update.Ns); rcode != dns.RcodeSuccess {
+		t.Fatal("Expected the prerequisite to hold, got ", dns.RcodeToString[rcode])
+	}
+
+	// Adding a record with the same value as a scoped one adds it to the
+	// record set everyone else sees
+	update = new(dns.Msg)
+	update.SetUpdate("disco.net.")
+	update.Insert([]dns.RR{newTestRR(t, "www.disco.net. 300 IN A 2.2.2.2")})
+	if rcode := resolver.Update("disco.net.", update.Answer, update.Ns); rcode != dns.RcodeSuccess {
+		t.Fatal("Expected update to succeed: ", dns.RcodeToString[rcode])
+	}
+	records, _ := resolver.LookupAnswersForType("www.disco.net.", dns.TypeA)
+	if len(records) != 2 {
+		t.Fatal("Expected the record to be added alongside 1.1.1.2: ", records)
+	}
+	if ttl, err := store.Get("TestUpdateSubnetRecords/net/disco/www/.A/@10.1.0.0-16/0.ttl"); err != nil || ttl.Value != "60" {
+		t.Fatal("Expected the TTL of the scoped record to be left alone")
+	}
+
+	// Deleting record sets leaves the scoped records in place
+	update = new(dns.Msg)
+	update.SetUpdate("disco.net.")
+	update.RemoveRRset([]dns.RR{
+		newTestRR(t, "www.disco.net. 0 IN A 1.1.1.2"),
+		newTestRR(t, "www.disco.net. 0 IN TXT \"scoped\"")})
+	if rcode := resolver.Update("disco.net.", update.Answer, update.Ns); rcode != dns.RcodeSuccess {
+		t.Fatal("Expected update to succeed: ", dns.RcodeToString[rcode])
+	}
+	if records, _ = resolver.LookupAnswersForType("www.disco.net.", dns.TypeA); len(records) != 0 {
+		t.Fatal("Expected the A record set to be deleted: ", records)
+	}
+	for _, key := range scoped {
+		if _, err := store.Get("TestUpdateSubnetRecords/net/disco/" + key); err != nil {
+			t.Fatal("Expected the scoped record to be kept: ", key)
+		}
+	}
+}
+
+func TestUpdateSingleKeyRecordSet(t *testing.T) {
+	resolver.etcdPrefix = "TestUpdateSingleKeyRecordSet/"
+	newTestZone("TestUpdateSingleKeyRecordSet", testUpdateRecords)
+	store.Set("TestUpdateSingleKeyRecordSet/net/disco/www/.A", "1.1.1.2")
+	store.Set("TestUpdateSingleKeyRecordSet/net/disco/www/.A.ttl", "30")
+	defer store.Delete(resolver.etcdPrefix)
+
+	update := new(dns.Msg)
+	update.SetUpdate("disco.net.")
+	update.Insert([]dns.RR{newTestRR(t, "www.disco.net. 300 IN A 1.1.1.3")})
+	if rcode := resolver.Update("disco.net.", update.Answer, update.Ns); rcode != dns.RcodeSuccess {
+		t.Fatal("Expected update to succeed: ", dns.RcodeToString[rcode])
+	}
+
+	records, _ := resolver.LookupAnswersForType("www.disco.net.", dns.TypeA)
+	if len(records) != 2 {
+		t.Fatal("Expected two A records: ", records)
+	}
+	for _, rr := range records {
+		a := rr.(*dns.A)
+		if a.A.String() == "1.1.1.2" && a.Hdr.Ttl != 30 {
+			t.Fatal("Expected the existing record to keep its TTL: ", a)
+		}
+	}
+	if _, err := store.Get("TestUpdateSingleKeyRecordSet/net/disco/www/.A.ttl"); err == nil {
+		t.Fatal("Expected the single key TTL to have moved")
+	}
+}
+
+func TestUpdateReplacesTTL(t *testing.T) {
+	resolver.etcdPrefix = "TestUpdateReplacesTTL/"
+	newTestZone("TestUpdateReplacesTTL", testUpdateRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	for _, ttl := range []string{"300", "60"} {
+		update := new(dns.Msg)
+		update.SetUpdate("disco.net.")
+		update.Insert([]dns.RR{
+			newTestRR(t, "www.disco.net. "+ttl+" IN A 1.1.1.2"),
+			newTestRR(t, "ns1.disco.net. "+ttl+" IN A 1.1.1.1")})
+		if rcode := resolver.Update("disco.net.", update.Answer, update.Ns); rcode != dns.RcodeSuccess {
+			t.Fatal("Expected update to succeed: ", dns.RcodeToString[rcode])
+		}
+	}
+
+	// Both the record added with a TTL and the one without have the new TTL
+	for _, name := range []string{"www.disco.net.", "ns1.disco.net."} {
+		records, _ := resolver.LookupAnswersForType(name, dns.TypeA)
+		if len(records) != 1 || records[0].Header().Ttl != 60 {
+			t.Fatal("Expected a single A record with TTL 60: ", records)
+		}
+	}
+}
+
+func TestUpdateConcurrentChange(t *testing.T) {
+	resolver.etcdPrefix = "TestUpdateConcurrentChange/"
+	newTestZone("TestUpdateConcurrentChange", testUpdateRecords)
+	store.Set("TestUpdateConcurrentChange/net/disco/www/.A/0", "1.1.1.2")
+	defer store.Delete(resolver.etcdPrefix)
+
+	// The prerequisites see the record set before it's changed elsewhere
+	u := &zoneUpdate{Resolver: resolver, sets: make(map[string][]*storedRecord)}
+	prereq := newTestRR(t, "www.disco.net. 0 IN A 1.1.1.2")
+	if rcode := u.checkPrerequisites("disco.net.", []dns.RR{prereq}); rcode != dns.RcodeSuccess {
+		t.Fatal("Expected prerequisites to hold: ", dns.RcodeToString[rcode])
+	}
+	store.Set("TestUpdateConcurrentChange/net/disco/www/.A/0", "1.1.1.2")
+
+	err := u.applyUpdate("disco.net.", newTestRR(t, "www.disco.net. 0 NONE A 1.1.1.2"))
+	if _, ok := err.(*CompareFailedError); !ok {
+		t.Fatal("Expected the change to be detected, got ", err)
+	}
+}
+
+func TestUpdateUncached(t *testing.T) {
+	cache := NewCachedStore(store, "/", time.Minute)
+	if uncachedStore(cache) != store {
+		t.Fatal("Expected updates to bypass the cache")
+	}
+
+	routingStore, err := NewRoutingStore([]*Route{{Zone: ".", Backends: []string{"cache"}}}, map[string]RecordStore{"cache": cache})
+	if err != nil {
+		t.Fatal("Unable to create routing store: ", err)
+	}
+	uncached := uncachedStore(routingStore).(*RoutingStore)
+	if uncached.routes[0].stores[0] != store || routingStore.routes[0].stores[0] != cache {
+		t.Fatal("Expected routes to bypass the cache, leaving the original alone")
+	}
+}
+
+func TestUpdatePrerequisites(t *testing.T) {
+	resolver.etcdPrefix = "TestUpdatePrerequisites/"
+	newTestZone("TestUpdatePrerequisites", testUpdateRecords)
+	store.Set("TestUpdatePrerequisites/net/disco/www/.A", "1.1.1.2")
+	defer store.Delete(resolver.etcdPrefix)
+
+	existing := newTestRR(t, "www.disco.net. 0 IN A 1.1.1.2")
+	missing := newTestRR(t, "missing.disco.net. 0 IN A 1.1.1.2")
+	wrong := newTestRR(t, "www.disco.net. 0 IN A 1.1.1.9")
+	outside := newTestRR(t, "www.other.net. 0 IN A 1.1.1.2")
+
+	tests := []struct {
+		prereq func(m *dns.Msg)
+		rcode  int
+	}{
+		{func(m *dns.Msg) { m.NameUsed([]dns.RR{existing}) }, dns.RcodeSuccess},
+		{func(m *dns.Msg) { m.NameUsed([]dns.RR{missing}) }, dns.RcodeNameError},
+		{func(m *dns.Msg) { m.NameNotUsed([]dns.RR{missing}) }, dns.RcodeSuccess},
+		{func(m *dns.Msg) { m.NameNotUsed([]dns.RR{existing}) }, dns.RcodeYXDomain},
+		{func(m *dns.Msg) { m.RRsetUsed([]dns.RR{existing}) }, dns.RcodeSuccess},
+		{func(m *dns.Msg) { m.RRsetUsed([]dns.RR{missing}) }, dns.RcodeNXRrset},
+		{func(m *dns.Msg) { m.RRsetNotUsed([]dns.RR{missing}) }, dns.RcodeSuccess},
+		{func(m *dns.Msg) { m.RRsetNotUsed([]dns.RR{existing}) }, dns.RcodeYXRrset},
+		{func(m *dns.Msg) { m.Used([]dns.RR{existing}) }, dns.RcodeSuccess},
+		{func(m *dns.Msg) { m.Used([]dns.RR{wrong}) }, dns.RcodeNXRrset},
+		{func(m *dns.Msg) { m.NameUsed([]dns.RR{outside}) }, dns.RcodeNotZone},
+	}
+	for i, test := range tests {
+		update := new(dns.Msg)
+		update.SetUpdate("disco.net.")
+		test.prereq(update)
+		update.Insert([]dns.RR{newTestRR(t, "new.disco.net. 300 IN A 1.1.1.4")})
+
+		if rcode := resolver.Update("disco.net.", update.Answer, update.Ns); rcode != test.rcode {
+			t.Fatalf("Test %d: expected %s, got %s", i, dns.RcodeToString[test.rcode], dns.RcodeToString[rcode])
+		}
+		records, _ := resolver.LookupAnswersForType("new.disco.net.", dns.TypeA)
+		if (test.rcode == dns.RcodeSuccess) != (len(records) == 1) {
+			t.Fatalf("Test %d: update should only be applied if the prerequisites hold", i)
+		}
+		store.Delete("TestUpdatePrerequisites/net/disco/new")
+	}
+}
+
+func TestUpdateProtectsApex(t *testing.T) {
+	resolver.etcdPrefix = "TestUpdateProtectsApex/"
+	newTestZone("TestUpdateProtectsApex", testUpdateRecords)
+	store.Set("TestUpdateProtectsApex/net/disco/.MX", "10\tmail.disco.net.")
+	defer store.Delete(resolver.etcdPrefix)
+
+	update := new(dns.Msg)
+	update.SetUpdate("disco.net.")
+	update.RemoveName([]dns.RR{newTestRR(t, "disco.net. 0 IN A 1.1.1.1")})
+	update.Remove([]dns.RR{newTestRR(t, "disco.net. 0 IN NS ns1.disco.net.")})
+	if rcode := resolver.Update("disco.net.", update.Answer, update.Ns); rcode != dns.RcodeSuccess {
+		t.Fatal("Expected update to succeed: ", dns.RcodeToString[rcode])
+	}
+
+	if records, _ := resolver.LookupAnswersForType("disco.net.", dns.TypeMX); len(records) != 0 {
+		t.Fatal("Expected MX records to be deleted: ", records)
+	}
+	if records, _ := resolver.LookupAnswersForType("disco.net.", dns.TypeNS); len(records) != 1 {
+		t.Fatal("Expected the last NS record to be kept: ", records)
+	}
+	if soa := resolver.Authority("disco.net."); soa == nil {
+		t.Fatal("Expected the SOA record to be kept")
+	}
+}
+
+func TestUpdateNotAuthoritative(t *testing.T) {
+	resolver.etcdPrefix = "TestUpdateNotAuthoritative/"
+	newTestZone("TestUpdateNotAuthoritative", testUpdateRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	update := new(dns.Msg)
+	update.SetUpdate("www.disco.net.")
+	update.Insert([]dns.RR{newTestRR(t, "www.disco.net. 300 IN A 1.1.1.2")})
+	if rcode := resolver.Update("www.disco.net.", update.Answer, update.Ns); rcode != dns.RcodeNotAuth {
+		t.Fatal("Expected NOTAUTH: ", dns.RcodeToString[rcode])
+	}
+}
+
+func TestUpdateHandler(t *testing.T) {
+	resolver.etcdPrefix = "TestUpdateHandler/"
+	newTestZone("TestUpdateHandler", testUpdateRecords)
+	defer store.Delete(resolver.etcdPrefix)
+
+	h := &handler{resolver: resolver, updateAllow: parseNetworks([]string{"10.0.0.0/8"})}
+	update := new(dns.Msg)
+	update.SetUpdate("disco.net.")
+	update.Insert([]dns.RR{newTestRR(t, "www.disco.net. 300 IN A 1.1.1.2")})
+
+	w := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}}
+	h.Update(w, update)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeRefused {
+		t.Fatal("Expected update to be refused: ", w.msgs)
+	}
+
+	w = &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}}
+	h.Update(w, update)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeSuccess {
+		t.Fatal("Expected update to succeed: ", w.msgs)
+	}
+	if records, _ := resolver.LookupAnswersForType("www.disco.net.", dns.TypeA); len(records) != 1 {
+		t.Fatal("Expected the A record to have been added: ", records)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"path"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/rcrowley/go-metrics"
+)
+
+// View is a different set of records served to some clients, those querying
+// from one of its networks or signing their queries with one of its TSIG keys.
+// Its records are kept beneath their own prefix in the store, for example
+//
+//	/views/internal/net/disco/api/.A -> 10.0.0.1
+//
+// and any record set the view doesn't have is taken from the records every
+// other client sees, so a view only needs to hold the records that differ.
+type View struct {
+	Prefix   string
+	Networks []*net.IPNet
+	Keys     []string
+
+	resolver *Resolver
+}
+
+// newResolver returns a copy of the resolver that answers queries with the
+// records of the view, falling back to those of the resolver itself.
+func (v *View) newResolver(resolver *Resolver) *Resolver {
+	viewResolver := *resolver
+	viewResolver.etcdPrefix = v.Prefix
+
+	// Routes are for keys without the view's prefix, so the view's own keys
+	// have to be routed as if it wasn't there
+	store := resolver.store
+	if routingStore, ok := store.(*RoutingStore); ok {
+		store = routingStore.withPrefix(v.Prefix)
+	}
+	viewResolver.store = &viewStore{
+		RecordStore: store,
+		prefix:      cleanKey(v.Prefix),
+		fallback:    cleanKey(resolver.etcdPrefix),
+		route:       &Route{Backends: []string{"view", "default"}}}
+	if resolver.serials != nil {
+		viewResolver.serials = NewZoneSerials(&viewResolver)
+		viewResolver.serials.fallback = resolver.serials
+	}
+	return &viewResolver
+}
+
+// matches returns true if the request should be answered from the view
+func (v *View) matches(w dns.ResponseWriter, req *dns.Msg) bool {
+	if tsig := req.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		name := strings.ToLower(tsig.Hdr.Name)
+		for _, key := range v.Keys {
+			if key == name {
+				return true
+			}
+		}
+	}
+	return len(v.Networks) > 0 && addrAllowed(w.RemoteAddr(), v.Networks)
+}
+
+// viewResolver returns the resolver to answer a query with, that of the first
+// view matching the request or otherwise the default.
+func (h *handler) viewResolver(w dns.ResponseWriter, req *dns.Msg) *Resolver {
+	viewCounter := metrics.GetOrRegisterCounter("request.handler.view", metrics.DefaultRegistry)
+
+	for _, view := range h.views {
+		if view.matches(w, req) {
+			viewCounter.Inc(1)
+			return view.resolver
+		}
+	}
+	return h.resolver
+}
+
+// viewStore is a RecordStore that overlays the keys beneath a view's prefix on
+// those beneath the fallback prefix, in the same way as a Route with two
+// backends. Keys outside of the view are read as they are.
+type viewStore struct {
+	RecordStore
+	prefix   string
+	fallback string
+	route    *Route
+}
+
+// Get implements RecordStore
+func (s *viewStore) Get(key string) (*Node, error) {
+	key = cleanKey(key)
+	if s.prefix == "/" || !keyWithin(key, s.prefix) {
+		return s.RecordStore.Get(key)
+	}
+	fallbackKey := path.Join(s.fallback, strings.TrimPrefix(key, s.prefix))
+
+	nodes := make([]*Node, 2)
+	for i, k := range []string{key, fallbackKey} {
+		node, err := s.RecordStore.Get(k)
+		if _, ok := err.(*KeyNotFoundError); ok {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		nodes[i] = rekeyNode(node, k, key)
+	}
+
+	node := s.route.overlay(key, nodes, make([]*Node, 2))
+	if node == nil {
+		return nil, &KeyNotFoundError{Key: key}
+	}
+	return node, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestViewLookup(t *testing.T) {
+	resolver.etcdPrefix = "TestViewLookup/"
+	store.Set("TestViewLookup/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	store.Set("TestViewLookup/net/disco/api/.A", "1.1.1.1")
+	store.Set("TestViewLookup/net/disco/api/.TXT", "public")
+	store.Set("TestViewLookup/net/disco/www/.A", "1.1.1.2")
+	store.Set("TestViewLookup/views/internal/net/disco/api/.A/0", "10.0.0.1")
+	store.Set("TestViewLookup/views/internal/net/disco/api/.A/1", "10.0.0.2")
+	store.Set("TestViewLookup/views/internal/net/disco/db/.A", "10.0.0.3")
+	defer store.Delete(resolver.etcdPrefix)
+
+	view := &View{Prefix: "TestViewLookup/views/internal"}
+	viewResolver := view.newResolver(resolver)
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		answers []string
+	}{
+		// The view's own records hide the default ones
+		{"api.disco.net.", dns.TypeA, []string{"10.0.0.1", "10.0.0.2"}},
+		// Anything else comes from the default records
+		{"api.disco.net.", dns.TypeTXT, []string{"public"}},
+		{"www.disco.net.", dns.TypeA, []string{"1.1.1.2"}},
+		{"db.disco.net.", dns.TypeA, []string{"10.0.0.3"}},
+	}
+	for _, test := range tests {
+		query := new(dns.Msg)
+		query.SetQuestion(test.name, test.qtype)
+		answer := viewResolver.Lookup(query)
+		if len(answer.Answer) != len(test.answers) {
+			t.Fatalf("Expected %v for %s, got %v", test.answers, test.name, answer.Answer)
+		}
+		for i, rr := range answer.Answer {
+			var value string
+			switch rr := rr.(type) {
+			case *dns.A:
+				value = rr.A.String()
+			case *dns.TXT:
+				value = rr.Txt[0]
+			}
+			if value != test.answers[i] || rr.Header().Name != test.name {
+				t.Fatalf("Expected %v for %s, got %v", test.answers, test.name, answer.Answer)
+			}
+		}
+	}
+
+	// Everyone else doesn't see the view's records
+	query := new(dns.Msg)
+	query.SetQuestion("db.disco.net.", dns.TypeA)
+	if answer := resolver.Lookup(query); answer.Rcode != dns.RcodeNameError {
+		t.Fatal("Expected NXDOMAIN outside of the view, got ", answer)
+	}
+}
+
+func TestViewResolver(t *testing.T) {
+	internal := &View{Prefix: "/views/internal", Networks: parseNetworks([]string{"10.0.0.0/8"})}
+	partner := &View{Prefix: "/views/partner", Keys: []string{"transfer."}}
+	h := &handler{resolver: resolver, tsigKeys: testTsigKeys, views: []*View{internal, partner}}
+	for _, view := range h.views {
+		view.resolver = view.newResolver(resolver)
+	}
+
+	signed := func(key string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("disco.net.", dns.TypeA)
+		if key != "" {
+			req.SetTsig(key, dns.HmacSHA256, tsigFudge, 0)
+		}
+		return req
+	}
+	internalAddr := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}
+	externalAddr := &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}
+
+	tests := []struct {
+		addr       net.Addr
+		req        *dns.Msg
+		tsigStatus error
+		resolver   *Resolver
+	}{
+		{internalAddr, signed(""), nil, internal.resolver},
+		{externalAddr, signed(""), nil, resolver},
+		{externalAddr, signed("transfer."), nil, partner.resolver},
+		{externalAddr, signed("sub."), nil, resolver},
+		{externalAddr, signed("transfer."), dns.ErrSig, resolver},
+		// The first view to match wins
+		{internalAddr, signed("transfer."), nil, internal.resolver},
+	}
+	for i, test := range tests {
+		w := &testResponseWriter{remoteAddr: test.addr, tsigStatus: test.tsigStatus}
+		if r := h.viewResolver(w, test.req); r != test.resolver {
+			t.Fatalf("Test %d: expected the resolver with prefix '%s', got '%s'", i, test.resolver.etcdPrefix, r.etcdPrefix)
+		}
+	}
+}
+
+func TestViewRoutes(t *testing.T) {
+	routingStore, first, second := newTestRoutingStore(t,
+		&Route{Zone: ".", Backends: []string{"first"}},
+		&Route{Zone: "static.disco.net.", Backends: []string{"second"}})
+	first.Set("/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10")
+	first.Set("/net/disco/static/www/.A", "1.1.1.1")
+	first.Set("/views/internal/net/disco/static/www/.A", "1.1.1.2")
+	second.Set("/net/disco/static/www/.A", "1.1.1.3")
+	second.Set("/views/internal/net/disco/static/db/.A", "10.0.0.1")
+
+	view := &View{Prefix: "/views/internal"}
+	viewResolver := view.newResolver(&Resolver{store: routingStore})
+
+	// The view's keys are routed by the zone they're for, so the records of
+	// static.disco.net. come from the second backend with or without the view
+	tests := map[string]string{
+		"www.static.disco.net.": "1.1.1.3",
+		"db.static.disco.net.":  "10.0.0.1",
+	}
+	for name, address := range tests {
+		records, err := viewResolver.LookupAnswersForType(name, dns.TypeA)
+		if err != nil {
+			t.Fatal("Failed to look up ", name, ": ", err)
+		}
+		if len(records) != 1 || records[0].(*dns.A).A.String() != address {
+			t.Fatalf("Expected %s for %s, got %v", address, name, records)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneFile is an RFC 1035 master file, and the origin to parse it with
+type ZoneFile struct {
+	Origin string
+	Path   string
+}
+
+// ZoneFileStore is a read-only RecordStore serving the records held in a set
+// of zone files. Records are laid out in the same way as they would be in
+// etcd, so the zone file
+//
+//	$ORIGIN disco.net.
+//	@    300 IN A 1.1.1.1
+//	www  60  IN A 1.1.1.2
+//
+// is served as the keys
+//
+//	/net/disco/.A/0 -> 1.1.1.1
+//	/net/disco/.A/0.ttl -> 300
+//	/net/disco/www/.A/0 -> 1.1.1.2
+//	/net/disco/www/.A/0.ttl -> 60
+//
+// Record types that discodns doesn't know how to serve are skipped. The files
+// are checked periodically by Run, and reloaded when they change.
+type ZoneFileStore struct {
+	sync.Mutex
+	files    []ZoneFile
+	modTimes map[string]time.Time
+	store    *MemoryStore
+}
+
+// NewZoneFileStore creates a RecordStore from the given zone files, returning
+// an error if any of them can't be loaded.
+func NewZoneFileStore(files []ZoneFile) (*ZoneFileStore, error) {
+	s := &ZoneFileStore{
+		files:    files,
+		modTimes: make(map[string]time.Time),
+		store:    NewMemoryStore()}
+	if err := s.Load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get implements RecordStore
+func (s *ZoneFileStore) Get(key string) (*Node, error) {
+	return s.store.Get(key)
+}
+
+// Snapshot implements SnapshotRecordStore
+func (s *ZoneFileStore) Snapshot(key string) (*Node, uint64, error) {
+	return s.store.Snapshot(key)
+}
+
+// Watch implements RecordStore. An event is sent for each key that changes
+// when the zone files are reloaded.
+func (s *ZoneFileStore) Watch(key string, waitIndex uint64, events chan *StoreEvent, stop chan bool) error {
+	return s.store.Watch(key, waitIndex, events, stop)
+}
+
+// Run checks the zone files for changes every interval, reloading them when
+// they have been modified. It blocks until the stop channel is closed.
+func (s *ZoneFileStore) Run(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s.modified() {
+				logger.Printf("Zone files changed, reloading")
+				if err := s.Load(); err != nil {
+					logger.Printf("[WARNING] Failed to reload zone files, keeping existing records: %s", err)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Load parses all of the zone files, and updates the store with any keys that
+// have been added, changed or removed since they were last loaded. If any of
+// the files fail to parse the existing records are left untouched.
+func (s *ZoneFileStore) Load() error {
+	s.Lock()
+	defer s.Unlock()
+
+	modTimes := make(map[string]time.Time)
+	values := make(map[string]string)
+	for _, file := range s.files {
+		if info, err := os.Stat(file.Path); err == nil {
+			modTimes[file.Path] = info.ModTime()
+		}
+		if err := loadZoneFile(file, values); err != nil {
+			return err
+		}
+	}
+
+	// Only once every file has parsed are the records swapped in, all at once
+	s.store.Replace(values)
+
+	s.modTimes = modTimes
+	return nil
+}
+
+// modified returns true if any of the zone files have changed since they were
+// last loaded.
+func (s *ZoneFileStore) modified() bool {
+	s.Lock()
+	defer s.Unlock()
+	for _, file := range s.files {
+		info, err := os.Stat(file.Path)
+		if err != nil {
+			continue
+		}
+		if modTime, ok := s.modTimes[file.Path]; !ok || !modTime.Equal(info.ModTime()) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadZoneFile parses a single zone file, adding the keys and values for each
+// record to the given map.
+func loadZoneFile(file ZoneFile, values map[string]string) error {
+	reader, err := os.Open(file.Path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// Always read every token, so that the parser isn't left blocked
+	for token := range dns.ParseZone(reader, dns.Fqdn(file.Origin), file.Path) {
+		if err != nil {
+			continue
+		}
+		if token.Error != nil {
+			err = token.Error
+			continue
+		}
+		header := token.RR.Header()
+		if _, ok := converters[header.Rrtype]; !ok || header.Class != dns.ClassINET {
+			debugMsg("Skipping unsupported record in zone file: ", token.RR)
+			continue
+		}
+		var value string
+		if value, err = encodeRecord(token.RR); err != nil {
+			continue
+		}
+
+		// Records of the same name and type (possibly from different files)
+		// are numbered in the order they're found
+		dirKey := nameToKey(strings.ToLower(header.Name), "/."+dns.TypeToString[header.Rrtype])
+		key := dirKey + "/0"
+		for i := 1; ; i++ {
+			if _, exists := values[key]; !exists {
+				break
+			}
+			key = dirKey + "/" + strconv.Itoa(i)
+		}
+		values[key] = value
+		values[key+".ttl"] = strconv.FormatUint(uint64(header.Ttl), 10)
+	}
+	return err
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testZoneFile = `$ORIGIN disco.net.
+$TTL 300
+@       IN SOA ns1.disco.net. admin.disco.net. 1 3600 600 86400 10
+@       IN A 1.1.1.1
+@       IN A 1.1.1.2
+www  60 IN CNAME disco.net.
+_http._tcp IN SRV 10 20 80 www.disco.net.
+@       IN HINFO "unsupported" "type"
+`
+
+func writeTestZoneFile(t *testing.T, contents string) string {
+	file, err := ioutil.TempFile("", "discodns-zone")
+	if err != nil {
+		t.Fatal("Unable to create zone file", err)
+	}
+	defer file.Close()
+	file.WriteString(contents)
+	return file.Name()
+}
+
+func TestZoneFileStoreLoad(t *testing.T) {
+	path := writeTestZoneFile(t, testZoneFile)
+	defer os.Remove(path)
+
+	zoneFileStore, err := NewZoneFileStore([]ZoneFile{{Origin: ".", Path: path}})
+	if err != nil {
+		t.Fatal("Failed to load zone file", err)
+	}
+
+	node, err := zoneFileStore.Get("/net/disco/.A")
+	if err != nil {
+		t.Fatal("Error returned from store", err)
+	}
+	if len(node.Nodes) != 4 {
+		t.Fatal("Expected two A records with TTLs, got ", len(node.Nodes), " nodes")
+	}
+
+	if _, err := zoneFileStore.Get("/net/disco/.HINFO"); err == nil {
+		t.Fatal("Didn't expect unsupported record types to be stored")
+	}
+
+	zoneResolver := &Resolver{store: zoneFileStore}
+	records, _ := zoneResolver.LookupAnswersForType("www.disco.net.", dns.TypeCNAME)
+	if len(records) != 1 {
+		t.Fatal("Expected one answer, got ", len(records))
+	}
+	if records[0].Header().Ttl != 60 {
+		t.Fatal("Expected TTL of 60 seconds:", records[0].Header().Ttl)
+	}
+	if records[0].(*dns.CNAME).Target != "disco.net." {
+		t.Fatal("Expected CNAME target disco.net.: ", records[0])
+	}
+
+	records, _ = zoneResolver.LookupAnswersForType("_http._tcp.disco.net.", dns.TypeSRV)
+	if len(records) != 1 {
+		t.Fatal("Expected one answer, got ", len(records))
+	}
+	srv := records[0].(*dns.SRV)
+	if srv.Priority != 10 || srv.Weight != 20 || srv.Port != 80 || srv.Target != "www.disco.net." {
+		t.Fatal("Unexpected SRV record: ", srv)
+	}
+
+	records, _ = zoneResolver.LookupAnswersForType("disco.net.", dns.TypeSOA)
+	if len(records) != 1 || records[0].(*dns.SOA).Minttl != 10 {
+		t.Fatal("Expected an SOA record with a minimum TTL of 10: ", records)
+	}
+}
+
+func TestZoneFileStoreOrigin(t *testing.T) {
+	path := writeTestZoneFile(t, "@ 300 IN A 1.1.1.1\nwww 300 IN A 1.1.1.2\n")
+	defer os.Remove(path)
+
+	zoneFileStore, err := NewZoneFileStore(parseZoneFiles([]string{"disco.net:" + path}))
+	if err != nil {
+		t.Fatal("Failed to load zone file", err)
+	}
+	if _, err := zoneFileStore.Get("/net/disco/www/.A/0"); err != nil {
+		t.Fatal("Expected www.disco.net. to be loaded relative to the origin", err)
+	}
+}
+
+func TestParseZoneFiles(t *testing.T) {
+	tests := []struct {
+		file   string
+		origin string
+		path   string
+	}{
+		{"/etc/disco.net.zone", ".", "/etc/disco.net.zone"},
+		{"disco.net:/etc/disco.net.zone", "disco.net.", "/etc/disco.net.zone"},
+		{"disco.net:/etc/zones:old/disco.net.zone", "disco.net.", "/etc/zones:old/disco.net.zone"},
+		{"/etc/zones:old/disco.net.zone", ".", "/etc/zones:old/disco.net.zone"},
+		{`C:\zones\disco.net.zone`, ".", `C:\zones\disco.net.zone`},
+		{`disco.net:C:\zones\disco.net.zone`, "disco.net.", `C:\zones\disco.net.zone`},
+		{"localhost.:/etc/localhost.zone", "localhost.", "/etc/localhost.zone"},
+		{"localhost:/etc/localhost.zone", ".", "localhost:/etc/localhost.zone"},
+	}
+	for _, test := range tests {
+		zoneFile := parseZoneFiles([]string{test.file})[0]
+		if zoneFile.Origin != test.origin || zoneFile.Path != test.path {
+			t.Fatalf("Expected %s to be %s with origin %s, got %+v", test.file, test.path, test.origin, zoneFile)
+		}
+	}
+}
+
+func TestZoneFileStoreInvalidFile(t *testing.T) {
+	path := writeTestZoneFile(t, "disco.net. 300 IN A not-an-ip\n")
+	defer os.Remove(path)
+
+	if _, err := NewZoneFileStore([]ZoneFile{{Origin: ".", Path: path}}); err == nil {
+		t.Fatal("Expected an error loading an invalid zone file")
+	}
+}
+
+func TestZoneFileStoreReload(t *testing.T) {
+	path := writeTestZoneFile(t, testZoneFile)
+	defer os.Remove(path)
+
+	zoneFileStore, err := NewZoneFileStore([]ZoneFile{{Origin: ".", Path: path}})
+	if err != nil {
+		t.Fatal("Failed to load zone file", err)
+	}
+
+	stop := make(chan bool)
+	defer close(stop)
+	go zoneFileStore.Run(5*time.Millisecond, stop)
+
+	// Make sure the modification time changes, even on coarse filesystems
+	ioutil.WriteFile(path, []byte("$ORIGIN disco.net.\n@ 300 IN A 1.1.1.3\n"), 0644)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path, future, future)
+
+	waitForValue(t, zoneFileStore, "/net/disco/.A/0", "1.1.1.3")
+
+	if _, err := zoneFileStore.Get("/net/disco/.A/1"); err == nil {
+		t.Fatal("Expected the second A record to have been removed")
+	}
+	if _, err := zoneFileStore.Get("/net/disco/www"); err == nil {
+		t.Fatal("Expected the empty www.disco.net. directory to have been removed")
+	}
+}
+
+func TestZoneFileStoreFailedReload(t *testing.T) {
+	path := writeTestZoneFile(t, testZoneFile)
+	defer os.Remove(path)
+	other := writeTestZoneFile(t, "$ORIGIN disco.org.\n@ 300 IN A 2.2.2.2\n")
+	defer os.Remove(other)
+
+	zoneFileStore, err := NewZoneFileStore([]ZoneFile{{Origin: ".", Path: other}, {Origin: ".", Path: path}})
+	if err != nil {
+		t.Fatal("Failed to load zone files", err)
+	}
+
+	// Nothing changes unless every file parses, even those that are fine
+	ioutil.WriteFile(other, []byte("$ORIGIN disco.org.\n@ 300 IN A 2.2.2.3\n"), 0644)
+	ioutil.WriteFile(path, []byte("disco.net. 300 IN A not-an-ip\n"), 0644)
+	if err := zoneFileStore.Load(); err == nil {
+		t.Fatal("Expected an error reloading an invalid zone file")
+	}
+	for key, value := range map[string]string{"/org/disco/.A/0": "2.2.2.2", "/net/disco/.A/0": "1.1.1.1"} {
+		if node, err := zoneFileStore.Get(key); err != nil || node.Value != value {
+			t.Fatalf("Expected %s to still be %s, got %v (%v)", key, value, node, err)
+		}
+	}
+}